@@ -0,0 +1,202 @@
+package finalize
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Access is the `access:` section. Allow, Deny and ValidReferers apply to
+// every location that does not set its own; DenyUserAgents applies to the
+// whole server.
+type Access struct {
+	TrustedProxies AddressList   `yaml:"trusted_proxies"`
+	Allow          AddressList   `yaml:"allow"`
+	Deny           AddressList   `yaml:"deny"`
+	DenyUserAgents UserAgentList `yaml:"deny_user_agents"`
+	ValidReferers  RefererList   `yaml:"valid_referers"`
+}
+
+func (a Access) isSet() bool {
+	return !reflect.DeepEqual(a, Access{})
+}
+
+func (a Access) rules() *LocationAccess {
+	return &LocationAccess{Allow: a.Allow, Deny: a.Deny, ValidReferers: a.ValidReferers}
+}
+
+// LocationAccess is the `access:` of a location. Each list it sets replaces
+// the top-level one; allow: [all] opens a location the top level restricts.
+type LocationAccess struct {
+	Allow         AddressList `yaml:"allow"`
+	Deny          AddressList `yaml:"deny"`
+	ValidReferers RefererList `yaml:"valid_referers"`
+}
+
+func (a LocationAccess) isSet() bool {
+	return a.Allow != nil || a.Deny != nil || a.ValidReferers != nil
+}
+
+// AddressList holds IP addresses and CIDR ranges, or all.
+type AddressList []string
+
+func (l AddressList) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if err := checkAddress(item.Value); err != nil {
+			return nodeError{item, err.Error()}
+		}
+	}
+	return nil
+}
+
+func checkAddress(address string) error {
+	if address == "all" || net.ParseIP(address) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(address); err != nil {
+		return fmt.Errorf("invalid address %q, expected an IP address, a CIDR range or all", address)
+	}
+	return nil
+}
+
+func (l AddressList) valid() AddressList {
+	if l == nil {
+		return nil
+	}
+	valid := AddressList{}
+	for _, address := range l {
+		if checkAddress(address) == nil {
+			valid = append(valid, address)
+		}
+	}
+	return valid
+}
+
+// UserAgentList holds case-insensitive regular expressions matched against
+// User-Agent.
+type UserAgentList []string
+
+func (l UserAgentList) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if err := checkRegex(item.Value); err != nil {
+			return nodeError{item, err.Error()}
+		}
+	}
+	return nil
+}
+
+// RefererList holds valid_referers values: none, blocked, server_names, a
+// host name with an optional * at either end, or a ~regex.
+type RefererList []string
+
+func (l RefererList) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if err := checkReferer(item.Value); err != nil {
+			return nodeError{item, err.Error()}
+		}
+	}
+	return nil
+}
+
+func checkReferer(referer string) error {
+	if referer == "" || strings.ContainsAny(referer, " \t;{}\"'") {
+		return fmt.Errorf("invalid referer %q", referer)
+	}
+	if strings.HasPrefix(referer, "~") {
+		return checkRegex(strings.TrimPrefix(referer, "~"))
+	}
+	return nil
+}
+
+func (l RefererList) valid() RefererList {
+	if l == nil {
+		return nil
+	}
+	valid := RefererList{}
+	for _, referer := range l {
+		if checkReferer(referer) == nil {
+			valid = append(valid, referer)
+		}
+	}
+	return valid
+}
+
+// loadAccess resolves the `access:` section, dropping entries that failed
+// the schema check.
+func (sf *Finalizer) loadAccess(access Access) *Access {
+	loaded := &Access{
+		TrustedProxies: access.TrustedProxies.valid(),
+		Allow:          access.Allow.valid(),
+		Deny:           access.Deny.valid(),
+		ValidReferers:  access.ValidReferers.valid(),
+	}
+	for _, agent := range access.DenyUserAgents {
+		if checkRegex(agent) == nil {
+			loaded.DenyUserAgents = append(loaded.DenyUserAgents, agent)
+		}
+	}
+
+	sf.beginStep("access", "Enabling access control")
+	if len(loaded.TrustedProxies) > 0 {
+		sf.Log.Info("Using the client address from X-Forwarded-For sent by %s", strings.Join(loaded.TrustedProxies, ", "))
+	}
+	if len(loaded.DenyUserAgents) > 0 {
+		sf.Log.Info("Denying %d user agent patterns", len(loaded.DenyUserAgents))
+	}
+	return loaded
+}
+
+// locationAccess merges the access rules of a location over the top-level
+// ones.
+func (sf *Finalizer) locationAccess(rules LocationAccess) *LocationAccess {
+	merged := LocationAccess{}
+	if sf.Config.Access != nil {
+		merged = *sf.Config.Access.rules()
+	}
+	if rules.Allow != nil {
+		merged.Allow = rules.Allow.valid()
+	}
+	if rules.Deny != nil {
+		merged.Deny = rules.Deny.valid()
+	}
+	if rules.ValidReferers != nil {
+		merged.ValidReferers = rules.ValidReferers.valid()
+	}
+	return &merged
+}
+
+// accessRules is the template function picking the access rules of a
+// location block.
+func accessRules(s locationScope) *LocationAccess {
+	if s.Location.Access != nil {
+		return s.Location.Access
+	}
+	if s.Config.Access != nil {
+		return s.Config.Access.rules()
+	}
+	return nil
+}
+
+// hasAddressRules reports whether any location allows or denies by client
+// address.
+func hasAddressRules(conf Staticfile) bool {
+	scopes := []locationScope{rootScope(conf)}
+	for _, l := range conf.Locations {
+		scopes = append(scopes, scope(conf, l))
+	}
+	for _, s := range scopes {
+		if rules := accessRules(s); rules != nil && (len(rules.Allow) > 0 || len(rules.Deny) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustsProxies reports whether nginx takes the client address from
+// X-Forwarded-For, making $remote_addr the address to log.
+func trustsProxies(conf Staticfile) bool {
+	return conf.Access != nil && len(conf.Access.TrustedProxies) > 0
+}
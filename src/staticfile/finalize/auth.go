@@ -0,0 +1,266 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// defaultAuthFile holds the credentials for basic_auth unless the Staticfile
+// names another file with basic_auth_file.
+const defaultAuthFile = "Staticfile.auth"
+
+// AuthFile is an htpasswd file in the app directory.
+type AuthFile string
+
+func (f AuthFile) checkValue(node *yaml.Node) error {
+	if filepath.IsAbs(node.Value) || strings.HasPrefix(filepath.Clean(node.Value), "..") {
+		return fmt.Errorf("invalid credentials file %q, expected a path inside the app directory", node.Value)
+	}
+	return nil
+}
+
+// AuthRealm is the realm browsers show when asking for credentials.
+type AuthRealm string
+
+func (r AuthRealm) checkValue(node *yaml.Node) error {
+	if strings.Contains(node.Value, "<%") || strings.IndexFunc(node.Value, isControl) >= 0 {
+		return fmt.Errorf("invalid realm %q", node.Value)
+	}
+	return nil
+}
+
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+// stagedFile is a credentials or certificate file of the app staged as
+// nginx/conf/<Name>.
+type stagedFile struct {
+	Name string
+	Data []byte
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// htpasswdName names the staged copy of a credentials file. Staticfile.auth
+// keeps the .htpasswd name nginx.conf has always used.
+func htpasswdName(source string) string {
+	if source == defaultAuthFile {
+		return ".htpasswd"
+	}
+	return ".htpasswd-" + unsafeFileChars.ReplaceAllString(filepath.ToSlash(filepath.Clean(source)), "_")
+}
+
+var desHash = regexp.MustCompile(`^[./0-9A-Za-z]{13}$`)
+
+// strongHashPrefixes are the salted schemes nginx verifies: bcrypt, SHA-256
+// and SHA-512 crypt, MD5 crypt and apr1, and salted SHA-1.
+var strongHashPrefixes = []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "$1$", "$apr1$", "{SSHA}"}
+
+// auditHtpasswd checks each `user:hash` line of a credentials file. Lines
+// nginx cannot use are problems; weak hash schemes are warnings.
+func auditHtpasswd(source string, data []byte) (problems, warnings []schemaError) {
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		report := func(list *[]schemaError, format string, args ...interface{}) {
+			*list = append(*list, schemaError{Source: source, Line: i + 1, Column: 1, Message: fmt.Sprintf(format, args...)})
+		}
+
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			report(&problems, "expected user:password-hash")
+			continue
+		}
+		user, hash := parts[0], parts[1]
+
+		switch {
+		case strings.HasPrefix(hash, "{PLAIN}"):
+			report(&warnings, "the password of %s is plain text", user)
+		case strings.HasPrefix(hash, "{SHA}"):
+			report(&warnings, "the password of %s is an unsalted SHA-1 hash", user)
+		case hasAnyPrefix(hash, strongHashPrefixes):
+		case desHash.MatchString(hash):
+			report(&warnings, "the password of %s is a crypt DES hash, which only checks the first 8 characters", user)
+		default:
+			report(&problems, "unrecognized password hash for %s", user)
+		}
+	}
+	return problems, warnings
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAuthFiles reads and audits Staticfile.auth and every basic_auth_file
+// the Staticfile names. Files that do not exist are left out, so the
+// directives using them can warn.
+func (sf *Finalizer) loadAuthFiles(hash *StaticfileTemp) error {
+	sources := []string{defaultAuthFile}
+	if hash.BasicAuthFile != "" {
+		sources = append(sources, string(hash.BasicAuthFile))
+	}
+	for _, rule := range hash.Locations {
+		if rule.BasicAuthFile != "" {
+			sources = append(sources, string(rule.BasicAuthFile))
+		}
+	}
+
+	sf.authFiles = map[string]stagedFile{}
+	var problems []string
+	for _, source := range sources {
+		if _, ok := sf.authFiles[source]; ok || !isValid(AuthFile(source), source) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(sf.BuildDir, source))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		invalid, weak := auditHtpasswd(source, data)
+		for _, problem := range invalid {
+			problems = append(problems, problem.String())
+		}
+		for _, warning := range weak {
+			sf.Log.Warning("%s", warning)
+		}
+		if len(weak) > 0 {
+			sf.Log.Protip("Hash passwords with bcrypt, e.g. htpasswd -B "+source+" <user>", "https://docs.cloudfoundry.org/buildpacks/staticfile/index.html#authentication")
+		}
+		sf.authFiles[source] = stagedFile{Name: htpasswdName(source), Data: data}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid basic authentication credentials:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// removeStagedFiles keeps the credentials and certificate files under the
+// app root from being served, once they are moved to dir, the directory
+// nginx serves.
+func (sf *Finalizer) removeStagedFiles(appRootDir, dir string) error {
+	var sources []string
+	for source := range sf.authFiles {
+		sources = append(sources, source)
+	}
+	for source := range sf.certFiles {
+		sources = append(sources, source)
+	}
+	for _, source := range sources {
+		rel, err := filepath.Rel(appRootDir, filepath.Join(sf.BuildDir, source))
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasBasicAuth reports whether any location asks for credentials when the
+// app starts without overrides.
+func hasBasicAuth(conf Staticfile) bool {
+	if conf.BasicAuth {
+		return true
+	}
+	for _, l := range conf.Locations {
+		if l.BasicAuth.Enabled() && (conf.BasicAuthFile || l.BasicAuthUserFile != "") {
+			return true
+		}
+	}
+	return false
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// AuthSource is the `basic_auth_from:` section: an environment variable or
+// a bound service holding the basic_auth users, read when the app starts.
+// Either holds `user:password` lines or a JSON object of users and
+// passwords; a service may also hold username and password credentials.
+// Plain-text passwords are hashed at start. The users replace those of
+// Staticfile.auth.
+type AuthSource struct {
+	Env     string `yaml:"env" json:"env,omitempty"`
+	Service string `yaml:"service" json:"service,omitempty"`
+	Tag     string `yaml:"tag" json:"tag,omitempty"`
+	Field   string `yaml:"field" json:"field,omitempty"`
+}
+
+func (s AuthSource) checkValue(node *yaml.Node) error {
+	var source AuthSource
+	if err := node.Decode(&source); err != nil {
+		return err
+	}
+	return source.check()
+}
+
+func (s AuthSource) check() error {
+	set := 0
+	for _, value := range []string{s.Env, s.Service, s.Tag} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("expected one of env, service or tag")
+	}
+	if s.Env != "" && !envNamePattern.MatchString(s.Env) {
+		return fmt.Errorf("invalid environment variable %q", s.Env)
+	}
+	if s.Env != "" && s.Field != "" {
+		return fmt.Errorf("field only applies to a service")
+	}
+	return nil
+}
+
+func (s AuthSource) isSet() bool {
+	return s != AuthSource{}
+}
+
+func (s AuthSource) String() string {
+	var name string
+	switch {
+	case s.Env != "":
+		return s.Env
+	case s.Service != "":
+		name = "service " + s.Service
+	default:
+		name = "the service tagged " + s.Tag
+	}
+	if s.Field != "" {
+		return fmt.Sprintf("the %s of %s", s.Field, name)
+	}
+	return name
+}
+
+// writeAuthSource stages auth.json, which the launcher writes the htpasswd
+// file for `basic_auth_from:` from at start.
+func (sf *Finalizer) writeAuthSource(confDir string) error {
+	if sf.authSource == nil {
+		return nil
+	}
+	data, err := json.Marshal(sf.authSource)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(confDir, "auth.json"), data, 0644)
+}
@@ -0,0 +1,80 @@
+package finalize
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Brotli serves the .br files written by Precompress with brotli_static
+// and compresses the other responses of Types with brotli.
+type Brotli struct {
+	// Modules are the dynamic modules nginx loads, relative to DEPS_DIR.
+	// They are empty when the nginx dependency has ngx_brotli compiled in.
+	Modules []string
+	Types   []string
+}
+
+// brotliModules are the modules of ngx_brotli, in the order nginx loads
+// them. supply installs them from the nginx-brotli dependency.
+var brotliModules = []string{
+	"ngx_http_brotli_filter_module.so",
+	"ngx_http_brotli_static_module.so",
+}
+
+func (sf *Finalizer) loadBrotli(enabled Toggle, compression *Compression) *Brotli {
+	if !enabled.Enabled() {
+		return nil
+	}
+	sf.beginStep("brotli", "Enabling brotli compression")
+	return &Brotli{Types: compression.Types}
+}
+
+// configureBrotli finds the brotli modules supply installed and checks that
+// the nginx dependency loads them, which a module built for another nginx
+// fails to do. The manifest of this buildpack has no nginx-brotli
+// dependency, so unless an operator adds one or ships an nginx with
+// ngx_brotli compiled in, brotli is turned off with a warning.
+func (sf *Finalizer) configureBrotli() error {
+	b := sf.Config.Brotli
+	b.Modules = nil
+	var loads []string
+	for _, module := range brotliModules {
+		path := filepath.Join(sf.DepDir, "nginx", "modules", module)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		b.Modules = append(b.Modules, filepath.Join(filepath.Base(sf.DepDir), "nginx", "modules", module))
+		loads = append(loads, fmt.Sprintf("load_module %s;\n", path))
+	}
+
+	dir, err := ioutil.TempDir("", "brotli")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "logs"), 0755); err != nil {
+		return err
+	}
+	conf := filepath.Join(dir, "nginx.conf")
+	probe := strings.Join(loads, "") + "events {}\nhttp {\n  brotli on;\n  brotli_static on;\n}\n"
+	if err := ioutil.WriteFile(conf, []byte(probe), 0644); err != nil {
+		return err
+	}
+
+	output := new(bytes.Buffer)
+	nginx := filepath.Join(sf.DepDir, "nginx", "sbin", "nginx")
+	if err := sf.Command.Execute(dir, output, output, nginx, "-t", "-q", "-p", dir, "-c", conf); err != nil {
+		message := strings.TrimSpace(output.String())
+		if len(b.Modules) == 0 {
+			sf.Log.Warning("brotli is not available, as the nginx dependency has no brotli module and the buildpack manifest has no nginx-brotli dependency for it; serving gzip only")
+			sf.Config.Brotli = nil
+			return nil
+		}
+		return fmt.Errorf("brotli is enabled, but nginx is unable to load the brotli modules, which may have been built for another nginx version: %s", message)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package finalize
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Caching is the `caching:` section, which sets Cache-Control per path glob
+// and file extension. Rules are tried in order: fingerprinted assets, the
+// preset, paths in Staticfile order, extensions, then the default.
+type Caching struct {
+	Preset               CachePreset           `yaml:"preset"`
+	Default              CacheValue            `yaml:"default"`
+	Fingerprinted        CacheValue            `yaml:"fingerprinted"`
+	Paths                CachePaths            `yaml:"paths"`
+	Extensions           map[string]CacheValue `yaml:"extensions"`
+	StaleWhileRevalidate Duration              `yaml:"stale_while_revalidate"`
+	StaleIfError         Duration              `yaml:"stale_if_error"`
+	SurrogateControl     CacheValue            `yaml:"surrogate_control"`
+}
+
+func (c Caching) isSet() bool {
+	return !reflect.DeepEqual(c, Caching{})
+}
+
+// CachePreset names a set of caching rules. "spa" revalidates index.html
+// on every request and caches fingerprinted assets for a year.
+type CachePreset string
+
+func (p CachePreset) checkValue(node *yaml.Node) error {
+	if node.Value != "spa" {
+		return fmt.Errorf("invalid preset %q, expected spa", node.Value)
+	}
+	return nil
+}
+
+// CacheValue is a max-age such as 1h or 7d, one of no-cache, no-store,
+// immutable and off, or a literal Cache-Control value.
+type CacheValue string
+
+var (
+	durationPattern = regexp.MustCompile(`^(\d+)([smhdwy]?)$`)
+	cacheDirective  = regexp.MustCompile(`^([a-z-]+)(=\d+)?$`)
+	durationUnits   = map[string]int{"": 1, "s": 1, "m": 60, "h": 3600, "d": 86400, "w": 604800, "y": 31536000}
+)
+
+// cacheDirectives are the Cache-Control and Surrogate-Control directives a
+// literal cache value may use.
+var cacheDirectives = map[string]bool{
+	"public":                 true,
+	"private":                true,
+	"no-cache":               true,
+	"no-store":               true,
+	"no-transform":           true,
+	"must-revalidate":        true,
+	"proxy-revalidate":       true,
+	"must-understand":        true,
+	"immutable":              true,
+	"max-age":                true,
+	"s-maxage":               true,
+	"stale-while-revalidate": true,
+	"stale-if-error":         true,
+}
+
+func (v CacheValue) checkValue(node *yaml.Node) error {
+	if node.Value == "off" || durationPattern.MatchString(node.Value) {
+		return nil
+	}
+	for _, directive := range strings.Split(strings.ToLower(node.Value), ",") {
+		match := cacheDirective.FindStringSubmatch(strings.TrimSpace(directive))
+		if match == nil || !cacheDirectives[match[1]] {
+			return fmt.Errorf("invalid cache value %q, expected a max-age such as 1h or 7d, no-cache, no-store, immutable, off or a Cache-Control value", node.Value)
+		}
+	}
+	return nil
+}
+
+// Duration is a number of seconds, optionally with an s, m, h, d, w or y
+// unit.
+type Duration string
+
+func (d Duration) checkValue(node *yaml.Node) error {
+	if !durationPattern.MatchString(node.Value) {
+		return fmt.Errorf("invalid duration %q, expected a number of seconds or a value such as 30s, 5m or 1d", node.Value)
+	}
+	return nil
+}
+
+func (d Duration) seconds() int {
+	match := durationPattern.FindStringSubmatch(string(d))
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	return n * durationUnits[match[2]]
+}
+
+// CachePaths keeps `caching.paths` in Staticfile order, since the first
+// matching glob wins.
+type CachePaths []CachePath
+
+type CachePath struct {
+	Glob  string
+	Value CacheValue
+}
+
+func (c *CachePaths) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml2.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+
+	*c = nil
+	for _, item := range order {
+		*c = append(*c, CachePath{Glob: fmt.Sprint(item.Key), Value: CacheValue(fmt.Sprint(item.Value))})
+	}
+	return nil
+}
+
+func (c CachePaths) mapValueType() reflect.Type {
+	return reflect.TypeOf(CacheValue(""))
+}
+
+func (c CachePaths) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if !strings.HasPrefix(key.Value, "/") {
+			return nodeError{key, fmt.Sprintf("path glob %q must start with /", key.Value)}
+		}
+		if err := checkGlob(key.Value); err != nil {
+			return nodeError{key, err.Error()}
+		}
+	}
+	return nil
+}
+
+const oneYear = 31536000
+
+// cacheControl renders the Cache-Control header for a cache value, or ""
+// for none.
+func (c Caching) cacheControl(value CacheValue) string {
+	switch value {
+	case "", "off":
+		return ""
+	case "no-cache", "no-store":
+		return string(value)
+	case "immutable":
+		return fmt.Sprintf("public, max-age=%d, immutable", oneYear)
+	}
+	if !durationPattern.MatchString(string(value)) {
+		return string(value)
+	}
+
+	directives := []string{"public", fmt.Sprintf("max-age=%d", Duration(value).seconds())}
+	if c.StaleWhileRevalidate != "" {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", c.StaleWhileRevalidate.seconds()))
+	}
+	if c.StaleIfError != "" {
+		directives = append(directives, fmt.Sprintf("stale-if-error=%d", c.StaleIfError.seconds()))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// surrogateControl renders Surrogate-Control, where a bare duration is the
+// max-age CDNs keep the response for.
+func (c Caching) surrogateControl() string {
+	if durationPattern.MatchString(string(c.SurrogateControl)) {
+		return fmt.Sprintf("max-age=%d", Duration(c.SurrogateControl).seconds())
+	}
+	return string(c.SurrogateControl)
+}
+
+func (c Caching) fingerprinted() CacheValue {
+	if c.Fingerprinted == "" && c.Preset == "spa" {
+		return "immutable"
+	}
+	return c.Fingerprinted
+}
+
+// maxMapKeyLength keeps exact `map $uri` keys within map_hash_bucket_size.
+const maxMapKeyLength = 200
+
+// fingerprintPart is a hash-like part of a file name, e.g. 3f2a1b9c in
+// main.3f2a1b9c.js or BxYz12Ab in index-BxYz12Ab.js.
+var fingerprintPart = regexp.MustCompile(`^[0-9A-Za-z_]{8,}$`)
+
+// isFingerprinted reports whether a file name carries a content hash, which
+// makes it safe to cache forever.
+func isFingerprinted(name string) bool {
+	ext := filepath.Ext(name)
+	parts := strings.FieldsFunc(strings.TrimSuffix(name, ext), func(r rune) bool {
+		return r == '.' || r == '-'
+	})
+	if ext == "" || len(parts) < 2 {
+		return false
+	}
+	for _, part := range parts[1:] {
+		if fingerprintPart.MatchString(part) && strings.ContainsAny(part, "0123456789") && strings.IndexFunc(part, isLetter) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+// findFingerprinted lists the URIs of fingerprinted files under dir.
+func findFingerprinted(dir string) ([]string, error) {
+	var uris []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !isFingerprinted(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if uri := "/" + filepath.ToSlash(rel); len(uri) <= maxMapKeyLength {
+			uris = append(uris, uri)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	sort.Strings(uris)
+	return uris, err
+}
+
+// configureCaching turns the `caching:` section into Cache-Control and
+// Surrogate-Control response headers. Fingerprinted assets are found in
+// the staged public directory and matched exactly, ahead of any glob.
+func (sf *Finalizer) configureCaching() error {
+	caching := *sf.Config.Caching
+	header := ResponseHeader{Name: "Cache-Control", Value: caching.cacheControl(caching.Default)}
+
+	if value := caching.cacheControl(caching.fingerprinted()); value != "" {
+		uris, err := findFingerprinted(filepath.Join(sf.BuildDir, "public"))
+		if err != nil {
+			return err
+		}
+		if len(uris) > 0 {
+			sf.Log.BeginStep("Caching %d fingerprinted assets with %s", len(uris), value)
+		}
+		for _, uri := range uris {
+			header.Globs = append(header.Globs, HeaderGlob{Pattern: uri, Value: value})
+		}
+	}
+
+	if caching.Preset == "spa" {
+		header.Globs = append(header.Globs, HeaderGlob{Pattern: "/**/index.html", Regex: `/index\.html$`, Value: "no-cache"})
+	}
+	for _, path := range caching.Paths {
+		if checkGlob(path.Glob) == nil {
+			header.Globs = append(header.Globs, HeaderGlob{Pattern: path.Glob, Regex: globToRegex(path.Glob), Value: caching.cacheControl(path.Value)})
+		}
+	}
+
+	byValue := map[string][]string{}
+	for ext, value := range caching.Extensions {
+		control := caching.cacheControl(value)
+		byValue[control] = append(byValue[control], regexp.QuoteMeta(strings.TrimPrefix(ext, ".")))
+	}
+	controls := make([]string, 0, len(byValue))
+	for control := range byValue {
+		controls = append(controls, control)
+	}
+	sort.Strings(controls)
+	for _, control := range controls {
+		exts := byValue[control]
+		sort.Strings(exts)
+		header.Globs = append(header.Globs, HeaderGlob{Pattern: "*." + strings.Join(exts, ","), Regex: `\.(?:` + strings.Join(exts, "|") + `)$`, Value: control})
+	}
+
+	headers := []ResponseHeader{}
+	for _, h := range sf.Config.Headers {
+		switch strings.ToLower(h.Name) {
+		case "cache-control":
+			sf.Log.Warning("Cache-Control from headers is replaced by the caching section")
+			continue
+		case "surrogate-control":
+			if caching.SurrogateControl != "" {
+				sf.Log.Warning("Surrogate-Control from headers is replaced by caching.surrogate_control")
+				continue
+			}
+		}
+		headers = append(headers, h)
+	}
+
+	if len(header.Globs) > 0 {
+		header.Variable = "$staticfile_cache_control"
+	}
+	if header.Value != "" || len(header.Globs) > 0 {
+		headers = append(headers, header)
+	}
+	if caching.SurrogateControl != "" {
+		headers = append(headers, ResponseHeader{Name: "Surrogate-Control", Value: caching.surrogateControl()})
+	}
+	sf.Config.Headers = headers
+	return nil
+}
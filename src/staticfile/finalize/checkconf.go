@@ -0,0 +1,172 @@
+package finalize
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
+)
+
+// Placeholders for the values only known at launch, while nginx -t checks
+// the configuration at staging.
+const (
+	placeholderPort     = "8080"
+	placeholderHost     = "127.0.0.1"
+	placeholderUpstream = "http://" + placeholderHost
+)
+
+var (
+	// nginxErrorLocation is where an nginx error message says the error is.
+	nginxErrorLocation = regexp.MustCompile(` in (\S+):(\d+)$`)
+	// proxyPassHost is the host of a proxy_pass URL, which nginx resolves
+	// when it loads the configuration.
+	proxyPassHost = regexp.MustCompile(`(\bproxy_pass\s+"?https?://)(\[[^\]]*\]|[^/:"\s;]+)`)
+)
+
+// CheckNginxConf renders nginx.conf the way the launcher does and has the
+// nginx supply installed test it, so that a broken configuration fails
+// the staging rather than the start of the app.
+func (sf *Finalizer) CheckNginxConf() error {
+	nginx := filepath.Join(sf.DepDir, "nginx", "sbin", "nginx")
+	if _, err := os.Stat(nginx); err != nil {
+		sf.Log.Warning("Unable to check nginx.conf, nginx is not installed")
+		return nil
+	}
+	for _, l := range sf.Config.Locations {
+		if p := l.Proxy; p != nil && p.Service != nil && (p.Service.ClientCertField != "" || p.Service.CAField != "") {
+			sf.Log.Info("Skipping the check of nginx.conf, the certificates of %s are only written at start", l.Match)
+			return nil
+		}
+	}
+	sf.Log.BeginStep("Checking nginx.conf")
+
+	root, err := ioutil.TempDir("", "staticfile-check.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+	if err := sf.linkAppRoot(root); err != nil {
+		return err
+	}
+
+	env := func(key string) (string, bool) {
+		switch {
+		case key == "PORT":
+			return placeholderPort, true
+		case key == "APP_ROOT":
+			return root, true
+		case key == "DEPS_DIR":
+			return filepath.Dir(sf.DepDir), true
+		case strings.HasPrefix(key, "STATICFILE_UPSTREAM_"):
+			return placeholderUpstream, true
+		}
+		return launcher.LaunchEnv(key)
+	}
+	conf, lines, err := launcher.RenderConfigLines(filepath.Join(root, "nginx", "conf", "nginx.conf"), root, env)
+	if err != nil {
+		return err
+	}
+	if err := placeholderProxyHosts(conf); err != nil {
+		return err
+	}
+
+	output := new(bytes.Buffer)
+	prefix := filepath.Join(root, "nginx")
+	if err := sf.Command.Execute(root, output, output, nginx, "-t", "-q", "-p", prefix, "-c", conf); err != nil {
+		var messages []string
+		for _, line := range strings.Split(output.String(), "\n") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "nginx: "))
+			if line == "" || strings.HasSuffix(line, "test failed") {
+				continue
+			}
+			messages = append(messages, sf.nginxErrorSource(line, root, conf, lines))
+		}
+		return fmt.Errorf("nginx rejects the configuration: %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// placeholderProxyHosts points the proxy_pass directives of the rendered
+// conf at placeholderHost. The upstream hosts may only resolve from the
+// app's network, or not yet exist, and nginx -t fails on a host it cannot
+// resolve.
+func placeholderProxyHosts(conf string) error {
+	data, err := ioutil.ReadFile(conf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(conf, proxyPassHost.ReplaceAll(data, []byte("${1}"+placeholderHost)), 0644)
+}
+
+// linkAppRoot mirrors the staged app under root with links, but for the
+// nginx logs and run directories, which nginx -t writes to.
+func (sf *Finalizer) linkAppRoot(root string) error {
+	link := func(dir, target string, skip ...string) error {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !contains(skip, entry.Name()) {
+				if err := os.Symlink(filepath.Join(dir, entry.Name()), filepath.Join(target, entry.Name())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := link(sf.BuildDir, root, "nginx"); err != nil {
+		return err
+	}
+	for _, dir := range []string{"logs", "run"} {
+		if err := os.MkdirAll(filepath.Join(root, "nginx", dir), 0755); err != nil {
+			return err
+		}
+	}
+	return link(filepath.Join(sf.BuildDir, "nginx"), filepath.Join(root, "nginx"), "logs", "run")
+}
+
+// nginxErrorSource points an nginx error at the file of the app and the
+// line the user wrote, rather than at the rendered copy.
+func (sf *Finalizer) nginxErrorSource(message, root, conf string, lines []int) string {
+	match := nginxErrorLocation.FindStringSubmatchIndex(message)
+	if match == nil {
+		return message
+	}
+	path := message[match[2]:match[3]]
+	line, _ := strconv.Atoi(message[match[4]:match[5]])
+
+	var name string
+	if rel, err := filepath.Rel(filepath.Dir(conf), path); err == nil && !strings.HasPrefix(rel, "..") {
+		name = filepath.Join("nginx", "conf", rel)
+		if rel == filepath.Base(conf) && line > 0 && line <= len(lines) {
+			line = lines[line-1]
+		}
+		if sf.customConf[rel] {
+			name = rel
+		} else if rel == filepath.Base(conf) {
+			name = "the generated nginx.conf"
+		}
+	} else if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		name = rel
+	} else {
+		return message
+	}
+	return fmt.Sprintf("%s in %s line %d", message[:match[0]], name, line)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/finalize"
@@ -37,11 +38,20 @@ func main() {
 		os.Exit(11)
 	}
 
+	executable, err := os.Executable()
+	if err != nil {
+		logger.Error("Unable to determine finalize directory: %s", err.Error())
+		os.Exit(18)
+	}
+
 	sf := finalize.Finalizer{
 		BuildDir: stager.BuildDir(),
 		DepDir:   stager.DepDir(),
 		Log:      logger,
 		YAML:     libbuildpack.NewYAML(),
+		Command:  &libbuildpack.Command{},
+		CacheDir: stager.CacheDir(),
+		BinDir:   filepath.Dir(executable),
 	}
 
 	if err := finalize.Run(&sf); err != nil {
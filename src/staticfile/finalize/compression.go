@@ -0,0 +1,201 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Compression is how nginx compresses responses on the fly. The types and
+// threshold also pick the files Precompress compresses at staging.
+type Compression struct {
+	// Dynamic is off for apps that would rather not spend CPU on
+	// compression; the precompressed files are still served.
+	Dynamic   bool
+	Level     int
+	MinLength int
+	Types     []string
+	Proxied   string
+	// Exclude are the path prefixes served as they are.
+	Exclude []string
+}
+
+const (
+	defaultCompressionLevel     = 6
+	defaultCompressionMinLength = 1100
+)
+
+// defaultCompressionTypes are the MIME types worth compressing, besides
+// text/html, which nginx always compresses. Images, fonts and archives that
+// are compressed already are left out.
+var defaultCompressionTypes = []string{
+	"text/plain", "text/css", "text/js", "text/xml", "text/javascript",
+	"application/javascript", "application/x-javascript", "application/json",
+	"application/xml", "application/xml+rss", "application/xhtml+xml",
+	"application/atom+xml", "application/rss+xml", "application/manifest+json",
+	"application/wasm", "image/svg+xml", "font/ttf", "font/otf",
+	"application/vnd.ms-fontobject",
+}
+
+func defaultCompression() *Compression {
+	return &Compression{
+		Dynamic:   true,
+		Level:     defaultCompressionLevel,
+		MinLength: defaultCompressionMinLength,
+		Types:     defaultCompressionTypes,
+		Proxied:   "any",
+	}
+}
+
+// CompressionTemp is `compression:`, either a toggle for dynamic
+// compression or a mapping of options.
+type CompressionTemp struct {
+	Enabled Toggle
+	CompressionOptions
+}
+
+type CompressionOptions struct {
+	Dynamic   Toggle           `yaml:"dynamic"`
+	Level     CompressionLevel `yaml:"level"`
+	MinLength ByteSize         `yaml:"min_length"`
+	Types     MimeTypeList     `yaml:"types"`
+	Proxied   GzipProxied      `yaml:"proxied"`
+	Exclude   CompressionPaths `yaml:"exclude"`
+}
+
+func (c *CompressionTemp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled string
+	if err := unmarshal(&enabled); err == nil {
+		c.Enabled = Toggle(enabled)
+		return nil
+	}
+	c.Enabled = "enabled"
+	return unmarshal(&c.CompressionOptions)
+}
+
+func (c CompressionTemp) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind == yaml.MappingNode {
+		return checkNode(node, reflect.TypeOf(CompressionOptions{}), key)
+	}
+	return checkNode(node, reflect.TypeOf(Toggle("")), key)
+}
+
+// CompressionLevel is gzip_comp_level.
+type CompressionLevel string
+
+func (l CompressionLevel) checkValue(node *yaml.Node) error {
+	if n, err := strconv.Atoi(node.Value); err != nil || n < 1 || n > 9 {
+		return fmt.Errorf("invalid compression level %q, expected a number from 1 to 9", node.Value)
+	}
+	return nil
+}
+
+// GzipProxied is gzip_proxied, the proxied requests whose responses are
+// compressed, e.g. "expired no-cache".
+type GzipProxied string
+
+var gzipProxiedValues = map[string]bool{
+	"off": true, "expired": true, "no-cache": true, "no-store": true, "private": true,
+	"no_last_modified": true, "no_etag": true, "auth": true, "any": true,
+}
+
+func (p GzipProxied) checkValue(node *yaml.Node) error {
+	fields := strings.Fields(node.Value)
+	valid := len(fields) > 0
+	for _, field := range fields {
+		valid = valid && gzipProxiedValues[field]
+	}
+	if !valid {
+		return fmt.Errorf("invalid proxied %q, expected off, any, or some of expired, no-cache, no-store, private, no_last_modified, no_etag and auth", node.Value)
+	}
+	return nil
+}
+
+// CompressionPaths are path prefixes such as /downloads/.
+type CompressionPaths []string
+
+func (p CompressionPaths) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !validCompressionPath(item.Value) {
+			return nodeError{item, fmt.Sprintf("invalid path %q, expected a path starting with /", item.Value)}
+		}
+	}
+	return nil
+}
+
+func validCompressionPath(path string) bool {
+	return strings.HasPrefix(path, "/") && path != "/" && !strings.ContainsAny(path, " \t{};\"'")
+}
+
+func (sf *Finalizer) loadCompression(rule CompressionTemp) *Compression {
+	c := defaultCompression()
+	if rule.Enabled == "" {
+		return c
+	}
+	c.Dynamic = rule.Enabled.Enabled() && (rule.Dynamic == "" || rule.Dynamic.Enabled())
+	if isValid(rule.Level, string(rule.Level)) {
+		c.Level, _ = strconv.Atoi(string(rule.Level))
+	}
+	if isValid(rule.MinLength, string(rule.MinLength)) {
+		c.MinLength = rule.MinLength.bytes()
+	}
+	if types := rule.Types.valid(); len(types) > 0 {
+		c.Types = types
+	}
+	if isValid(rule.Proxied, string(rule.Proxied)) {
+		c.Proxied = strings.Join(strings.Fields(string(rule.Proxied)), " ")
+	}
+	for _, path := range rule.Exclude {
+		if validCompressionPath(path) {
+			c.Exclude = append(c.Exclude, path)
+		}
+	}
+
+	if c.Dynamic {
+		sf.beginStep("compression", "Compressing responses at level %d from %d bytes", c.Level, c.MinLength)
+	} else {
+		sf.beginStep("compression", "Disabling dynamic compression")
+	}
+	if len(c.Exclude) > 0 {
+		sf.Log.Info("Serving %s uncompressed", strings.Join(c.Exclude, ", "))
+		sf.Config.Locations = excludeFromCompression(sf.Config.Locations, c.Exclude)
+	}
+	return c
+}
+
+// excludeFromCompression turns compression off in a prefix location for
+// each excluded path, reusing the location of the Staticfile for the same
+// prefix. A new location inherits the top-level directives and wins over
+// regex locations, as ^~ does.
+func excludeFromCompression(locations []Location, paths []string) []Location {
+	for _, path := range paths {
+		if i := locationIndex(locations, "^~ "+path); i >= 0 {
+			locations[i].Uncompressed = true
+		} else {
+			locations = append(locations, Location{Match: "^~ " + path, Uncompressed: true})
+		}
+	}
+	return sortLocations(locations)
+}
+
+// excluded reports whether nginx serves uri uncompressed.
+func (c *Compression) excluded(uri string) bool {
+	for _, path := range c.Exclude {
+		if strings.HasPrefix(uri, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionOf is the compression of config, which LoadStaticfile always
+// sets.
+func compressionOf(config Staticfile) *Compression {
+	if config.Compression == nil {
+		return defaultCompression()
+	}
+	return config.Compression
+}
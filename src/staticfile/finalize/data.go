@@ -18,55 +18,91 @@ const (
 
 export APP_ROOT=$HOME
 export LD_LIBRARY_PATH=$APP_ROOT/nginx/lib:$LD_LIBRARY_PATH
-
-mv $APP_ROOT/nginx/conf/nginx.conf $APP_ROOT/nginx/conf/nginx.conf.erb
-erb $APP_ROOT/nginx/conf/nginx.conf.erb > $APP_ROOT/nginx/conf/nginx.conf
-
-if [[ ! -f $APP_ROOT/nginx/logs/access.log ]]; then
-    mkfifo $APP_ROOT/nginx/logs/access.log
-fi
-
-if [[ ! -f $APP_ROOT/nginx/logs/error.log ]]; then
-    mkfifo $APP_ROOT/nginx/logs/error.log
-fi
-`
-
-	startLoggingScript = `
-cat < $APP_ROOT/nginx/logs/access.log &
-(>&2 cat) < $APP_ROOT/nginx/logs/error.log &
 `
 
 	startCommand = `#!/bin/sh
-set -ex
-$APP_ROOT/start_logging.sh
-nginx -p $APP_ROOT/nginx -c $APP_ROOT/nginx/conf/nginx.conf
+exec staticfile-launcher run $APP_ROOT/nginx/conf/launch.json
 `
 
 	nginxConfTemplate = `
 worker_processes 1;
 daemon off;
-
-error_log <%= ENV["APP_ROOT"] %>/nginx/logs/error.log;
+{{with .Brotli}}{{range .Modules}}load_module <%= ENV["DEPS_DIR"] %>/{{.}};
+{{end}}{{end}}
+error_log <%= ENV["APP_ROOT"] %>/nginx/logs/error.log{{with .Logging}}{{with .ErrorLevel}} {{.}}{{end}}{{end}};
 events { worker_connections 1024; }
 
 http {
   charset utf-8;
-  log_format cloudfoundry '$http_x_forwarded_for - $http_referer - [$time_local] "$request" $status $body_bytes_sent';
+  log_format cloudfoundry '{{if trustsProxies .}}$remote_addr{{else}}$http_x_forwarded_for{{end}} - {{if redactsQuery .}}$staticfile_log_referer{{else}}$http_referer{{end}} - [$time_local] "{{if redactsQuery .}}$staticfile_log_request{{else}}$request{{end}}" $status $body_bytes_sent';
+  {{range redactMaps .Logging}}
+  map {{.Source}} {{.Variable}} {
+    {{quote (print "~*" .Regex)}} "$1REDACTED$2";
+    default {{.Source}};
+  }
+  {{end}}
+  {{with .Logging}}
+  {{with .JSON}}
+  log_format json escape=json '{{.}}';
+  map $http_x_vcap_request_id $staticfile_request_id {
+    ""      $request_id;
+    default $http_x_vcap_request_id;
+  }
+  {{end}}
+  {{if and .Exclude .Sample}}
+  map $uri $staticfile_log_path {
+    {{range .Exclude}}{{quote .}} 0;
+    {{end}}default 1;
+  }
+  split_clients $request_id $staticfile_log_sample {
+    {{.Sample}} 1;
+    *       0;
+  }
+  map "$staticfile_log_path$staticfile_log_sample" $staticfile_log {
+    "11"    1;
+    default 0;
+  }
+  {{else if .Exclude}}
+  map $uri $staticfile_log {
+    {{range .Exclude}}{{quote .}} 0;
+    {{end}}default 1;
+  }
+  {{else if .Sample}}
+  split_clients $request_id $staticfile_log {
+    {{.Sample}} 1;
+    *       0;
+  }
+  {{end}}
+  access_log <%= ENV["APP_ROOT"] %>/nginx/logs/access.log {{.Format}}{{if .Filtered}} if=$staticfile_log{{end}};
+  {{else}}
   access_log <%= ENV["APP_ROOT"] %>/nginx/logs/access.log cloudfoundry;
+  {{end}}
+  {{with .Metrics}}
+  log_format staticfile_metrics '{{metricsLogFormat}}';
+  access_log <%= ENV["APP_ROOT"] %>/nginx/logs/metrics.log staticfile_metrics;
+  {{end}}
   default_type application/octet-stream;
   include mime.types;
   sendfile on;
 
-  gzip on;
+  {{with compression .}}
+  gzip {{if .Dynamic}}on{{else}}off{{end}};
   gzip_disable "msie6";
-  gzip_comp_level 6;
-  gzip_min_length 1100;
+  gzip_comp_level {{.Level}};
+  gzip_min_length {{.MinLength}};
   gzip_buffers 16 8k;
-  gzip_proxied any;
+  gzip_proxied {{.Proxied}};
   gunzip on;
   gzip_static always;
-  gzip_types text/plain text/css text/js text/xml text/javascript application/javascript application/x-javascript application/json application/xml application/xml+rss;
+  gzip_types{{range .Types}} {{.}}{{end}};
   gzip_vary on;
+  {{end}}
+  {{with .Brotli}}
+  brotli {{if (compression $).Dynamic}}on{{else}}off{{end}};
+  brotli_static on;
+  brotli_min_length {{(compression $).MinLength}};
+  brotli_types{{range .Types}} {{.}}{{end}};
+  {{end}}
 
   tcp_nopush on;
   keepalive_timeout 30;
@@ -87,80 +123,278 @@ http {
     "~^([^,]+),?.*$" $1;
     ''               '';
   }
+
+  {{with .Access}}
+  {{range .TrustedProxies}}
+  set_real_ip_from {{.}};
+  {{end}}
+  {{if .TrustedProxies}}
+  real_ip_header X-Forwarded-For;
+  real_ip_recursive on;
+  {{end}}
+  {{with .DenyUserAgents}}
+  map $http_user_agent $staticfile_denied_agent {
+    {{range .}}{{quote (print "~*" .)}} 1;
+    {{end}}default 0;
+  }
+  {{end}}
+  {{end}}
+
+  {{with mapHash .}}
+  map_hash_max_size {{.MaxSize}};
+  map_hash_bucket_size {{.BucketSize}};
+  {{end}}
+  {{if hasWebSocketProxy .Locations}}
+  map $http_upgrade $connection_upgrade {
+    default upgrade;
+    ''      close;
+  }
+  {{end}}
+
+  {{range redirectMaps .Redirects}}
+  map {{.Subject}} {{.Variable}} {
+    {{range .Entries}}{{quote .MapKey}} {{quote .Value}};
+    {{end}}default "";
+  }
+  {{end}}
+
+  {{range .Headers}}{{if .Variable}}
+  map $uri {{.Variable}} {
+    {{range .Globs}}{{quote .MapKey}} {{quote .Value}};
+    {{end}}default {{quote .Value}};
+  }
+  {{end}}{{end}}
+
+  {{with .Metrics}}
+  server {
+    listen unix:<%= ENV["APP_ROOT"] %>/nginx/run/status.sock;
+    access_log off;
+
+    location = /stub_status {
+      stub_status;
+    }
+  }
+  {{end}}
   
   server {
-    {{if .EnableHttp2}}
-	  listen <%= ENV["PORT"] %> http2;
-    {{else}}
-      <% if ENV["ENABLE_HTTP2"] %>
-	    listen <%= ENV["PORT"] %> http2;
-      <% else %>
-	    listen <%= ENV["PORT"] %>;
-      <% end %>
-    {{end}}
+    <% if ENV["ENABLE_HTTP2"] || {{toggle "enable_http2" .EnableHttp2}} %>
+      listen <%= ENV["PORT"] %> http2;
+    <% else %>
+      listen <%= ENV["PORT"] %>;
+    <% end %>
     server_name localhost;
 
     root <%= ENV["APP_ROOT"] %>/public;
 
-    {{if .ForceHTTPS}}
+    {{with .Healthcheck}}
+    if ($uri = {{quote .Path}}) {
+      rewrite ^ /.staticfile/healthz last;
+    }
+    {{end}}
 
+    <% if ENV["FORCE_HTTPS"] || {{toggle "force_https" .ForceHTTPS}} %>
       if ($best_proto != "https") {
         return 301 https://$best_host$best_prefix$request_uri;
       }
-    {{else}}
-      <% if ENV["FORCE_HTTPS"] %>
-        if ($best_proto != "https") {
-          return 301 https://$best_host$best_prefix$request_uri;
-        }
-      <% end %>
+    <% end %>
+
+    {{with .Access}}{{if .DenyUserAgents}}
+    if ($staticfile_denied_agent) {
+      return 403;
+    }
+    {{end}}{{end}}
+
+    {{with .Redirects}}
+    absolute_redirect off;
+    {{if hasUnforcedRedirects .}}
+    set $staticfile_shadow "";
+    if (-e $request_filename) {
+      set $staticfile_shadow "shadowed";
+    }
+    {{end}}
+    {{range redirectMaps .}}
+    if ({{.Variable}}) {
+      {{if .Rewrite}}rewrite ^ {{.Variable}} last;{{else}}return {{.Status}} {{.Variable}};{{end}}
+    }
+    {{end}}
+    {{range .}}{{if ne .Match "exact"}}
+    if ({{.Subject}} ~ {{quote .Regex}}) {
+      {{if .IsRewrite}}rewrite {{quote .Regex}} {{quote .Target}} last;{{else}}return {{.Status}} {{quote .Target}};{{end}}
+    }
+    {{end}}{{end}}
+    {{end}}
+
+
+    {{template "location" rootScope .}}
+
+    {{with .Healthcheck}}
+    location = /.staticfile/healthz {
+      internal;
+      access_log off;
+      default_type text/plain;
+      {{if .Readiness}}
+      if (!-f <%= ENV["APP_ROOT"] %>/nginx/run/ready) {
+        return 503 "starting\n";
+      }
+      {{end}}
+      return 200 "ok\n";
+    }
     {{end}}
 
+    {{range .Locations}}{{if not .IsRegex}}
+    {{template "location" scope $ .}}
+    {{end}}{{end}}
 
-    location / {
-      {{if .PushState}}
+    <% unless {{toggle "host_dot_files" .HostDotFiles}} %>
+      location ~ /\. {
+        deny all;
+        return 404;
+      }
+    <% end %>
+
+    {{range .Locations}}{{if .IsRegex}}
+    {{template "location" scope $ .}}
+    {{end}}{{end}}
+  }
+}
+`
+
+	nginxLocationTemplate = `{{define "location"}}
+    location {{locationMatch .Location.Match}} {
+      {{with .Location.Proxy}}
+      {{with .Service}}
+        proxy_pass "<%= ENV["{{.Env}}"] %>";
+      {{else}}
+        proxy_pass {{quote .Upstream}};
+      {{end}}
+        proxy_http_version 1.1;
+        proxy_set_header Host {{.Host}};
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Host $best_host;
+        proxy_set_header X-Forwarded-Proto $best_proto;
+      {{if .WebSocket}}
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection $connection_upgrade;
+      {{else}}
+        proxy_set_header Connection "";
+      {{end}}
+      {{range $name, $value := .SetHeaders}}
+        proxy_set_header {{$name}} {{quote $value}};
+      {{end}}
+      {{range .RemoveHeaders}}
+        proxy_set_header {{.}} "";
+      {{end}}
+      {{with .ConnectTimeout}}
+        proxy_connect_timeout {{.}};
+      {{end}}
+      {{with .ReadTimeout}}
+        proxy_read_timeout {{.}};
+        proxy_send_timeout {{.}};
+      {{end}}
+      {{if not .Buffering}}
+        proxy_buffering off;
+      {{end}}
+      {{if not .RequestBuffering}}
+        proxy_request_buffering off;
+      {{end}}
+      {{if .TLS}}
+        proxy_ssl_server_name on;
+      {{with .TLSServerName}}
+        proxy_ssl_name {{quote .}};
+      {{end}}
+      {{if .TLSVerify}}
+        proxy_ssl_verify on;
+        proxy_ssl_verify_depth {{.TLSVerifyDepth}};
+        proxy_ssl_trusted_certificate "{{.TLSTrustedCertificate}}";
+      {{end}}
+      {{with .ClientCertificate}}
+        proxy_ssl_certificate {{.}};
+        proxy_ssl_certificate_key {{$.Location.Proxy.ClientCertificateKey}};
+      {{end}}
+      {{end}}
+      {{else}}
+      <% if {{inherit "pushstate" .Location.PushState .Config.PushState}} %>
         if (!-e $request_filename) {
           rewrite ^(.*)$ / break;
         }
-      {{end}}
+      <% end %>
 
         index index.html index.htm Default.htm;
 
-      {{if .DirectoryIndex}}
+      <% if {{inherit "directory" .Location.DirectoryIndex .Config.DirectoryIndex}} %>
         autoindex on;
         absolute_redirect off;
+      <% end %>
       {{end}}
 
-      {{if .BasicAuth}}
-        auth_basic "Restricted";  #For Basic Auth
-        auth_basic_user_file <%= ENV["APP_ROOT"] %>/nginx/conf/.htpasswd;
+      {{if or .Config.BasicAuth .Config.BasicAuthFile .Location.BasicAuthUserFile}}
+      <% if {{inherit "basic_auth" .Location.BasicAuth .Config.BasicAuth}} %>
+        auth_basic {{quote (or .Location.BasicAuthRealm .Config.BasicAuthRealm "Restricted")}};  #For Basic Auth
+        auth_basic_user_file <%= ENV["APP_ROOT"] %>/nginx/conf/{{or .Location.BasicAuthUserFile .Config.BasicAuthUserFile ".htpasswd"}};
+      <% end %>
       {{end}}
 
-      {{if .SSI}}
+      {{with access .}}
+      {{range .Deny}}
+        deny {{.}};
+      {{end}}
+      {{range .Allow}}
+        allow {{.}};
+      {{end}}
+      {{if .Allow}}
+        deny all;
+      {{end}}
+      {{with .ValidReferers}}
+        valid_referers{{range .}} {{.}}{{end}};
+        if ($invalid_referer) {
+          return 403;
+        }
+      {{end}}
+      {{end}}
+
+      <% if {{inherit "ssi" .Location.SSI .Config.SSI}} %>
         ssi on;
+      <% end %>
+
+      <% if {{inherit "http_strict_transport_security" .Location.HSTS .Config.HSTS}} %>
+        add_header Strict-Transport-Security "max-age=31536000<% if {{toggle "http_strict_transport_security_include_subdomains" .Config.HSTSIncludeSubDomains}} %>; includeSubDomains<% end %><% if {{toggle "http_strict_transport_security_preload" .Config.HSTSPreload}} %>; preload<% end %>";
+      <% end %>
+
+      {{range headers .}}
+        add_header {{.Name}} {{.Value}} always;
+      {{end}}
+
+      {{with .Location.Expires}}
+        expires {{.}};
+      {{end}}
+
+      {{with .Location.ContentType}}
+        types { }
+        default_type {{.}};
       {{end}}
 
-      {{if .HSTS}}
-        add_header Strict-Transport-Security "max-age=31536000{{if .HSTSIncludeSubDomains}}; includeSubDomains{{end}}{{if .HSTSPreload}}; preload{{end}}";
+      {{if .Location.Uncompressed}}
+        gzip off;
+        gzip_static off;
+      {{if .Config.Brotli}}
+        brotli off;
+        brotli_static off;
+      {{end}}
       {{end}}
 
-      {{if ne .LocationInclude ""}}
-        include {{.LocationInclude}};
+      {{with .Location.LocationInclude}}
+        include {{.}};
+      {{else}}
+      <% unless {{setting "location_include" .Config.LocationInclude}}.empty? %>
+        include <%= {{setting "location_include" .Config.LocationInclude}} %>;
+      <% end %>
       {{end}}
 
-      {{ range $code, $value := .StatusCodes }}
+      {{ range $code, $value := or .Location.StatusCodes .Config.StatusCodes }}
         error_page {{ $code }} {{ $value }};
       {{ end }}
     }
-
-    {{if not .HostDotFiles}}
-      location ~ /\. {
-        deny all;
-        return 404;
-      }
-    {{end}}
-  }
-}
-`
+{{end}}`
 	MimeTypes = `
 types {
   text/html html htm shtml;
@@ -168,14 +402,19 @@ types {
   text/xml xml;
   image/gif gif;
   image/jpeg jpeg jpg;
-  application/javascript js;
+  application/javascript js mjs;
   application/atom+xml atom;
   application/rss+xml rss;
   font/ttf ttf;
   font/woff woff;
   font/woff2 woff2;
+  font/otf otf;
   text/mathml mml;
   text/plain txt;
+  text/markdown md;
+  text/csv csv;
+  text/calendar ics;
+  text/vtt vtt;
   text/vnd.sun.j2me.app-descriptor jad;
   text/vnd.wap.wml wml;
   text/x-component htc;
@@ -188,15 +427,24 @@ types {
   image/x-ms-bmp bmp;
   image/svg+xml svg svgz;
   image/webp webp;
+  image/avif avif;
+  image/apng apng;
   application/java-archive jar war ear;
   application/mac-binhex40 hqx;
   application/msword doc;
+  application/vnd.openxmlformats-officedocument.wordprocessingml.document docx;
+  application/vnd.openxmlformats-officedocument.spreadsheetml.sheet xlsx;
+  application/vnd.openxmlformats-officedocument.presentationml.presentation pptx;
+  application/epub+zip epub;
   application/pdf pdf;
   application/postscript ps eps ai;
   application/rtf rtf;
   application/vnd.ms-excel xls;
   application/vnd.ms-powerpoint ppt;
   application/vnd.wap.wmlc wmlc;
+  application/vnd.android.package-archive apk;
+  application/vnd.apple.mpegurl m3u8;
+  application/vnd.ms-fontobject eot;
   application/vnd.google-earth.kml+xml  kml;
   application/vnd.google-earth.kmz kmz;
   application/x-7z-compressed 7z;
@@ -219,14 +467,19 @@ types {
   application/octet-stream bin exe dll;
   application/octet-stream deb;
   application/octet-stream dmg;
-  application/octet-stream eot;
   application/octet-stream iso img;
   application/octet-stream msi msp msm;
-  application/json json;
+  application/json json map;
+  application/ld+json jsonld;
+  application/manifest+json webmanifest;
+  application/wasm wasm;
   audio/midi mid midi kar;
   audio/mpeg mp3;
   audio/ogg ogg;
   audio/x-m4a m4a;
+  audio/aac aac;
+  audio/flac flac;
+  audio/wav wav;
   audio/x-realaudio ra;
   video/3gpp 3gpp 3gp;
   video/mp4 mp4;
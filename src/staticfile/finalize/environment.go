@@ -0,0 +1,128 @@
+package finalize
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is prepended to the upper-cased Staticfile key to name the
+// environment variable overriding it, e.g. BP_STATICFILE_PUSHSTATE.
+const EnvPrefix = "BP_STATICFILE_"
+
+// EnvName returns the environment variable that overrides a Staticfile key.
+func EnvName(key string) string {
+	return EnvPrefix + strings.ToUpper(key)
+}
+
+// applyEnvironment overrides Staticfile values with BP_STATICFILE_*
+// variables from the staging environment. Scalar directives take the
+// variable verbatim; maps and lists are parsed as YAML flow syntax, e.g.
+// BP_STATICFILE_STATUS_CODES='{404: /404.html}', and decoded with yaml.v2
+// like the Staticfile itself.
+//
+// The effective value of a directive is, from highest precedence:
+//  1. BP_STATICFILE_* in the container environment at start, for the
+//     directives nginx.conf reads with erbToggle and erbSetting; the
+//     others decide what is staged and need a restage
+//  2. BP_STATICFILE_* in the staging environment
+//  3. the Staticfile
+//  4. the buildpack default
+//
+// Invalid values are reported and the Staticfile value is kept.
+func (sf *Finalizer) applyEnvironment(hash *StaticfileTemp) []schemaError {
+	var problems []schemaError
+	sf.overrides = map[string]string{}
+
+	fields := yamlFields(reflect.TypeOf(*hash))
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := EnvName(key)
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+
+		field := reflect.ValueOf(hash).Elem().FieldByIndex(fields[key].Index)
+		node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		if field.Kind() != reflect.String {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(value), &doc); err != nil || len(doc.Content) == 0 {
+				problems = append(problems, schemaError{Source: name, Message: "invalid YAML value"})
+				continue
+			}
+			node = doc.Content[0]
+		}
+
+		if errs := checkNode(node, field.Type(), ""); len(errs) > 0 {
+			for _, e := range errs {
+				problems = append(problems, schemaError{Source: name, Message: e.Message})
+			}
+			continue
+		}
+
+		if field.Kind() == reflect.String {
+			field.SetString(value)
+		} else {
+			decoded := reflect.New(field.Type())
+			if err := yaml2.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+				problems = append(problems, schemaError{Source: name, Message: err.Error()})
+				continue
+			}
+			field.Set(decoded.Elem())
+		}
+		sf.overrides[key] = name
+	}
+
+	return problems
+}
+
+// beginStep logs a Staticfile step, naming the environment variable that
+// set it when it did not come from the Staticfile.
+func (sf *Finalizer) beginStep(key, format string, args ...interface{}) {
+	if name, ok := sf.overrides[key]; ok {
+		format += " (from %s)"
+		args = append(args, name)
+	}
+	sf.Log.BeginStep(format, args...)
+}
+
+// logDisabledOverrides reports toggles that the environment switched off,
+// which would otherwise leave no trace in the build log.
+func (sf *Finalizer) logDisabledOverrides(hash *StaticfileTemp) {
+	fields := yamlFields(reflect.TypeOf(*hash))
+	keys := make([]string, 0, len(sf.overrides))
+	for key := range sf.overrides {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		field := reflect.ValueOf(hash).Elem().FieldByIndex(fields[key].Index)
+		if toggle, ok := field.Interface().(Toggle); ok && !toggle.Enabled() {
+			sf.Log.BeginStep("Disabling %s (from %s)", key, sf.overrides[key])
+		}
+	}
+}
+
+// erbToggle renders the ERB condition that lets BP_STATICFILE_<KEY> in the
+// container environment override the staged value of a runtime toggle.
+func erbToggle(key string, staged bool) string {
+	return fmt.Sprintf(`%%w(enabled true on visible).include?(ENV.fetch("%s", "%t").downcase)`, EnvName(key), staged)
+}
+
+// erbSetting renders the ERB expression that lets BP_STATICFILE_<KEY> in the
+// container environment override the staged value of a string directive.
+func erbSetting(key, staged string) string {
+	return fmt.Sprintf(`ENV.fetch("%s", '%s')`, EnvName(key), strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(staged))
+}
@@ -2,6 +2,7 @@ package finalize
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -11,6 +12,7 @@ import (
 	"bytes"
 
 	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
 )
 
 type Staticfile struct {
@@ -26,33 +28,88 @@ type Staticfile struct {
 	ForceHTTPS            bool   `yaml:"force_https"`
 	EnableHttp2           bool   `yaml:"enable_http2"`
 	BasicAuth             bool
+	BasicAuthFile         bool
+	BasicAuthUserFile     string
+	BasicAuthRealm        string
 	StatusCodes           map[string]string `yaml:"status_codes"`
+	Locations             []Location        `yaml:"locations"`
+	Headers               []ResponseHeader  `yaml:"headers"`
+	Caching               *Caching          `yaml:"caching"`
+	Redirects             []Redirect        `yaml:"redirects"`
+	Access                *Access           `yaml:"access"`
+	Logging               *AccessLog        `yaml:"logging"`
+	Healthcheck           *Healthcheck      `yaml:"healthcheck"`
+	Metrics               *Metrics          `yaml:"metrics"`
+	Launcher              *Launcher         `yaml:"launch"`
+	MimeTypes             map[string]string `yaml:"mime_types"`
+	Compression           *Compression      `yaml:"compression"`
+	Precompress           *Precompress      `yaml:"precompress"`
+	Brotli                *Brotli           `yaml:"brotli"`
+	Strict                bool              `yaml:"strict"`
 }
 
 type YAML interface {
 	Load(string, interface{}) error
 }
 
+type Command interface {
+	Execute(dir string, stdout io.Writer, stderr io.Writer, program string, args ...string) error
+}
+
 type Finalizer struct {
 	BuildDir string
 	DepDir   string
 	Log      *libbuildpack.Logger
 	Config   Staticfile
 	YAML     YAML
+	Command  Command
+	// CacheDir persists between stagings of the app.
+	CacheDir string
+	// BinDir holds the buildpack's launch-time binaries, next to finalize.
+	BinDir string
+
+	overrides     map[string]string
+	customConf    map[string]bool
+	redirectsFile string
+	redirectRules RedirectRules
+	authFiles     map[string]stagedFile
+	certFiles     map[string]stagedFile
+	authSource    *AuthSource
 }
 type StaticfileTemp struct {
-	RootDir               string            `yaml:"root,omitempty"`
-	HostDotFiles          string            `yaml:"host_dot_files,omitempty"`
-	LocationInclude       string            `yaml:"location_include"`
-	DirectoryIndex        string            `yaml:"directory"`
-	SSI                   string            `yaml:"ssi"`
-	PushState             string            `yaml:"pushstate"`
-	HSTS                  string            `yaml:"http_strict_transport_security"`
-	HSTSIncludeSubDomains string            `yaml:"http_strict_transport_security_include_subdomains"`
-	HSTSPreload           string            `yaml:"http_strict_transport_security_preload"`
-	ForceHTTPS            string            `yaml:"force_https"`
-	EnableHttp2           string            `yaml:"enable_http2"`
-	StatusCodes           map[string]string `yaml:"status_codes"`
+	RootDir               string          `yaml:"root,omitempty"`
+	HostDotFiles          Toggle          `yaml:"host_dot_files,omitempty"`
+	LocationInclude       string          `yaml:"location_include"`
+	DirectoryIndex        Toggle          `yaml:"directory"`
+	SSI                   Toggle          `yaml:"ssi"`
+	PushState             Toggle          `yaml:"pushstate"`
+	HSTS                  Toggle          `yaml:"http_strict_transport_security"`
+	HSTSIncludeSubDomains Toggle          `yaml:"http_strict_transport_security_include_subdomains"`
+	HSTSPreload           Toggle          `yaml:"http_strict_transport_security_preload"`
+	ForceHTTPS            Toggle          `yaml:"force_https"`
+	EnableHttp2           Toggle          `yaml:"enable_http2"`
+	StatusCodes           StatusCodes     `yaml:"status_codes"`
+	BasicAuth             Toggle          `yaml:"basic_auth"`
+	BasicAuthFile         AuthFile        `yaml:"basic_auth_file"`
+	BasicAuthRealm        AuthRealm       `yaml:"basic_auth_realm"`
+	BasicAuthFrom         AuthSource      `yaml:"basic_auth_from"`
+	Locations             LocationRules   `yaml:"locations"`
+	Headers               HeaderRules     `yaml:"headers"`
+	SecurityHeaders       SecurityHeaders `yaml:"security_headers"`
+	Redirects             RedirectRules   `yaml:"redirects"`
+	Proxy                 ProxyRules      `yaml:"proxy"`
+	Access                Access          `yaml:"access"`
+	Logging               Logging         `yaml:"logging"`
+	Healthcheck           HealthcheckTemp `yaml:"healthcheck"`
+	Metrics               MetricsTemp     `yaml:"metrics"`
+	Launch                Launch          `yaml:"launch"`
+	MimeTypes             MimeTypeMap     `yaml:"mime_types"`
+	Compression           CompressionTemp `yaml:"compression"`
+	Precompress           PrecompressTemp `yaml:"precompress"`
+	Brotli                Toggle          `yaml:"brotli"`
+	RedirectsFile         string          `yaml:"redirects_file"`
+	Caching               Caching         `yaml:"caching"`
+	Strict                Toggle          `yaml:"strict"`
 }
 
 var skipCopyFile = map[string]bool{
@@ -95,6 +152,18 @@ func Run(sf *Finalizer) error {
 		return err
 	}
 
+	err = sf.CheckNginxConf()
+	if err != nil {
+		sf.Log.Error("Invalid nginx configuration: %s", err.Error())
+		return err
+	}
+
+	err = sf.Precompress()
+	if err != nil {
+		sf.Log.Error("Unable to precompress assets: %s", err.Error())
+		return err
+	}
+
 	err = sf.WriteStartupFiles()
 	if err != nil {
 		sf.Log.Error("Unable to write startup file: %s", err.Error())
@@ -115,8 +184,17 @@ func (sf *Finalizer) WriteStartupFiles() error {
 		return err
 	}
 
-	err = ioutil.WriteFile(filepath.Join(sf.BuildDir, "start_logging.sh"), []byte(startLoggingScript), 0755)
-	if err != nil {
+	for _, name := range []string{"launcher", "logs"} {
+		if err := sf.installBinary(name); err != nil {
+			return err
+		}
+	}
+	if sf.Config.Metrics != nil {
+		if err := sf.installBinary("metrics"); err != nil {
+			return err
+		}
+	}
+	if err := sf.writeLaunchConfig(); err != nil {
 		return err
 	}
 
@@ -128,66 +206,88 @@ func (sf *Finalizer) LoadStaticfile() error {
 	var hash StaticfileTemp
 	conf := &sf.Config
 
-	err := sf.YAML.Load(filepath.Join(sf.BuildDir, "Staticfile"), &hash)
+	staticfilePath := filepath.Join(sf.BuildDir, "Staticfile")
+	err := sf.YAML.Load(staticfilePath, &hash)
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
-	isEnabled := func(value string) bool {
-		return (value == "enabled" || value == "true")
+	problems := sf.applyEnvironment(&hash)
+
+	redirects := hash.Redirects
+	sf.redirectsFile = hash.RedirectsFile
+	if hash.RedirectsFile != "" {
+		imported, fileProblems := sf.readRedirectsFile(hash.RedirectsFile)
+		problems = append(problems, fileProblems...)
+		if len(imported) > 0 {
+			sf.beginStep("redirects_file", "Importing %d redirect rules from %s", len(imported), hash.RedirectsFile)
+			redirects = append(redirects, imported...)
+		}
 	}
 
+	conf.Strict = hash.Strict.Enabled()
+	if err := sf.checkStaticfile(staticfilePath, problems); err != nil {
+		return err
+	}
+	if conf.Strict {
+		sf.beginStep("strict", "Enabling strict Staticfile validation")
+	}
+	sf.logDisabledOverrides(&hash)
+
 	if hash.RootDir != "" {
 		conf.RootDir = hash.RootDir
+		if _, ok := sf.overrides["root"]; ok {
+			sf.beginStep("root", "Using root %s", conf.RootDir)
+		}
 	}
 
-	if isEnabled(hash.HostDotFiles) {
-		sf.Log.BeginStep("Enabling hosting of dotfiles")
+	if hash.HostDotFiles.Enabled() {
+		sf.beginStep("host_dot_files", "Enabling hosting of dotfiles")
 		conf.HostDotFiles = true
 	}
 
 	conf.LocationInclude = hash.LocationInclude
 	if conf.LocationInclude != "" {
-		sf.Log.BeginStep("Enabling location include file %s", conf.LocationInclude)
+		sf.beginStep("location_include", "Enabling location include file %s", conf.LocationInclude)
 	}
 
-	if hash.DirectoryIndex != "" {
-		sf.Log.BeginStep("Enabling directory index for folders without index.html files")
+	if hash.DirectoryIndex.Enabled() {
+		sf.beginStep("directory", "Enabling directory index for folders without index.html files")
 		conf.DirectoryIndex = true
 	}
 
-	if isEnabled(hash.SSI) {
-		sf.Log.BeginStep("Enabling SSI")
+	if hash.SSI.Enabled() {
+		sf.beginStep("ssi", "Enabling SSI")
 		conf.SSI = true
 	}
 
-	if isEnabled(hash.PushState) {
-		sf.Log.BeginStep("Enabling pushstate")
+	if hash.PushState.Enabled() {
+		sf.beginStep("pushstate", "Enabling pushstate")
 		conf.PushState = true
 	}
 
-	if isEnabled(hash.HSTS) {
-		sf.Log.BeginStep("Enabling HSTS")
+	if hash.HSTS.Enabled() {
+		sf.beginStep("http_strict_transport_security", "Enabling HSTS")
 		conf.HSTS = true
 	}
-	if isEnabled(hash.HSTSIncludeSubDomains) {
-		sf.Log.BeginStep("Enabling HSTS includeSubDomains")
+	if hash.HSTSIncludeSubDomains.Enabled() {
+		sf.beginStep("http_strict_transport_security_include_subdomains", "Enabling HSTS includeSubDomains")
 		conf.HSTSIncludeSubDomains = true
 	}
-	if isEnabled(hash.HSTSPreload) {
-		sf.Log.BeginStep("Enabling HSTS Preload")
+	if hash.HSTSPreload.Enabled() {
+		sf.beginStep("http_strict_transport_security_preload", "Enabling HSTS Preload")
 		conf.HSTSPreload = true
 	}
-	if isEnabled(hash.EnableHttp2) {
-		sf.Log.BeginStep("Enabling HTTP/2")
+	if hash.EnableHttp2.Enabled() {
+		sf.beginStep("enable_http2", "Enabling HTTP/2")
 		conf.EnableHttp2 = true
 	}
-	if isEnabled(hash.ForceHTTPS) {
-		sf.Log.BeginStep("Enabling HTTPS redirect")
+	if hash.ForceHTTPS.Enabled() {
+		sf.beginStep("force_https", "Enabling HTTPS redirect")
 		conf.ForceHTTPS = true
 	}
 	if len(hash.StatusCodes) > 0 {
-		sf.Log.BeginStep("Enabling custom pages for status_codes")
+		sf.beginStep("status_codes", "Enabling custom pages for status_codes")
 		conf.StatusCodes = sf.getStatusCodes(hash.StatusCodes)
 	}
 
@@ -196,27 +296,129 @@ func (sf *Finalizer) LoadStaticfile() error {
 		sf.Log.Protip("http_strict_transport_security_include_subdomains and http_strict_transport_security_preload do nothing without http_strict_transport_security enabled.", "https://docs.cloudfoundry.org/buildpacks/staticfile/index.html#strict-security")
 	}
 
-	authFile := filepath.Join(sf.BuildDir, "Staticfile.auth")
-	_, err = os.Stat(authFile)
-	if err == nil {
+	if err := sf.loadAuthFiles(&hash); err != nil {
+		return err
+	}
+	authSource := defaultAuthFile
+	if hash.BasicAuthFile != "" && isValid(hash.BasicAuthFile, string(hash.BasicAuthFile)) {
+		authSource = string(hash.BasicAuthFile)
+	}
+	authFile, ok := sf.authFiles[authSource]
+	conf.BasicAuthFile = ok
+	conf.BasicAuthUserFile = authFile.Name
+	if hash.BasicAuthFrom.isSet() && hash.BasicAuthFrom.check() == nil {
+		// Credentials read at start replace those staged with the app.
+		if ok {
+			sf.Log.Warning("basic_auth_from replaces the credentials in %s", authSource)
+		}
+		sf.authSource = &hash.BasicAuthFrom
+		authSource = hash.BasicAuthFrom.String()
+		conf.BasicAuthFile = true
+		conf.BasicAuthUserFile = launcher.RuntimeAuthFile
+	}
+	if isValid(hash.BasicAuthRealm, string(hash.BasicAuthRealm)) {
+		conf.BasicAuthRealm = string(hash.BasicAuthRealm)
+	}
+	if conf.BasicAuthFile && (hash.BasicAuth == "" || hash.BasicAuth.Enabled()) {
 		conf.BasicAuth = true
-		sf.Log.BeginStep("Enabling basic authentication using Staticfile.auth")
+		sf.beginStep("basic_auth", "Enabling basic authentication using %s", authSource)
 		sf.Log.Protip("Learn about basic authentication", "https://docs.cloudfoundry.org/buildpacks/staticfile/index.html#authentication")
+	} else if !conf.BasicAuthFile && (hash.BasicAuth.Enabled() || hash.BasicAuthFile != "") {
+		sf.Log.Warning("basic_auth is enabled, but there is no %s with credentials", authSource)
+	}
+
+	if len(hash.Headers) > 0 {
+		conf.Headers = sf.loadHeaders("headers", hash.Headers)
+	}
+	if hash.SecurityHeaders.isSet() {
+		conf.Headers = append(conf.Headers, sf.loadSecurityHeaders(hash.SecurityHeaders)...)
+	}
+
+	if hash.Caching.isSet() {
+		sf.beginStep("caching", "Enabling Cache-Control policy")
+		conf.Caching = &hash.Caching
+	}
+
+	sf.redirectRules = redirects
+	if len(redirects) > 0 {
+		if conf.Redirects, err = sf.loadRedirects(redirects); err != nil {
+			return err
+		}
+	}
+
+	if hash.Access.isSet() {
+		conf.Access = sf.loadAccess(hash.Access)
+	}
+
+	if len(hash.Locations) > 0 {
+		conf.Locations = sf.loadLocations(hash.Locations)
+	}
+	if len(hash.Proxy) > 0 {
+		conf.Locations = sf.loadProxies(hash.Proxy, conf.Locations)
+	}
+
+	conf.Healthcheck = sf.loadHealthcheck(hash.Healthcheck)
+	conf.Metrics = sf.loadMetrics(hash.Metrics)
+	if len(hash.MimeTypes) > 0 {
+		conf.MimeTypes = sf.loadMimeTypes(hash.MimeTypes)
+	}
+	conf.Compression = sf.loadCompression(hash.Compression)
+	conf.Precompress = sf.loadPrecompress(hash.Precompress, conf.Compression)
+	conf.Brotli = sf.loadBrotli(hash.Brotli, conf.Compression)
+	if hash.Launch.isSet() {
+		conf.Launcher = sf.loadLaunch(hash.Launch)
+	}
+
+	if hash.Logging.isSet() {
+		conf.Logging = sf.loadLogging(hash.Logging)
+	}
+
+	if hasAddressRules(*conf) && (conf.Access == nil || len(conf.Access.TrustedProxies) == 0) {
+		sf.Log.Warning("access rules match the address of the Cloud Foundry router unless access.trusted_proxies lists it")
+	}
+	if hasBasicAuth(*conf) && !conf.ForceHTTPS {
+		sf.Log.Warning("basic authentication is enabled without force_https, so credentials can be sent over plain HTTP")
 	}
 
 	return nil
 }
 
+// checkStaticfile reports schema problems in the Staticfile, along with
+// those found in the environment or an imported file, as warnings, or
+// fails staging when the Staticfile sets `strict: true`.
+func (sf *Finalizer) checkStaticfile(staticfilePath string, extraProblems []schemaError) error {
+	problems, err := validateStaticfile(staticfilePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	problems = append(problems, extraProblems...)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	messages := make([]string, len(problems))
+	for i, problem := range problems {
+		messages[i] = problem.String()
+	}
+
+	if sf.Config.Strict {
+		return fmt.Errorf("the Staticfile is invalid:\n  %s", strings.Join(messages, "\n  "))
+	}
+
+	for _, message := range messages {
+		sf.Log.Warning("%s", message)
+	}
+	sf.Log.Protip("Set `strict: true` in the Staticfile to fail staging on invalid directives", "https://docs.cloudfoundry.org/buildpacks/staticfile/index.html")
+	return nil
+}
+
 func (sf *Finalizer) getStatusCodes(codes map[string]string) map[string]string {
 	var versions map[string]string
 	versions = make(map[string]string)
 	for key, value := range codes {
-		if strings.Contains(key, "4xx") {
-			key = "400 401 402 403 404 405 406 407 408 409 410 411 412 413 414 415 416 417 418 421 422 423 424 426 428 429 431 451"
-		} else if strings.Contains(key, "5xx") {
-			key = "500 501 502 503 504 505 506 507 508 510 511"
+		if parsed, err := parseStatusCodes(key); err == nil {
+			versions[strings.Join(parsed, " ")] = value
 		}
-		versions[key] = value
 	}
 	return versions
 }
@@ -255,7 +457,7 @@ func (sf *Finalizer) CopyFilesToPublic(appRootDir string) error {
 	publicDir := filepath.Join(sf.BuildDir, "public")
 
 	if publicDir == appRootDir {
-		return nil
+		return sf.removeStagedFiles(appRootDir, publicDir)
 	}
 
 	tmpDir, err := ioutil.TempDir("", "staticfile-buildpack.approot.")
@@ -283,6 +485,10 @@ func (sf *Finalizer) CopyFilesToPublic(appRootDir string) error {
 		}
 	}
 
+	if err := sf.removeStagedFiles(appRootDir, tmpDir); err != nil {
+		return err
+	}
+
 	if err := os.RemoveAll(publicDir); err != nil {
 		return err
 	}
@@ -310,6 +516,22 @@ func (sf *Finalizer) ConfigureNginx() error {
 
 	sf.Log.BeginStep("Configuring nginx")
 
+	if err := sf.configureNetlifyFiles(); err != nil {
+		return err
+	}
+
+	if sf.Config.Caching != nil {
+		if err := sf.configureCaching(); err != nil {
+			return err
+		}
+	}
+
+	if sf.Config.Brotli != nil {
+		if err := sf.configureBrotli(); err != nil {
+			return err
+		}
+	}
+
 	nginxConf, err := sf.generateNginxConf()
 	if err != nil {
 		sf.Log.Error("Unable to generate nginx.conf: %s", err.Error())
@@ -326,9 +548,13 @@ func (sf *Finalizer) ConfigureNginx() error {
 		return err
 	}
 
+	mimeTypes := MimeTypes
+	if len(sf.Config.MimeTypes) > 0 {
+		mimeTypes = mergeMimeTypes(MimeTypes, sf.Config.MimeTypes)
+	}
 	confFiles := map[string]string{
 		"nginx.conf": nginxConf,
-		"mime.types": MimeTypes}
+		"mime.types": mimeTypes}
 
 	for file, contents := range confFiles {
 		confDest := filepath.Join(confDir, file)
@@ -336,10 +562,17 @@ func (sf *Finalizer) ConfigureNginx() error {
 
 		_, err = os.Stat(customConfFile)
 		if err == nil {
+			if sf.customConf == nil {
+				sf.customConf = map[string]bool{}
+			}
+			sf.customConf[file] = true
 			err = os.Rename(customConfFile, confDest)
 			if file == "nginx.conf" {
 				sf.Log.Warning("overriding nginx.conf is deprecated and highly discouraged, as it breaks the functionality of the Staticfile and Staticfile.auth configuration directives. Please use the NGINX buildpack available at: https://github.com/cloudfoundry/nginx-buildpack")
 			}
+			if file == "mime.types" && err == nil && len(sf.Config.MimeTypes) > 0 {
+				err = sf.mergeCustomMimeTypes(confDest)
+			}
 		} else {
 			err = ioutil.WriteFile(confDest, []byte(contents), 0644)
 		}
@@ -349,10 +582,39 @@ func (sf *Finalizer) ConfigureNginx() error {
 		}
 	}
 
-	if sf.Config.BasicAuth {
-		authFile := filepath.Join(sf.BuildDir, "Staticfile.auth")
-		err = libbuildpack.CopyFile(authFile, filepath.Join(confDir, ".htpasswd"))
-		if err != nil {
+	if err := sf.writeServiceBindings(confDir); err != nil {
+		return err
+	}
+
+	if err := sf.writeAuthSource(confDir); err != nil {
+		return err
+	}
+
+	if err := sf.writeMetricsConfig(confDir); err != nil {
+		return err
+	}
+
+	if sf.Config.BasicAuthFile || sf.Config.BasicAuth {
+		authFile := filepath.Join(sf.BuildDir, defaultAuthFile)
+		if _, err := os.Stat(authFile); err == nil {
+			err = libbuildpack.CopyFile(authFile, filepath.Join(confDir, ".htpasswd"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, file := range sf.authFiles {
+		if file.Name == ".htpasswd" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(confDir, file.Name), file.Data, 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range sf.certFiles {
+		if err := ioutil.WriteFile(filepath.Join(confDir, file.Name), file.Data, 0644); err != nil {
 			return err
 		}
 	}
@@ -363,7 +625,27 @@ func (sf *Finalizer) ConfigureNginx() error {
 func (sf *Finalizer) generateNginxConf() (string, error) {
 	buffer := new(bytes.Buffer)
 
-	t := template.Must(template.New("nginx.conf").Parse(nginxConfTemplate))
+	t := template.Must(template.New("nginx.conf").Funcs(template.FuncMap{
+		"toggle":               erbToggle,
+		"setting":              erbSetting,
+		"inherit":              inheritToggle,
+		"rootScope":            rootScope,
+		"scope":                scope,
+		"access":               accessRules,
+		"trustsProxies":        trustsProxies,
+		"redactMaps":           redactMaps,
+		"redactsQuery":         redactsQuery,
+		"quote":                nginxQuote,
+		"locationMatch":        locationMatch,
+		"headers":              locationHeaders,
+		"mapHash":              mapHash,
+		"redirectMaps":         redirectMaps,
+		"hasUnforcedRedirects": hasUnforcedRedirects,
+		"hasWebSocketProxy":    hasWebSocketProxy,
+		"metricsLogFormat":     metricsLogFormat,
+		"compression":          compressionOf,
+	}).Parse(nginxConfTemplate))
+	template.Must(t.Parse(nginxLocationTemplate))
 
 	err := t.Execute(buffer, sf.Config)
 	if err != nil {
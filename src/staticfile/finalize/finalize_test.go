@@ -1,17 +1,24 @@
 package finalize_test
 
 import (
+	"compress/gzip"
+	"crypto/rand"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"syscall"
 
 	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/finalize"
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
 
 	"bytes"
 
+	"github.com/andybalholm/brotli"
 	"github.com/cloudfoundry/libbuildpack"
 	"github.com/cloudfoundry/libbuildpack/ansicleaner"
 	"github.com/golang/mock/gomock"
@@ -28,10 +35,12 @@ var _ = Describe("Compile", func() {
 		err        error
 		buildDir   string
 		depDir     string
+		binDir     string
 		finalizer  *finalize.Finalizer
 		logger     *libbuildpack.Logger
 		mockCtrl   *gomock.Controller
 		mockYaml   *MockYAML
+		mockCmd    *MockCommand
 		buffer     *bytes.Buffer
 		data       []byte
 	)
@@ -43,11 +52,19 @@ var _ = Describe("Compile", func() {
 		depDir, err = ioutil.TempDir("", "staticfile-buildpack.depDir.")
 		Expect(err).To(BeNil())
 
+		binDir, err = ioutil.TempDir("", "staticfile-buildpack.bin.")
+		Expect(err).To(BeNil())
+		for _, name := range []string{"launcher", "logs", "metrics"} {
+			err = ioutil.WriteFile(filepath.Join(binDir, name), []byte(name+" binary"), 0755)
+			Expect(err).To(BeNil())
+		}
+
 		buffer = new(bytes.Buffer)
 		logger = libbuildpack.NewLogger(ansicleaner.New(buffer))
 
 		mockCtrl = gomock.NewController(GinkgoT())
 		mockYaml = NewMockYAML(mockCtrl)
+		mockCmd = NewMockCommand(mockCtrl)
 	})
 
 	JustBeforeEach(func() {
@@ -56,7 +73,9 @@ var _ = Describe("Compile", func() {
 			DepDir:   depDir,
 			Config:   staticfile,
 			YAML:     mockYaml,
+			Command:  mockCmd,
 			Log:      logger,
+			BinDir:   binDir,
 		}
 	})
 
@@ -68,6 +87,9 @@ var _ = Describe("Compile", func() {
 
 		err = os.RemoveAll(depDir)
 		Expect(err).To(BeNil())
+
+		err = os.RemoveAll(binDir)
+		Expect(err).To(BeNil())
 	})
 
 	Describe("WriteStartupFiles", func() {
@@ -80,22 +102,103 @@ var _ = Describe("Compile", func() {
 			Expect(string(contents)).To(ContainSubstring("export LD_LIBRARY_PATH=$APP_ROOT/nginx/lib:$LD_LIBRARY_PATH"))
 		})
 
-		It("writes start_logging.sh in appdir", func() {
+		It("writes launch.json in the nginx conf dir", func() {
 			err = finalizer.WriteStartupFiles()
 			Expect(err).To(BeNil())
 
-			contents, err := ioutil.ReadFile(filepath.Join(buildDir, "start_logging.sh"))
+			contents, err := ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
 			Expect(err).To(BeNil())
-			Expect(string(contents)).To(Equal("\ncat < $APP_ROOT/nginx/logs/access.log &\n(>&2 cat) < $APP_ROOT/nginx/logs/error.log &\n"))
+			Expect(string(contents)).To(MatchJSON(`{
+				"conf": "nginx/conf/nginx.conf",
+				"fifos": ["nginx/logs/access.log", "nginx/logs/error.log"],
+				"forward": [
+					{"path": "nginx/logs/access.log", "out": "stdout"},
+					{"path": "nginx/logs/error.log", "out": "stderr"}
+				],
+				"drain_timeout": 8,
+				"restarts": 0
+			}`))
 		})
 
-		It("start_logging.sh is an executable file", func() {
+		It("installs the log forwarder", func() {
 			err = finalizer.WriteStartupFiles()
 			Expect(err).To(BeNil())
 
-			fi, err := os.Stat(filepath.Join(buildDir, "start_logging.sh"))
+			contents, err := ioutil.ReadFile(filepath.Join(depDir, "bin", "staticfile-logs"))
 			Expect(err).To(BeNil())
-			Expect(fi.Mode().Perm() & 0111).NotTo(Equal(os.FileMode(0000)))
+			Expect(string(contents)).To(Equal("logs binary"))
+		})
+
+		It("installs the launcher instead of rendering nginx.conf with erb", func() {
+			err = finalizer.WriteStartupFiles()
+			Expect(err).To(BeNil())
+
+			contents, err := ioutil.ReadFile(filepath.Join(depDir, "bin", "staticfile-launcher"))
+			Expect(err).To(BeNil())
+			Expect(string(contents)).To(Equal("launcher binary"))
+
+			contents, err = ioutil.ReadFile(filepath.Join(depDir, "profile.d", "staticfile.sh"))
+			Expect(err).To(BeNil())
+			Expect(string(contents)).NotTo(ContainSubstring("erb"))
+			Expect(string(contents)).NotTo(ContainSubstring("nginx.conf"))
+		})
+
+		It("no longer creates the FIFOs in staticfile.sh", func() {
+			err = finalizer.WriteStartupFiles()
+			Expect(err).To(BeNil())
+
+			contents, err := ioutil.ReadFile(filepath.Join(depDir, "profile.d", "staticfile.sh"))
+			Expect(err).To(BeNil())
+			Expect(string(contents)).NotTo(ContainSubstring("mkfifo"))
+		})
+
+		It("leaves resolving services and basic_auth_from to the launcher", func() {
+			err = finalizer.WriteStartupFiles()
+			Expect(err).To(BeNil())
+
+			contents, err := ioutil.ReadFile(filepath.Join(depDir, "profile.d", "staticfile.sh"))
+			Expect(err).To(BeNil())
+			Expect(string(contents)).NotTo(ContainSubstring("ruby"))
+		})
+
+		Context("logging sets a prefix", func() {
+			BeforeEach(func() {
+				staticfile.Logging = &finalize.AccessLog{Format: "cloudfoundry", Prefix: "[web's] "}
+			})
+
+			AfterEach(func() {
+				staticfile.Logging = nil
+			})
+
+			It("prefixes the forwarded lines", func() {
+				err = finalizer.WriteStartupFiles()
+				Expect(err).To(BeNil())
+
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.LogPrefix).To(Equal("[web's] "))
+			})
+		})
+
+		Context("the staticfile sets launch", func() {
+			BeforeEach(func() {
+				staticfile.Launcher = &finalize.Launcher{BeforeStart: []string{"./bin/configure"}, DrainTimeout: 20, Restarts: 2}
+			})
+
+			AfterEach(func() {
+				staticfile.Launcher = nil
+			})
+
+			It("stages the commands and shutdown settings", func() {
+				err = finalizer.WriteStartupFiles()
+				Expect(err).To(BeNil())
+
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.BeforeStart).To(Equal([]string{"./bin/configure"}))
+				Expect(config.DrainTimeout).To(Equal(20))
+				Expect(config.Restarts).To(Equal(2))
+			})
 		})
 
 		It("writes boot.sh in appdir", func() {
@@ -104,7 +207,7 @@ var _ = Describe("Compile", func() {
 
 			contents, err := ioutil.ReadFile(filepath.Join(buildDir, "boot.sh"))
 			Expect(err).To(BeNil())
-			Expect(string(contents)).To(Equal("#!/bin/sh\nset -ex\n$APP_ROOT/start_logging.sh\nnginx -p $APP_ROOT/nginx -c $APP_ROOT/nginx/conf/nginx.conf\n"))
+			Expect(string(contents)).To(Equal("#!/bin/sh\nexec staticfile-launcher run $APP_ROOT/nginx/conf/launch.json\n"))
 		})
 
 		It("boot.sh is an executable file", func() {
@@ -115,6 +218,56 @@ var _ = Describe("Compile", func() {
 			Expect(err).To(BeNil())
 			Expect(fi.Mode().Perm() & 0111).NotTo(Equal(os.FileMode(0000)))
 		})
+
+		Context("the health check reports readiness", func() {
+			BeforeEach(func() {
+				staticfile.Healthcheck = &finalize.Healthcheck{Path: "/healthz", Readiness: true}
+			})
+
+			AfterEach(func() {
+				staticfile.Healthcheck = nil
+			})
+
+			It("has the launcher mark nginx ready", func() {
+				err = finalizer.WriteStartupFiles()
+				Expect(err).To(BeNil())
+
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.Ready).To(Equal("nginx/run/ready"))
+			})
+		})
+
+		Context("metrics are enabled", func() {
+			BeforeEach(func() {
+				staticfile.Metrics = &finalize.Metrics{Port: 9113}
+			})
+
+			AfterEach(func() {
+				staticfile.Metrics = nil
+			})
+
+			It("installs the metrics process for the launcher to start", func() {
+				err = finalizer.WriteStartupFiles()
+				Expect(err).To(BeNil())
+
+				contents, err := ioutil.ReadFile(filepath.Join(depDir, "bin", "staticfile-metrics"))
+				Expect(err).To(BeNil())
+				Expect(string(contents)).To(Equal("metrics binary"))
+
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.Metrics).To(Equal("nginx/conf/metrics.json"))
+				Expect(config.Sockets).To(Equal([]string{"nginx/run/status.sock"}))
+				Expect(config.FIFOs).To(Equal([]string{"nginx/logs/access.log", "nginx/logs/error.log", "nginx/logs/metrics.log"}))
+			})
+
+			It("fails without the metrics binary", func() {
+				Expect(os.Remove(filepath.Join(binDir, "metrics"))).To(Succeed())
+				err = finalizer.WriteStartupFiles()
+				Expect(err).To(MatchError(ContainSubstring("the buildpack has no metrics binary")))
+			})
+		})
 	})
 
 	Describe("LoadStaticfile", func() {
@@ -142,6 +295,10 @@ var _ = Describe("Compile", func() {
 				Expect(finalizer.Config.EnableHttp2).To(Equal(false))
 				Expect(finalizer.Config.ForceHTTPS).To(Equal(false))
 				Expect(finalizer.Config.BasicAuth).To(Equal(false))
+				Expect(finalizer.Config.Precompress).To(BeNil())
+				Expect(finalizer.Config.Compression.Dynamic).To(BeTrue())
+				Expect(finalizer.Config.Compression.Level).To(Equal(6))
+				Expect(finalizer.Config.Compression.Types).To(ContainElement("application/wasm"))
 			})
 
 			It("does not log enabling statements", func() {
@@ -197,7 +354,7 @@ var _ = Describe("Compile", func() {
 			Context("and sets directory", func() {
 				BeforeEach(func() {
 					mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
-						(*hash).DirectoryIndex = "any_string"
+						(*hash).DirectoryIndex = "visible"
 					})
 				})
 				It("sets location_include", func() {
@@ -208,6 +365,28 @@ var _ = Describe("Compile", func() {
 				})
 			})
 
+			Context("and sets directory to false", func() {
+				BeforeEach(func() {
+					mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
+						(*hash).DirectoryIndex = "false"
+					})
+				})
+				It("does not set directory", func() {
+					Expect(finalizer.Config.DirectoryIndex).To(Equal(false))
+				})
+			})
+
+			Context("and sets pushstate to on", func() {
+				BeforeEach(func() {
+					mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
+						(*hash).PushState = "on"
+					})
+				})
+				It("sets pushstate", func() {
+					Expect(finalizer.Config.PushState).To(Equal(true))
+				})
+			})
+
 			Context("and sets ssi", func() {
 				BeforeEach(func() {
 					mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
@@ -350,7 +529,7 @@ var _ = Describe("Compile", func() {
 
 		Context("Staticfile.auth is present", func() {
 			BeforeEach(func() {
-				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("some credentials"), 0644)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("bob:$apr1$DuUQEQp8$ZccZCHQElNSjrg.erwSFC0\n"), 0644)
 				Expect(err).To(BeNil())
 			})
 			JustBeforeEach(func() {
@@ -385,509 +564,2917 @@ var _ = Describe("Compile", func() {
 			})
 		})
 
-		Context("the staticfile exists and is not valid", func() {
+		Context("the staticfile sets per-path basic auth", func() {
 			BeforeEach(func() {
-				mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Return(errors.New("a yaml parsing error"))
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`basic_auth: false
+basic_auth_realm: Team
+locations:
+  /admin/:
+    basic_auth_file: config/admin.htpasswd
+    basic_auth_realm: Admins
+  /healthz:
+    basic_auth: false
+  /reports/:
+    basic_auth_file: missing.htpasswd
+`), 0644)
+				Expect(err).To(BeNil())
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("# team\nann:{PLAIN}secret\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\ncid:rl0uE/yiMWMDk\ndan:$2y$05$zBO9Bf.RjUu0dSW8DtYGeu2BbWw1jf/pj1XUXNM5P.c4wAmYd8tGi\n"), 0644)
+				Expect(err).To(BeNil())
+				Expect(os.MkdirAll(filepath.Join(buildDir, "config"), 0755)).To(Succeed())
+				err = ioutil.WriteFile(filepath.Join(buildDir, "config", "admin.htpasswd"), []byte("eve:$apr1$DuUQEQp8$ZccZCHQElNSjrg.erwSFC0\n"), 0644)
+				Expect(err).To(BeNil())
 			})
 
-			It("returns an error", func() {
+			JustBeforeEach(func() {
 				err = finalizer.LoadStaticfile()
-				Expect(err).NotTo(BeNil())
+				Expect(err).To(BeNil())
 			})
-		})
-	})
 
-	Describe("GetAppRootDir", func() {
-		var (
-			returnDir string
-		)
+			It("protects only the locations that ask for credentials", func() {
+				Expect(finalizer.Config.BasicAuth).To(BeFalse())
+				Expect(finalizer.Config.BasicAuthFile).To(BeTrue())
+				Expect(finalizer.Config.BasicAuthUserFile).To(Equal(".htpasswd"))
+				Expect(finalizer.Config.BasicAuthRealm).To(Equal("Team"))
 
-		JustBeforeEach(func() {
-			returnDir, err = finalizer.GetAppRootDir()
-		})
+				Expect(finalizer.Config.Locations[0].Match).To(Equal("/reports/"))
+				Expect(finalizer.Config.Locations[0].BasicAuth).To(Equal(finalize.Toggle("")))
+				Expect(finalizer.Config.Locations[1].Match).To(Equal("/healthz"))
+				Expect(finalizer.Config.Locations[1].BasicAuth).To(Equal(finalize.Toggle("false")))
+				Expect(finalizer.Config.Locations[2].Match).To(Equal("/admin/"))
+				Expect(finalizer.Config.Locations[2].BasicAuth).To(Equal(finalize.Toggle("enabled")))
+				Expect(finalizer.Config.Locations[2].BasicAuthUserFile).To(Equal(".htpasswd-config_admin.htpasswd"))
+				Expect(finalizer.Config.Locations[2].BasicAuthRealm).To(Equal("Admins"))
+			})
 
-		Context("the staticfile has a root directory specified", func() {
-			Context("the directory does not exist", func() {
-				BeforeEach(func() {
-					staticfile.RootDir = "not_exist"
-				})
+			It("warns about weak hashes, missing files and plain HTTP", func() {
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile.auth line 2, column 1: the password of ann is plain text"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile.auth line 3, column 1: the password of bob is an unsalted SHA-1 hash"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile.auth line 4, column 1: the password of cid is a crypt DES hash, which only checks the first 8 characters"))
+				Expect(buffer.String()).NotTo(ContainSubstring("the password of dan"))
+				Expect(buffer.String()).NotTo(ContainSubstring("the password of eve"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** basic_auth is enabled for location /reports/, but there is no missing.htpasswd with credentials"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** basic authentication is enabled without force_https, so credentials can be sent over plain HTTP"))
+			})
 
-				It("logs the staticfile's root directory", func() {
-					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
-					Expect(buffer.String()).To(ContainSubstring("not_exist"))
+			It("stages the credentials without serving them", func() {
+				Expect(finalizer.CopyFilesToPublic(buildDir)).To(Succeed())
+				Expect(finalizer.ConfigureNginx()).To(Succeed())
+				Expect(filepath.Join(buildDir, "public", "config", "admin.htpasswd")).NotTo(BeAnExistingFile())
 
-				})
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", ".htpasswd-config_admin.htpasswd"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(Equal("eve:$apr1$DuUQEQp8$ZccZCHQElNSjrg.erwSFC0\n"))
+				Expect(filepath.Join(buildDir, "nginx", "conf", ".htpasswd")).To(BeARegularFile())
 
-				It("returns an error", func() {
-					Expect(returnDir).To(Equal(""))
-					Expect(err).NotTo(BeNil())
-					Expect(err.Error()).To(ContainSubstring("the application Staticfile specifies a root directory"))
-					Expect(err.Error()).To(ContainSubstring("that does not exist"))
-				})
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("location /admin/ {\n"))
+				Expect(conf).To(ContainSubstring("<% if true %>\nauth_basic \"Admins\";  #For Basic Auth\nauth_basic_user_file <%= ENV[\"APP_ROOT\"] %>/nginx/conf/.htpasswd-config_admin.htpasswd;\n"))
+				Expect(conf).To(ContainSubstring("auth_basic \"Team\";  #For Basic Auth\nauth_basic_user_file <%= ENV[\"APP_ROOT\"] %>/nginx/conf/.htpasswd;\n"))
 			})
 
-			Context("the directory exists but is actually a file", func() {
+			Context("and force_https", func() {
 				BeforeEach(func() {
-					ioutil.WriteFile(filepath.Join(buildDir, "actually_a_file"), []byte("xxx"), 0644)
-					staticfile.RootDir = "actually_a_file"
+					Expect(os.Setenv("BP_STATICFILE_FORCE_HTTPS", "true")).To(Succeed())
 				})
 
-				It("logs the staticfile's root directory", func() {
-					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
-					Expect(buffer.String()).To(ContainSubstring("actually_a_file"))
+				AfterEach(func() {
+					Expect(os.Unsetenv("BP_STATICFILE_FORCE_HTTPS")).To(Succeed())
 				})
 
-				It("returns an error", func() {
-					Expect(returnDir).To(Equal(""))
-					Expect(err).NotTo(BeNil())
-					Expect(err.Error()).To(ContainSubstring("the application Staticfile specifies a root directory"))
-					Expect(err.Error()).To(ContainSubstring("that is a plain file"))
+				It("does not warn about plain HTTP", func() {
+					Expect(buffer.String()).NotTo(ContainSubstring("without force_https"))
 				})
 			})
+		})
 
-			Context("the directory exists", func() {
+		Context("the staticfile reads basic auth users at start", func() {
+			var staticfileYaml string
+
+			BeforeEach(func() {
+				staticfileYaml = "basic_auth_from:\n  env: SITE_USERS\n"
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("bob:$apr1$DuUQEQp8$ZccZCHQElNSjrg.erwSFC0\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(staticfileYaml), 0644)).To(Succeed())
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("replaces Staticfile.auth", func() {
+				Expect(finalizer.Config.BasicAuth).To(BeTrue())
+				Expect(finalizer.Config.BasicAuthUserFile).To(Equal(".htpasswd-runtime"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** basic_auth_from replaces the credentials in Staticfile.auth"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling basic authentication using SITE_USERS\n"))
+			})
+
+			It("stages the source for the launcher", func() {
+				Expect(finalizer.ConfigureNginx()).To(Succeed())
+				Expect(finalizer.WriteStartupFiles()).To(Succeed())
+
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "auth.json"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(MatchJSON(`{"env": "SITE_USERS"}`))
+				Expect(filepath.Join(buildDir, "nginx", "conf", "auth.rb")).NotTo(BeAnExistingFile())
+
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.Auth).To(Equal("nginx/conf/auth.json"))
+
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring(`auth_basic_user_file <%= ENV["APP_ROOT"] %>/nginx/conf/.htpasswd-runtime;`))
+			})
+
+			Context("from a bound service", func() {
 				BeforeEach(func() {
-					os.Mkdir(filepath.Join(buildDir, "a_directory"), 0755)
-					staticfile.RootDir = "a_directory"
+					staticfileYaml = "basic_auth_from:\n  tag: site-users\n  field: users\n"
 				})
 
-				It("logs the staticfile's root directory", func() {
-					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
-					Expect(buffer.String()).To(ContainSubstring("a_directory"))
+				It("logs the service", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Enabling basic authentication using the users of the service tagged site-users\n"))
 				})
+			})
 
-				It("returns the full directory path", func() {
-					Expect(err).To(BeNil())
-					Expect(returnDir).To(Equal(filepath.Join(buildDir, "a_directory")))
+			Context("from more than one source", func() {
+				BeforeEach(func() {
+					staticfileYaml = "basic_auth_from:\n  env: SITE_USERS\n  service: site-users\n"
+				})
+
+				It("keeps Staticfile.auth and reports the problem", func() {
+					Expect(finalizer.Config.BasicAuthUserFile).To(Equal(".htpasswd"))
+					Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile line 2, column 3: basic_auth_from: expected one of env, service or tag"))
 				})
 			})
 		})
 
-		Context("the staticfile does not have an root directory", func() {
+		Context("Staticfile.auth is malformed", func() {
 			BeforeEach(func() {
-				staticfile.RootDir = ""
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any())
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("bob\nalice:secret\n"), 0644)
+				Expect(err).To(BeNil())
 			})
 
-			It("logs the build directory as the root directory", func() {
-				Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
-				Expect(buffer.String()).To(ContainSubstring(buildDir))
-			})
-			It("returns the build directory", func() {
-				Expect(err).To(BeNil())
-				Expect(returnDir).To(Equal(buildDir))
+			It("fails staging", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(MatchError("invalid basic authentication credentials:\n  Staticfile.auth line 1, column 1: expected user:password-hash\n  Staticfile.auth line 2, column 1: unrecognized password hash for alice"))
 			})
 		})
-	})
 
-	Describe("Warnings", func() {
-		JustBeforeEach(func() {
-			finalizer.Warnings()
-		})
+		Context("BP_STATICFILE_* variables are set", func() {
+			var env map[string]string
 
-		Context("app dir has a nginx/conf directory", func() {
-			const WarningLine1 = "**WARNING** You have an nginx/conf directory, but have not set *root*, or have set it to '.'."
-			const WarningLine2 = "If you are using the nginx/conf directory for nginx configuration, you probably need to also set the *root* directive."
 			BeforeEach(func() {
-				os.MkdirAll(filepath.Join(buildDir, "nginx", "conf"), 0755)
+				env = map[string]string{}
 			})
 
-			Context("root is NOT set", func() {
+			JustBeforeEach(func() {
+				for name, value := range env {
+					Expect(os.Setenv(name, value)).To(Succeed())
+				}
+				err = finalizer.LoadStaticfile()
+			})
+
+			AfterEach(func() {
+				for name := range env {
+					Expect(os.Unsetenv(name)).To(Succeed())
+				}
+			})
+
+			Context("and the Staticfile does not set the directive", func() {
 				BeforeEach(func() {
-					staticfile.RootDir = ""
+					mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).Return(os.ErrNotExist)
+					env["BP_STATICFILE_PUSHSTATE"] = "on"
+					env["BP_STATICFILE_STATUS_CODES"] = "{404: /404.html}"
 				})
-				It("warns the user", func() {
-					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
-					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+
+				It("uses the environment", func() {
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.PushState).To(Equal(true))
+					Expect(finalizer.Config.StatusCodes).To(Equal(map[string]string{"404": "/404.html"}))
+				})
+
+				It("logs where the value came from", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Enabling pushstate (from BP_STATICFILE_PUSHSTATE)\n"))
+					Expect(buffer.String()).To(ContainSubstring("-----> Enabling custom pages for status_codes (from BP_STATICFILE_STATUS_CODES)\n"))
 				})
 			})
 
-			Context("root is set to .", func() {
+			Context("and the Staticfile sets the directive", func() {
 				BeforeEach(func() {
-					staticfile.RootDir = "."
+					mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
+						(*hash).SSI = "enabled"
+						(*hash).RootDir = "public"
+					})
+					env["BP_STATICFILE_SSI"] = "false"
+					env["BP_STATICFILE_ROOT"] = "dist"
 				})
-				It("warns the user", func() {
-					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
-					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+
+				It("overrides the Staticfile", func() {
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.SSI).To(Equal(false))
+					Expect(finalizer.Config.RootDir).To(Equal("dist"))
+				})
+
+				It("logs where the value came from", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Disabling ssi (from BP_STATICFILE_SSI)\n"))
+					Expect(buffer.String()).To(ContainSubstring("-----> Using root dist (from BP_STATICFILE_ROOT)\n"))
+					Expect(buffer.String()).NotTo(ContainSubstring("Enabling SSI"))
 				})
 			})
 
-			Context("root is set to something equivent to .", func() {
+			Context("and the value is invalid", func() {
 				BeforeEach(func() {
-					staticfile.RootDir = "./fred/.."
+					mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
+						(*hash).SSI = "enabled"
+					})
+					env["BP_STATICFILE_SSI"] = "yes"
 				})
-				It("warns the user", func() {
-					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
-					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+
+				It("keeps the Staticfile value and warns", func() {
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.SSI).To(Equal(true))
+					Expect(buffer.String()).To(ContainSubstring(`**WARNING** BP_STATICFILE_SSI: invalid value "yes"`))
+				})
+
+				Context("and BP_STATICFILE_STRICT is enabled", func() {
+					BeforeEach(func() {
+						env["BP_STATICFILE_STRICT"] = "true"
+					})
+
+					It("returns an error", func() {
+						Expect(err).NotTo(BeNil())
+						Expect(err.Error()).To(ContainSubstring(`BP_STATICFILE_SSI: invalid value "yes"`))
+					})
 				})
 			})
 
-			Context("root IS set something other than .", func() {
+			Context("and BP_STATICFILE_BASIC_AUTH disables a Staticfile.auth", func() {
 				BeforeEach(func() {
-					staticfile.RootDir = "somedir"
+					mockYaml.EXPECT().Load(gomock.Any(), gomock.Any())
+					Expect(ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("bob:$apr1$DuUQEQp8$ZccZCHQElNSjrg.erwSFC0\n"), 0644)).To(Succeed())
+					env["BP_STATICFILE_BASIC_AUTH"] = "disabled"
 				})
-				It("does not warn the user", func() {
-					Expect(buffer.String()).ToNot(ContainSubstring(WarningLine1))
-					Expect(buffer.String()).ToNot(ContainSubstring(WarningLine2))
+
+				It("keeps the credentials for the start-time override", func() {
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.BasicAuth).To(Equal(false))
+					Expect(finalizer.Config.BasicAuthFile).To(Equal(true))
+					Expect(buffer.String()).To(ContainSubstring("-----> Disabling basic_auth (from BP_STATICFILE_BASIC_AUTH)\n"))
 				})
 			})
 		})
-	})
 
-	Describe("ConfigureNginx", func() {
-		JustBeforeEach(func() {
-			err = finalizer.ConfigureNginx()
-			Expect(err).To(BeNil())
-		})
+		Context("the staticfile sets locations", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`
+locations:
+  "~* \\.php$":
+    status_codes:
+      404: /gone.html
+  /downloads/:
+    directory: enabled
+  "~ ^/legacy/":
+    ssi: on
+  = /admin:
+    basic_auth: enabled
+  /:
+    ssi: on
+  "~ ^/[0-9a-f]{8}/":
+    expires: 1d
+  '~ ^/a\"b\;':
+    expires: 1d
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("orders them like nginx evaluates them, keeping regexes in Staticfile order", func() {
+				var matches []string
+				for _, location := range finalizer.Config.Locations {
+					matches = append(matches, location.Match)
+				}
+				Expect(matches).To(Equal([]string{"= /admin", "/downloads/", "~* \\.php$", "~ ^/legacy/", "~ ^/[0-9a-f]{8}/", `~ ^/a\"b\;`}))
+			})
+
+			It("keeps the directives of each location", func() {
+				Expect(finalizer.Config.Locations[1].DirectoryIndex).To(Equal(finalize.Toggle("enabled")))
+				Expect(finalizer.Config.Locations[2].StatusCodes).To(Equal(map[string]string{"404": "/gone.html"}))
+			})
+
+			It("logs each location", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling rules for location /downloads/\n"))
+			})
+
+			It("rejects a location for / and warns about missing credentials", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 12, column 3: locations: use the top-level directives for location /`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** basic_auth is enabled for location = /admin, but there is no Staticfile.auth with credentials`))
+			})
+
+			Context("with an unescaped quote in a regex", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("locations:\n  '~ ^/a\"b':\n    expires: 1d\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("rejects the location", func() {
+					Expect(finalizer.Config.Locations).To(BeEmpty())
+					Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 3: locations: invalid location "~ ^/a\"b", escape " and ; in a regular expression with \`))
+				})
+			})
+		})
+
+		Context("the staticfile sets headers", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`headers:
+  X-Frame-Options: DENY
+  /downloads/*.pdf:
+    Content-Disposition: attachment
+  /downloads/**:
+    X-Frame-Options: SAMEORIGIN
+  Content-Length: 10
+  Bad Header: value
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("merges global and path glob headers by name", func() {
+				Expect(finalizer.Config.Headers).To(Equal([]finalize.ResponseHeader{
+					{
+						Name:     "Content-Disposition",
+						Globs:    []finalize.HeaderGlob{{Pattern: "/downloads/*.pdf", Regex: `^/downloads/[^/]*\.pdf$`, Value: "attachment"}},
+						Variable: "$staticfile_header_content_disposition",
+					},
+					{
+						Name:     "X-Frame-Options",
+						Value:    "DENY",
+						Globs:    []finalize.HeaderGlob{{Pattern: "/downloads/**", Regex: `^/downloads/.*$`, Value: "SAMEORIGIN"}},
+						Variable: "$staticfile_header_x_frame_options",
+					},
+				}))
+			})
+
+			It("logs each header", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling response header Content-Disposition for /downloads/*.pdf\n"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling response header X-Frame-Options\n"))
+			})
+
+			It("reports invalid headers", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 7, column 3: headers.Content-Length: header Content-Length is managed by nginx and cannot be set`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 8, column 3: headers.Bad Header: invalid header name "Bad Header"`))
+			})
+		})
+
+		Context("the staticfile sets caching", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`caching:
+  preset: spa
+  default: 1h
+  paths:
+    /static/**: 7d
+    /api/*.json: no-store
+  extensions:
+    css: 30d
+  stale_while_revalidate: 1m
+  stale_if_error: 5
+  surrogate_control: 1d
+  fingerprinted: forever
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("keeps the paths in Staticfile order", func() {
+				Expect(finalizer.Config.Caching).NotTo(BeNil())
+				Expect(finalizer.Config.Caching.Preset).To(Equal(finalize.CachePreset("spa")))
+				Expect(finalizer.Config.Caching.Paths).To(Equal(finalize.CachePaths{
+					{Glob: "/static/**", Value: "7d"},
+					{Glob: "/api/*.json", Value: "no-store"},
+				}))
+				Expect(finalizer.Config.Caching.Extensions).To(Equal(map[string]finalize.CacheValue{"css": "30d"}))
+			})
+
+			It("logs the policy", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling Cache-Control policy\n"))
+			})
+
+			It("reports invalid values", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 12, column 18: caching.fingerprinted: invalid cache value "forever"`))
+			})
+		})
+
+		Context("the staticfile sets security_headers", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`headers:
+  Referrer-Policy: same-origin
+security_headers:
+  preset: strict
+  frame_options: sameorigin
+  frame_ancestors: [self, https://partner.example.com]
+  permissions_policy:
+    geolocation: [self, https://maps.example.com]
+  content_security_policy:
+    script-src: [self, wasm-unsafe-eval, https://cdn.example.com]
+    upgrade-insecure-requests: []
+  cross_origin_embedder_policy: require-corp
+  cross_origin_opener_policy: allow-all
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("applies the overrides on top of the preset", func() {
+				Expect(finalizer.Config.Headers).To(Equal([]finalize.ResponseHeader{
+					{Name: "Referrer-Policy", Value: "same-origin"},
+					{Name: "Content-Security-Policy", Value: "default-src 'self'; base-uri 'self'; form-action 'self'; frame-ancestors 'self' https://partner.example.com; object-src 'none'; script-src 'self' 'wasm-unsafe-eval' https://cdn.example.com; upgrade-insecure-requests"},
+					{Name: "Cross-Origin-Embedder-Policy", Value: "require-corp"},
+					{Name: "Cross-Origin-Opener-Policy", Value: "same-origin"},
+					{Name: "Permissions-Policy", Value: `geolocation=(self "https://maps.example.com")`},
+					{Name: "X-Content-Type-Options", Value: "nosniff"},
+					{Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+				}))
+			})
+
+			It("logs each security header", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling X-Frame-Options: SAMEORIGIN\n"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling Cross-Origin-Embedder-Policy: require-corp\n"))
+			})
+
+			It("keeps headers set under headers", func() {
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Referrer-Policy is set under headers, which takes precedence over security_headers"))
+			})
+
+			It("reports invalid values and falls back to the preset", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 13, column 31: security_headers.cross_origin_opener_policy: invalid value "allow-all", expected one of same-origin, same-origin-allow-popups, unsafe-none, off`))
+			})
+		})
+
+		Context("the staticfile sets the basic security_headers preset", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("security_headers:\n  preset: basic\n  content_security_policy_report_only: true\n  content_security_policy: {default-src: [self]}\n  content_type_options: \"off\"\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("sets the basic headers", func() {
+				Expect(finalizer.LoadStaticfile()).To(Succeed())
+				Expect(finalizer.Config.Headers).To(Equal([]finalize.ResponseHeader{
+					{Name: "Content-Security-Policy-Report-Only", Value: "default-src 'self'"},
+					{Name: "Referrer-Policy", Value: "strict-origin-when-cross-origin"},
+					{Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+				}))
+			})
+		})
+
+		Context("the staticfile drops the policy of the strict security_headers preset", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("security_headers:\n  preset: strict\n  frame_ancestors: [self]\n  content_security_policy: {}\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("keeps only frame-ancestors", func() {
+				Expect(finalizer.LoadStaticfile()).To(Succeed())
+				Expect(finalizer.Config.Headers).To(ContainElement(finalize.ResponseHeader{Name: "Content-Security-Policy", Value: "frame-ancestors 'self'"}))
+			})
+		})
+
+		Context("the staticfile sets redirects", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`redirects:
+  - from: /old
+    to: /new
+  - from: /blog/
+    to: https://blog.example.com/
+    match: prefix
+    status: 308
+    preserve_query: false
+  - from: /app/*
+    to: index.html
+    status: 200
+  - from: /a
+    to: /b
+  - from: /b
+    to: /a
+redirects_file: legacy.csv
+`), 0644)
+				Expect(err).To(BeNil())
+				err = ioutil.WriteFile(filepath.Join(buildDir, "legacy.csv"), []byte("from,to,status,match\n/products.php,/products,301\n^/p/([0-9]+)$,/products/$1,302,regex\n/broken,/x,999\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("loads the Staticfile rules followed by the imported ones", func() {
+				Expect(finalizer.Config.Redirects).To(Equal([]finalize.Redirect{
+					{From: "/old", To: "/new", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/blog/", To: "https://blog.example.com/", Status: 308, Match: "prefix", PreserveQuery: false, Force: true},
+					{From: "/a", To: "/b", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/b", To: "/a", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/products.php", To: "/products", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "^/p/([0-9]+)$", To: "/products/$1", Status: 302, Match: "regex", PreserveQuery: true, Force: true},
+				}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Importing 2 redirect rules from legacy.csv\n"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling 6 redirect and rewrite rules\n"))
+			})
+
+			It("reports invalid rules", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 9, column 5: redirects[2]: rewrite to "index.html" must start with /`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** legacy.csv line 4, column 1: invalid status 999, expected one of 200, 301, 302, 303, 307, 308`))
+			})
+
+			It("reports redirect loops", func() {
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** redirect loop: /a -> /b -> /a"))
+			})
+		})
+
+		Context("the staticfile imports a _redirects file", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("redirects_file: _redirects\n"), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "_redirects"), []byte(`# legacy blog
+/news/:year/:slug  /blog/:year/:slug  301!
+/docs/*            /guide/:splat
+/*                 /index.html        200
+/store id=:id      /products/:id      301
+/fr/*              /fr/index.html     200  Language=fr
+`), 0644)).To(Succeed())
+			})
+
+			It("translates placeholders and splats", func() {
+				Expect(finalizer.LoadStaticfile()).To(Succeed())
+				Expect(finalizer.Config.Redirects).To(Equal([]finalize.Redirect{
+					{From: "^/news/([^/]+)/([^/]+)$", To: "/blog/$1/$2", Status: 301, Match: "regex", PreserveQuery: true, Force: true},
+					{From: "^/docs/(.*)$", To: "/guide/$1", Status: 301, Match: "regex", PreserveQuery: true, Force: false},
+					{From: "^/(.*)$", To: "/index.html", Status: 200, Match: "regex", PreserveQuery: true, Force: false},
+				}))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** _redirects line 5, column 1: query parameter matching is not supported"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** _redirects line 6, column 1: unsupported option "Language=fr"`))
+			})
+		})
+
+		Context("the staticfile sets proxy", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`locations:
+  /api/:
+    expires: 1h
+proxy:
+  /api/:
+    upstream: https://api.example.com/v1/
+    connect_timeout: 5s
+    read_timeout: 2m
+    host: client
+    set_headers:
+      X-Api-Key: secret
+    remove_headers: [Cookie]
+    websocket: true
+    buffering: false
+    tls_verify: false
+    tls_verify_depth: 12
+  /legacy/:
+    upstream: ftp://legacy.example.com
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("replaces the location with the same path", func() {
+				Expect(finalizer.Config.Locations).To(Equal([]finalize.Location{{
+					Match: "^~ /api/",
+					Proxy: &finalize.Proxy{
+						Upstream:              "https://api.example.com/v1/",
+						ConnectTimeout:        "5s",
+						ReadTimeout:           "2m",
+						Host:                  "$best_host",
+						SetHeaders:            map[string]string{"X-Api-Key": "secret"},
+						RemoveHeaders:         []string{"Cookie"},
+						WebSocket:             true,
+						Buffering:             false,
+						RequestBuffering:      true,
+						TLS:                   true,
+						TLSVerify:             false,
+						TLSVerifyDepth:        3,
+						TLSTrustedCertificate: "/etc/ssl/certs/ca-certificates.crt",
+					},
+				}}))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** proxy /api/ replaces the location /api/"))
+			})
+
+			It("logs the proxy", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling proxy from /api/ to https://api.example.com/v1/\n"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** TLS verification is disabled for the proxy from /api/ to https://api.example.com/v1/"))
+			})
+
+			It("reports invalid upstreams", func() {
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 16, column 23: proxy./api/.tls_verify_depth: invalid verify depth "12", expected a number from 1 to 10`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 18, column 15: proxy./legacy/.upstream: invalid upstream "ftp://legacy.example.com", expected an http:// or https:// URL`))
+			})
+		})
+
+		Context("the staticfile trusts a certificate of the app", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`proxy:
+  /api/:
+    upstream: https://api.internal/
+    tls_trusted_certificate: certs/ca.pem
+  /injected/:
+    upstream: https://injected.internal/
+    tls_trusted_certificate: "ca.pem; include /etc/passwd"
+  /outside/:
+    upstream: https://outside.internal/
+    tls_trusted_certificate: ../ca.pem
+`), 0644)
+				Expect(err).To(BeNil())
+				Expect(os.MkdirAll(filepath.Join(buildDir, "certs"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "certs", "ca.pem"), []byte("CA"), 0644)).To(Succeed())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("stages the certificate next to nginx.conf without serving it", func() {
+				Expect(finalizer.CopyFilesToPublic(buildDir)).To(Succeed())
+				Expect(finalizer.ConfigureNginx()).To(Succeed())
+				Expect(filepath.Join(buildDir, "public", "certs", "ca.pem")).NotTo(BeAnExistingFile())
+				Expect(ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "trusted-certs_ca.pem"))).To(Equal([]byte("CA")))
+
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring(`proxy_ssl_trusted_certificate "<%= ENV["APP_ROOT"] %>/nginx/conf/trusted-certs_ca.pem";`))
+				Expect(string(data)).NotTo(ContainSubstring("/etc/passwd"))
+			})
+
+			It("falls back to the CA bundle of the stack for invalid paths", func() {
+				for _, l := range finalizer.Config.Locations {
+					if l.Match != "^~ /api/" {
+						Expect(l.Proxy.TLSTrustedCertificate).To(Equal("/etc/ssl/certs/ca-certificates.crt"))
+					}
+				}
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 7, column 30: proxy./injected/.tls_trusted_certificate: invalid certificate file "ca.pem; include /etc/passwd", expected an absolute path or a path inside the app directory`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 10, column 30: proxy./outside/.tls_trusted_certificate: invalid certificate file "../ca.pem", expected an absolute path or a path inside the app directory`))
+			})
+		})
+
+		Context("the staticfile proxies to bound services", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`proxy:
+  /api/:
+    upstream: {service: my-api}
+  /internal/:
+    upstream:
+      tag: internal
+      field: endpoints.https
+      client_cert_field: tls.cert
+      client_key_field: tls.key
+      ca_field: tls.ca
+  /broken/:
+    upstream: {service: a, tag: b}
+  /half/:
+    upstream: {service: a, client_cert_field: cert}
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("binds the proxies to the services", func() {
+				Expect(finalizer.Config.Locations).To(HaveLen(2))
+				Expect(finalizer.Config.Locations[1].Match).To(Equal("^~ /api/"))
+				Expect(finalizer.Config.Locations[1].Proxy.Service).To(Equal(&finalize.ServiceBinding{
+					ServiceRef: finalize.ServiceRef{Service: "my-api", Field: "url"},
+					Prefix:     "/api/",
+					Env:        "STATICFILE_UPSTREAM_0",
+					Dir:        "nginx/conf/services/upstream_0",
+				}))
+				Expect(finalizer.Config.Locations[1].Proxy.TLS).To(BeTrue())
+				Expect(finalizer.Config.Locations[1].Proxy.ClientCertificate).To(Equal(""))
+
+				proxy := finalizer.Config.Locations[0].Proxy
+				Expect(proxy.Service.Env).To(Equal("STATICFILE_UPSTREAM_1"))
+				Expect(proxy.Service.Field).To(Equal("endpoints.https"))
+				Expect(proxy.ClientCertificate).To(Equal(`<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_1/client.crt`))
+				Expect(proxy.ClientCertificateKey).To(Equal(`<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_1/client.key`))
+				Expect(proxy.TLSTrustedCertificate).To(Equal(`<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_1/ca.crt`))
+				Expect(proxy.TLSVerifyDepth).To(Equal(3))
+			})
+
+			It("logs the proxies", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling proxy from /api/ to the url of service my-api\n"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling proxy from /internal/ to the endpoints.https of the service tagged internal\n"))
+			})
+
+			It("reports invalid service references", func() {
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile line 12, column 15: proxy./broken/.upstream: expected either service or tag"))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Staticfile line 14, column 15: proxy./half/.upstream: client_cert_field and client_key_field must be set together"))
+			})
+		})
+
+		Context("the staticfile sets access", func() {
+			var staticfileYaml string
+
+			BeforeEach(func() {
+				staticfileYaml = `access:
+  trusted_proxies: [10.0.0.0/8]
+  allow: [192.168.0.0/16, 2001:db8::/32]
+  deny: [192.168.1.1, 300.0.0.1]
+  deny_user_agents: [BadBot, "(curl|wget)/"]
+  valid_referers: [none, blocked, "*.example.com"]
+locations:
+  /public/:
+    access:
+      allow: [all]
+  /docs/:
+    expires: 1h
+`
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+			})
+
+			JustBeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(staticfileYaml), 0644)).To(Succeed())
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("keeps the valid rules", func() {
+				Expect(finalizer.Config.Access).To(Equal(&finalize.Access{
+					TrustedProxies: finalize.AddressList{"10.0.0.0/8"},
+					Allow:          finalize.AddressList{"192.168.0.0/16", "2001:db8::/32"},
+					Deny:           finalize.AddressList{"192.168.1.1"},
+					DenyUserAgents: finalize.UserAgentList{"BadBot", "(curl|wget)/"},
+					ValidReferers:  finalize.RefererList{"none", "blocked", "*.example.com"},
+				}))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 4, column 23: access.deny: invalid address "300.0.0.1", expected an IP address, a CIDR range or all`))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling access control\n"))
+				Expect(buffer.String()).NotTo(ContainSubstring("Cloud Foundry router"))
+			})
+
+			It("merges location rules over the top-level ones", func() {
+				Expect(finalizer.Config.Locations[0].Match).To(Equal("/public/"))
+				Expect(finalizer.Config.Locations[0].Access).To(Equal(&finalize.LocationAccess{
+					Allow:         finalize.AddressList{"all"},
+					Deny:          finalize.AddressList{"192.168.1.1"},
+					ValidReferers: finalize.RefererList{"none", "blocked", "*.example.com"},
+				}))
+				Expect(finalizer.Config.Locations[1].Access).To(BeNil())
+			})
+
+			Context("without trusted proxies", func() {
+				BeforeEach(func() {
+					staticfileYaml = "access:\n  allow: [10.0.0.0/8]\n"
+				})
+
+				It("warns that the rules see the router", func() {
+					Expect(buffer.String()).To(ContainSubstring("**WARNING** access rules match the address of the Cloud Foundry router unless access.trusted_proxies lists it"))
+				})
+			})
+		})
+
+		Context("the staticfile sets logging", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`logging:
+  format: json
+  error_level: warn
+  exclude: [/healthz, /status/**]
+  sample_rate: 0.25
+  prefix: "[web] "
+proxy:
+  /api/:
+    upstream: https://api.example.com
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			JustBeforeEach(func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			It("resolves the access log", func() {
+				Expect(finalizer.Config.Logging).To(Equal(&finalize.AccessLog{
+					Format:     "json",
+					JSON:       `{"time":"$time_iso8601","client":"$http_x_forwarded_for","method":"$request_method","uri":"$request_uri","status":$status,"bytes":$body_bytes_sent,"request_time":$request_time,"referer":"$http_referer","user_agent":"$http_user_agent","host":"$best_host","request_id":"$staticfile_request_id","app":"<%= ENV["STATICFILE_APP_NAME"] %>","instance":"<%= ENV["CF_INSTANCE_INDEX"] %>","upstream_time":"$upstream_response_time"}`,
+					ErrorLevel: "warn",
+					Exclude:    []string{"/healthz", "~^/status/.*$"},
+					Sample:     "25%",
+					Prefix:     "[web] ",
+				}))
+			})
+
+			It("logs the settings", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling json access logs\n"))
+				Expect(buffer.String()).To(ContainSubstring("Leaving /healthz, /status/** out of the access log\n"))
+				Expect(buffer.String()).To(ContainSubstring("Logging 25% of requests\n"))
+				Expect(buffer.String()).To(ContainSubstring(`Prefixing log lines with "[web] "` + "\n"))
+			})
+		})
+
+		Context("the staticfile redacts query parameters", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`logging:
+  format: json
+  fields: [uri, referer, status]
+  redact: [code, access_token, "a b"]
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("logs the redacted URI and referer", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Logging.Redact).To(Equal([]string{"code", "access_token"}))
+				Expect(finalizer.Config.Logging.JSON).To(Equal(`{"uri":"$staticfile_log_uri","referer":"$staticfile_log_referer","status":$status}`))
+				Expect(buffer.String()).To(ContainSubstring("Redacting the query parameters code, access_token\n"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 4, column 32: logging.redact: invalid query parameter "a b"`))
+			})
+		})
+
+		Context("the staticfile enables the health check", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("healthcheck: enabled\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("answers at /healthz", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Healthcheck).To(Equal(&finalize.Healthcheck{Path: "/healthz"}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling health check at /healthz\n"))
+			})
+		})
+
+		Context("the staticfile configures the health check", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`healthcheck:
+  path: /status
+  readiness: true
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("answers at the path once nginx is ready", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Healthcheck).To(Equal(&finalize.Healthcheck{Path: "/status", Readiness: true}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling health check at /status\n"))
+				Expect(buffer.String()).To(ContainSubstring("/status answers 503 until nginx accepts connections\n"))
+			})
+
+			Context("to an invalid path", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("healthcheck:\n  path: status\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("warns and uses /healthz", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Healthcheck).To(Equal(&finalize.Healthcheck{Path: "/healthz"}))
+					Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 9: healthcheck.path: invalid health check path "status", expected a path starting with /`))
+				})
+			})
+		})
+
+		Context("the staticfile enables metrics", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`metrics:
+  port: 9200
+  path_prefixes: [/api/, assets]
+  buckets: [1, 0.1, 0.1, -2]
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("resolves the listener", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Metrics).To(Equal(&finalize.Metrics{Port: 9200, Prefixes: []string{"/api/"}, Buckets: []float64{0.1, 1}}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Serving Prometheus metrics on port 9200\n"))
+				Expect(buffer.String()).To(ContainSubstring("Counting requests under /api/\n"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 3, column 26: metrics.path_prefixes: invalid path prefix "assets", expected a path starting with /`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 4, column 26: metrics.buckets: invalid bucket "-2", expected a number of seconds above 0`))
+			})
+
+			Context("with a toggle", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("metrics: enabled\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("listens on port 9113", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Metrics).To(Equal(&finalize.Metrics{Port: 9113}))
+				})
+			})
+		})
+
+		Context("the staticfile sets launch", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`launch:
+  before_start: [./bin/configure, ""]
+  drain_timeout: 1m
+  restarts: 20
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("resolves the launcher", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Launcher).To(Equal(&finalize.Launcher{BeforeStart: []string{"./bin/configure"}, DrainTimeout: 60}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Draining requests for up to 60 seconds on shutdown\n"))
+				Expect(buffer.String()).To(ContainSubstring("Cloud Foundry stops apps 10 seconds after SIGTERM"))
+				Expect(buffer.String()).To(ContainSubstring("Running ./bin/configure before nginx starts\n"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 35: launch.before_start: invalid command "", expected a command on a single line`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 4, column 13: launch.restarts: invalid restarts "20", expected a number from 0 to 10`))
+			})
+
+			Context("with an invalid drain timeout", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("launch:\n  drain_timeout: 0s\n  restarts: 3\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("drains for 8 seconds", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Launcher).To(Equal(&finalize.Launcher{DrainTimeout: 8, Restarts: 3}))
+					Expect(buffer.String()).To(ContainSubstring("Restarting nginx up to 3 times after a crash\n"))
+					Expect(buffer.String()).To(ContainSubstring(`launch.drain_timeout: invalid drain timeout "0s", expected a duration such as 8s`))
+				})
+			})
+		})
+
+		Context("the staticfile configures precompress", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`precompress:
+  min_size: 2k
+  types: [text/css, css]
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("resolves the threshold and types", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Precompress).To(Equal(&finalize.Precompress{MinSize: 2048, Types: []string{"text/css"}}))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 3, column 21: precompress.types: invalid MIME type "css", expected a type such as text/html`))
+			})
+
+			Context("with a toggle", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("precompress: false\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("disables precompression", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Precompress).To(BeNil())
+				})
+			})
+
+			Context("without precompress", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("compression:\n  min_length: 2k\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("leaves precompression off", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Precompress).To(BeNil())
+					Expect(finalizer.Precompress()).To(Succeed())
+					Expect(buffer.String()).NotTo(ContainSubstring("Precompressing"))
+				})
+			})
+		})
+
+		Context("the staticfile configures mime_types", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`mime_types:
+  .GLB: model/gltf-binary
+  /.well-known/apple-app-site-association: application/json
+  /feeds/: application/rss+xml
+  bad.ext: text/plain
+  usdz: zip
+locations:
+  /feeds/:
+    expires: 1h
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("merges the extensions", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.MimeTypes).To(Equal(map[string]string{"glb": "model/gltf-binary"}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Adding MIME types\n"))
+				Expect(buffer.String()).To(ContainSubstring("Serving .glb as model/gltf-binary\n"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 5, column 3: mime_types: invalid key "bad.ext", expected a file extension such as wasm or a path starting with /`))
+			})
+
+			It("serves the paths with their type", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Locations).To(HaveLen(2))
+				Expect(finalizer.Config.Locations[0]).To(Equal(finalize.Location{Match: "= /.well-known/apple-app-site-association", ContentType: "application/json"}))
+				Expect(finalizer.Config.Locations[1].Match).To(Equal("/feeds/"))
+				Expect(finalizer.Config.Locations[1].Expires).To(Equal("1h"))
+				Expect(finalizer.Config.Locations[1].ContentType).To(Equal("application/rss+xml"))
+				Expect(buffer.String()).To(ContainSubstring("Serving /.well-known/apple-app-site-association as application/json\n"))
+			})
+		})
+
+		Context("the staticfile configures compression", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`compression:
+  level: 12
+  min_length: 4k
+  types: [text/css, application/wasm]
+  proxied: expired  no-cache
+  exclude: [/downloads/, downloads]
+locations:
+  /downloads/:
+    expires: 1h
+  ~* \.js$:
+    expires: 1d
+precompress: true
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("resolves the settings", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Compression).To(Equal(&finalize.Compression{Dynamic: true, Level: 6, MinLength: 4096,
+					Types: []string{"text/css", "application/wasm"}, Proxied: "expired no-cache", Exclude: []string{"/downloads/"}}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Compressing responses at level 6 from 4096 bytes\n"))
+				Expect(buffer.String()).To(ContainSubstring("Serving /downloads/ uncompressed\n"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 10: compression.level: invalid compression level "12", expected a number from 1 to 9`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 6, column 26: compression.exclude: invalid path "downloads", expected a path starting with /`))
+			})
+
+			It("turns compression off in the location of the excluded path", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Locations).To(HaveLen(2))
+				Expect(finalizer.Config.Locations[0].Match).To(Equal("/downloads/"))
+				Expect(finalizer.Config.Locations[0].Uncompressed).To(BeTrue())
+				Expect(finalizer.Config.Locations[1].Uncompressed).To(BeFalse())
+			})
+
+			It("precompresses the same types from the same size", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Precompress).To(Equal(&finalize.Precompress{MinSize: 4096, Types: []string{"text/html", "text/css", "application/wasm"}}))
+			})
+
+			Context("with a toggle", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("compression: false\nprecompress: true\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("disables dynamic compression", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Compression.Dynamic).To(BeFalse())
+					Expect(finalizer.Config.Compression.Level).To(Equal(6))
+					Expect(finalizer.Config.Precompress).NotTo(BeNil())
+					Expect(buffer.String()).To(ContainSubstring("-----> Disabling dynamic compression\n"))
+				})
+			})
+
+			Context("with an excluded path that has no location", func() {
+				BeforeEach(func() {
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("compression:\n  dynamic: off\n  exclude: [/stream/]\n"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("adds a prefix location that wins over regexes", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).To(BeNil())
+					Expect(finalizer.Config.Compression.Dynamic).To(BeFalse())
+					Expect(finalizer.Config.Locations).To(Equal([]finalize.Location{{Match: "^~ /stream/", Uncompressed: true}}))
+				})
+			})
+		})
+
+		Context("the staticfile enables brotli", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("brotli: true\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("compresses the compressible types but text/html", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Brotli).NotTo(BeNil())
+				Expect(finalizer.Config.Brotli.Types).To(ContainElement("text/css"))
+				Expect(finalizer.Config.Brotli.Types).NotTo(ContainElement("text/html"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling brotli compression\n"))
+			})
+		})
+
+		Context("the staticfile selects log fields", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte(`access:
+  trusted_proxies: [10.0.0.0/8]
+logging:
+  format: json
+  fields: [client, status, colour]
+  sample_rate: 0
+`), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("logs the real client address and reports unknown fields", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.Logging.JSON).To(Equal(`{"client":"$remote_addr","status":$status}`))
+				Expect(finalizer.Config.Logging.Sample).To(Equal(""))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 5, column 28: logging.fields: unknown log field "colour"`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 6, column 16: logging.sample_rate: invalid sample rate "0", expected a fraction above 0 and up to 1 such as 0.1`))
+			})
+		})
+
+		Context("the staticfile sets status_codes keys", func() {
+			var key string
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+			})
+			JustBeforeEach(func() {
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("status_codes:\n  \""+key+"\": /error.html\n"), 0644)
+				Expect(err).To(BeNil())
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+			})
+
+			clientErrors := "400 401 402 403 404 405 406 407 408 409 410 411 412 413 414 415 416 417 418 421 422 423 424 426 428 429 431 451"
+			serverErrors := "500 501 502 503 504 505 506 507 508 510 511"
+			for _, entry := range []struct{ key, codes string }{
+				{"404", "404"},
+				{"301", "301"},
+				{"404 410", "404 410"},
+				{"404,410", "404 410"},
+				{"4xx", clientErrors},
+				{"5XX", serverErrors},
+				{"4xx 5xx", clientErrors + " " + serverErrors},
+				{"404 5xx", "404 " + serverErrors},
+				{"403 4xx", "403 " + strings.Replace(clientErrors, "403 ", "", 1)},
+				{"200", ""},
+				{"600", ""},
+				{"4o4", ""},
+				{"6xx", ""},
+				{"404x", ""},
+			} {
+				entry := entry
+				Context(fmt.Sprintf("of %q", entry.key), func() {
+					BeforeEach(func() {
+						key = entry.key
+					})
+
+					if entry.codes != "" {
+						It("validates the key and renders its codes", func() {
+							Expect(buffer.String()).NotTo(ContainSubstring("WARNING"))
+							Expect(finalizer.Config.StatusCodes).To(Equal(map[string]string{entry.codes: "/error.html"}))
+						})
+					} else {
+						It("rejects the key and renders nothing for it", func() {
+							Expect(buffer.String()).To(ContainSubstring(fmt.Sprintf(`status_codes: invalid status code %q`, entry.key)))
+							Expect(finalizer.Config.StatusCodes).To(BeEmpty())
+						})
+					}
+				})
+			}
+		})
+
+		Context("the staticfile does not match the schema", func() {
+			var strict finalize.Toggle
+
+			BeforeEach(func() {
+				strict = ""
+				mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Do(func(_ string, hash *finalize.StaticfileTemp) {
+					(*hash).Strict = strict
+				})
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("root: public\npushstat: enabled\nssi: yes\nstatus_codes:\n  4o4: /404.html\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("warns about each problem with its line and column", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 1: unknown key "pushstat" (did you mean "pushstate"?)`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 3, column 6: ssi: invalid value "yes", expected one of enabled, disabled, true, false, on, off, visible, hidden`))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 5, column 3: status_codes: invalid status code "4o4"`))
+			})
+
+			It("does not enable directives with invalid values", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.SSI).To(Equal(false))
+			})
+
+			Context("and strict mode is enabled", func() {
+				BeforeEach(func() {
+					strict = "true"
+				})
+
+				It("returns an error listing each problem", func() {
+					err = finalizer.LoadStaticfile()
+					Expect(err).NotTo(BeNil())
+					Expect(err.Error()).To(ContainSubstring(`line 2, column 1: unknown key "pushstat"`))
+					Expect(err.Error()).To(ContainSubstring(`line 3, column 6: ssi: invalid value "yes"`))
+					Expect(buffer.String()).NotTo(ContainSubstring("**WARNING**"))
+				})
+			})
+		})
+
+		Context("the staticfile sets a toggle to yes or no", func() {
+			BeforeEach(func() {
+				finalizerYaml := libbuildpack.NewYAML()
+				mockYaml.EXPECT().Load(gomock.Any(), gomock.Any()).DoAndReturn(finalizerYaml.Load)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile"), []byte("ssi: on\npushstate: yes\nlocations:\n  /docs/:\n    ssi: no\n"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("leaves it unset like the schema", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).To(BeNil())
+				Expect(finalizer.Config.PushState).To(BeFalse())
+				Expect(finalizer.Config.Locations[0].SSI).To(Equal(finalize.Toggle("")))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Staticfile line 2, column 12: pushstate: invalid value "yes", expected one of enabled, disabled, true, false, on, off, visible, hidden`))
+			})
+		})
+
+		Context("the staticfile exists and is not valid", func() {
+			BeforeEach(func() {
+				mockYaml.EXPECT().Load(filepath.Join(buildDir, "Staticfile"), gomock.Any()).Return(errors.New("a yaml parsing error"))
+			})
+
+			It("returns an error", func() {
+				err = finalizer.LoadStaticfile()
+				Expect(err).NotTo(BeNil())
+			})
+		})
+	})
+
+	Describe("GetAppRootDir", func() {
+		var (
+			returnDir string
+		)
+
+		JustBeforeEach(func() {
+			returnDir, err = finalizer.GetAppRootDir()
+		})
+
+		Context("the staticfile has a root directory specified", func() {
+			Context("the directory does not exist", func() {
+				BeforeEach(func() {
+					staticfile.RootDir = "not_exist"
+				})
+
+				It("logs the staticfile's root directory", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
+					Expect(buffer.String()).To(ContainSubstring("not_exist"))
+
+				})
+
+				It("returns an error", func() {
+					Expect(returnDir).To(Equal(""))
+					Expect(err).NotTo(BeNil())
+					Expect(err.Error()).To(ContainSubstring("the application Staticfile specifies a root directory"))
+					Expect(err.Error()).To(ContainSubstring("that does not exist"))
+				})
+			})
+
+			Context("the directory exists but is actually a file", func() {
+				BeforeEach(func() {
+					ioutil.WriteFile(filepath.Join(buildDir, "actually_a_file"), []byte("xxx"), 0644)
+					staticfile.RootDir = "actually_a_file"
+				})
+
+				It("logs the staticfile's root directory", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
+					Expect(buffer.String()).To(ContainSubstring("actually_a_file"))
+				})
+
+				It("returns an error", func() {
+					Expect(returnDir).To(Equal(""))
+					Expect(err).NotTo(BeNil())
+					Expect(err.Error()).To(ContainSubstring("the application Staticfile specifies a root directory"))
+					Expect(err.Error()).To(ContainSubstring("that is a plain file"))
+				})
+			})
+
+			Context("the directory exists", func() {
+				BeforeEach(func() {
+					os.Mkdir(filepath.Join(buildDir, "a_directory"), 0755)
+					staticfile.RootDir = "a_directory"
+				})
+
+				It("logs the staticfile's root directory", func() {
+					Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
+					Expect(buffer.String()).To(ContainSubstring("a_directory"))
+				})
+
+				It("returns the full directory path", func() {
+					Expect(err).To(BeNil())
+					Expect(returnDir).To(Equal(filepath.Join(buildDir, "a_directory")))
+				})
+			})
+		})
+
+		Context("the staticfile does not have an root directory", func() {
+			BeforeEach(func() {
+				staticfile.RootDir = ""
+			})
+
+			It("logs the build directory as the root directory", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Root folder"))
+				Expect(buffer.String()).To(ContainSubstring(buildDir))
+			})
+			It("returns the build directory", func() {
+				Expect(err).To(BeNil())
+				Expect(returnDir).To(Equal(buildDir))
+			})
+		})
+	})
+
+	Describe("Warnings", func() {
+		JustBeforeEach(func() {
+			finalizer.Warnings()
+		})
+
+		Context("app dir has a nginx/conf directory", func() {
+			const WarningLine1 = "**WARNING** You have an nginx/conf directory, but have not set *root*, or have set it to '.'."
+			const WarningLine2 = "If you are using the nginx/conf directory for nginx configuration, you probably need to also set the *root* directive."
+			BeforeEach(func() {
+				os.MkdirAll(filepath.Join(buildDir, "nginx", "conf"), 0755)
+			})
+
+			Context("root is NOT set", func() {
+				BeforeEach(func() {
+					staticfile.RootDir = ""
+				})
+				It("warns the user", func() {
+					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
+					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+				})
+			})
+
+			Context("root is set to .", func() {
+				BeforeEach(func() {
+					staticfile.RootDir = "."
+				})
+				It("warns the user", func() {
+					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
+					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+				})
+			})
+
+			Context("root is set to something equivent to .", func() {
+				BeforeEach(func() {
+					staticfile.RootDir = "./fred/.."
+				})
+				It("warns the user", func() {
+					Expect(buffer.String()).To(ContainSubstring(WarningLine1))
+					Expect(buffer.String()).To(ContainSubstring(WarningLine2))
+				})
+			})
+
+			Context("root IS set something other than .", func() {
+				BeforeEach(func() {
+					staticfile.RootDir = "somedir"
+				})
+				It("does not warn the user", func() {
+					Expect(buffer.String()).ToNot(ContainSubstring(WarningLine1))
+					Expect(buffer.String()).ToNot(ContainSubstring(WarningLine2))
+				})
+			})
+		})
+	})
+
+	Describe("ConfigureNginx", func() {
+		JustBeforeEach(func() {
+			err = finalizer.ConfigureNginx()
+			Expect(err).To(BeNil())
+		})
+
+		Context("custom nginx.conf exists", func() {
+			BeforeEach(func() {
+				err = os.MkdirAll(filepath.Join(buildDir, "public"), 0755)
+				Expect(err).To(BeNil())
+
+				err = ioutil.WriteFile(filepath.Join(buildDir, "public", "nginx.conf"), []byte("nginx configuration"), 0644)
+				Expect(err).To(BeNil())
+			})
+
+			It("uses the custom configuration", func() {
+				Expect(filepath.Join(buildDir, "nginx", "conf", "nginx.conf")).To(BeARegularFile())
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte("nginx configuration")))
+			})
+
+			It("removes the copy in the public directory", func() {
+				Expect(filepath.Join(buildDir, "public", "nginx.conf")).ToNot(BeARegularFile())
+			})
+
+			It("warns the user", func() {
+				Expect(buffer.String()).To(ContainSubstring("overriding nginx.conf is deprecated and highly discouraged, as it breaks the functionality of the Staticfile and Staticfile.auth configuration directives. Please use the NGINX buildpack available at: https://github.com/cloudfoundry/nginx-buildpack"))
+			})
+		})
+
+		Context("custom nginx.conf does NOT exist", func() {
+			leadCloseWsp := regexp.MustCompile(`(?m)^\s+`)
+			stripStartWsp := func(inp string) string { return leadCloseWsp.ReplaceAllString(inp, "") }
+			readNginxConfAndStrip := func() string {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				return stripStartWsp(string(data))
+			}
+			renderNginxConfAndStrip := func(env map[string]string) string {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf, err := launcher.RenderERB("nginx.conf", string(data), func(key string) (string, bool) {
+					value, ok := env[key]
+					return value, ok
+				})
+				Expect(err).To(BeNil())
+				return stripStartWsp(conf)
+			}
+
+			hostDotConf := stripStartWsp(`
+				location ~ /\. {
+					deny all;
+					return 404;
+				}
+		  `)
+			pushStateConf := stripStartWsp(`
+        if (!-e $request_filename) {
+          rewrite ^(.*)$ / break;
+        }
+			`)
+			enableHttp2Conf := stripStartWsp(`
+				listen <%= ENV["PORT"] %> http2;
+			`)
+			enableHttp2Erb := stripStartWsp(`
+				<% if ENV["ENABLE_HTTP2"] || %w(enabled true on visible).include?(ENV.fetch("BP_STATICFILE_ENABLE_HTTP2", "false").downcase) %>
+				  listen <%= ENV["PORT"] %> http2;
+				<% else %>
+				  listen <%= ENV["PORT"] %>;
+				<% end %>
+			`)
+			forceHTTPSConf := stripStartWsp(`
+				if ($best_proto != "https") {
+					return 301 https://$best_host$best_prefix$request_uri;
+				}
+			`)
+			forceHTTPSErb := stripStartWsp(`
+				<% if ENV["FORCE_HTTPS"] || %w(enabled true on visible).include?(ENV.fetch("BP_STATICFILE_FORCE_HTTPS", "false").downcase) %>
+					if ($best_proto != "https") {
+						return 301 https://$best_host$best_prefix$request_uri;
+					}
+				<% end %>
+			`)
+			xForwardedHostMappingConf := stripStartWsp(`
+				map $http_x_forwarded_host $best_host {
+					"~^([^,]+),?.*$" $1;
+					''               $host;
+				}
+			`)
+			xForwardedPrefixMappingConf := stripStartWsp(`
+				map $http_x_forwarded_prefix $best_prefix {
+					"~^([^,]+),?.*$" $1;
+					''               '';
+				}
+			`)
+			xForwardedProtoMappingConf := stripStartWsp(`
+				map $http_x_forwarded_proto $best_proto {
+					"~^([^,]+),?.*$" $1;
+					''               '';
+				}
+			`)
+			basicAuthConf := stripStartWsp(`
+        auth_basic "Restricted";  #For Basic Auth
+        auth_basic_user_file <%= ENV["APP_ROOT"] %>/nginx/conf/.htpasswd;
+			`)
+
+			Context("host_dot_files is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HostDotFiles = true
+				})
+				It("allows dotfiles to be hosted", func() {
+					Expect(renderNginxConfAndStrip(nil)).NotTo(ContainSubstring(hostDotConf))
+				})
+				It("denies dotfiles when BP_STATICFILE_HOST_DOT_FILES is disabled at start", func() {
+					Expect(renderNginxConfAndStrip(map[string]string{"BP_STATICFILE_HOST_DOT_FILES": "false"})).To(ContainSubstring(hostDotConf))
+				})
+			})
+
+			Context("host_dot_files is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HostDotFiles = false
+				})
+				It("denies dotfiles", func() {
+					Expect(renderNginxConfAndStrip(nil)).To(ContainSubstring(hostDotConf))
+				})
+			})
+
+			Context("location_include is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.LocationInclude = "a/b/c"
+				})
+				It("includes the file", func() {
+					Expect(renderNginxConfAndStrip(nil)).To(ContainSubstring("include a/b/c;"))
+				})
+				It("includes the file of BP_STATICFILE_LOCATION_INCLUDE at start instead", func() {
+					data := renderNginxConfAndStrip(map[string]string{"BP_STATICFILE_LOCATION_INCLUDE": "d/e/f"})
+					Expect(data).To(ContainSubstring("include d/e/f;"))
+					Expect(data).NotTo(ContainSubstring("include a/b/c;"))
+				})
+			})
+
+			Context("location_include is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.LocationInclude = ""
+				})
+				It("does not include the file", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).NotTo(ContainSubstring("include ;"))
+				})
+			})
+
+			Context("directory is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.DirectoryIndex = true
+				})
+				It("sets autoindex on", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring("autoindex on;"))
+				})
+			})
+
+			Context("directory is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.DirectoryIndex = false
+				})
+				It("only sets autoindex on when BP_STATICFILE_DIRECTORY is enabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring("<% if %w(enabled true on visible).include?(ENV.fetch(\"BP_STATICFILE_DIRECTORY\", \"false\").downcase) %>\nautoindex on;"))
+				})
+			})
+
+			Context("ssi is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.SSI = true
+				})
+				It("enables SSI", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring("ssi on;"))
+				})
+			})
+
+			Context("ssi is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.SSI = false
+				})
+				It("only enables SSI when BP_STATICFILE_SSI is enabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring("<% if %w(enabled true on visible).include?(ENV.fetch(\"BP_STATICFILE_SSI\", \"false\").downcase) %>\nssi on;"))
+				})
+			})
+
+			Context("pushstate is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.PushState = true
+				})
+				It("it adds the configuration", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(pushStateConf))
+				})
+			})
+
+			Context("pushstate is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.PushState = false
+				})
+				It("only adds the configuration when BP_STATICFILE_PUSHSTATE is enabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(`<% if %w(enabled true on visible).include?(ENV.fetch("BP_STATICFILE_PUSHSTATE", "false").downcase) %>` + "\n" + pushStateConf))
+				})
+			})
+
+			Context("http_strict_transport_security is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HSTS = true
+				})
+				It("it adds the HSTS header", func() {
+					Expect(renderNginxConfAndStrip(nil)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000";`))
+				})
+			})
+
+			Context("http_strict_transport_security and http_strict_transport_security_include_subdomain is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HSTS = true
+					staticfile.HSTSIncludeSubDomains = true
+				})
+				It("it adds the HSTS header", func() {
+					Expect(renderNginxConfAndStrip(nil)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains";`))
+				})
+				It("adds preload when BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY_PRELOAD is enabled at start", func() {
+					data := renderNginxConfAndStrip(map[string]string{"BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY_PRELOAD": "on"})
+					Expect(data).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains; preload";`))
+				})
+			})
+
+			Context("http_strict_transport_security, http_strict_transport_security_include_subdomain, and http_strict_transport_security_preload is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HSTS = true
+					staticfile.HSTSIncludeSubDomains = true
+					staticfile.HSTSPreload = true
+				})
+				It("it adds the HSTS header", func() {
+					Expect(renderNginxConfAndStrip(nil)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains; preload";`))
+				})
+			})
+
+			Context("http_strict_transport_security is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HSTS = false
+					staticfile.HSTSIncludeSubDomains = false
+					staticfile.HSTSPreload = false
+				})
+				It("only adds the HSTS header when BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY is enabled at start", func() {
+					Expect(renderNginxConfAndStrip(nil)).NotTo(ContainSubstring("Strict-Transport-Security"))
+					data := renderNginxConfAndStrip(map[string]string{"BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY": "true"})
+					Expect(data).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000";`))
+				})
+			})
+
+			Context("http_strict_transport_security is NOT set in staticfile, but http_strict_transport_security_preload or http_strict_transport_security_include_subdomain are set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.HSTS = false
+					staticfile.HSTSIncludeSubDomains = true
+					staticfile.HSTSPreload = true
+				})
+				It("only adds the HSTS header when BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY is enabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).NotTo(ContainSubstring(`"max-age=31536000";`))
+					Expect(string(data)).To(ContainSubstring(`ENV.fetch("BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY", "false")`))
+				})
+			})
+
+			Context("enable_http2 is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.EnableHttp2 = true
+				})
+				It("the listener uses the http2 directive unless BP_STATICFILE_ENABLE_HTTP2 is disabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(enableHttp2Conf))
+					Expect(string(data)).To(ContainSubstring(`ENV.fetch("BP_STATICFILE_ENABLE_HTTP2", "true")`))
+				})
+			})
+
+			Context("enable_http2 is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.EnableHttp2 = false
+				})
+				It("using the http2 directive depends on ENV['ENABLE_HTTP2']", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(enableHttp2Erb))
+				})
+			})
+
+			Context("force_https is set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.ForceHTTPS = true
+				})
+				It("the 301 redirect is on unless BP_STATICFILE_FORCE_HTTPS is disabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(forceHTTPSConf))
+					Expect(string(data)).To(ContainSubstring(xForwardedHostMappingConf))
+					Expect(string(data)).To(ContainSubstring(xForwardedPrefixMappingConf))
+					Expect(string(data)).To(ContainSubstring(xForwardedProtoMappingConf))
+					Expect(string(data)).To(ContainSubstring(`ENV.fetch("BP_STATICFILE_FORCE_HTTPS", "true")`))
+				})
+			})
+
+			Context("force_https is NOT set in staticfile", func() {
+				BeforeEach(func() {
+					staticfile.ForceHTTPS = false
+				})
+				It("the 301 redirect does depend on ENV['FORCE_HTTPS']", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(forceHTTPSErb))
+					Expect(string(data)).To(ContainSubstring(xForwardedHostMappingConf))
+					Expect(string(data)).To(ContainSubstring(xForwardedPrefixMappingConf))
+					Expect(string(data)).To(ContainSubstring(xForwardedProtoMappingConf))
+				})
+			})
+
+			Context("there is a Staticfile.auth", func() {
+				BeforeEach(func() {
+					staticfile.BasicAuth = true
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("authentication info"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("it enables basic authentication", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(basicAuthConf))
+				})
+
+				It("copies the Staticfile.auth to .htpasswd", func() {
+					data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", ".htpasswd"))
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(Equal("authentication info"))
+				})
+			})
+
+			Context("there is a Staticfile.auth, but basic_auth is disabled", func() {
+				BeforeEach(func() {
+					staticfile.BasicAuth = false
+					staticfile.BasicAuthFile = true
+					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("authentication info"), 0644)
+					Expect(err).To(BeNil())
+				})
+
+				It("only enables basic authentication when BP_STATICFILE_BASIC_AUTH is enabled at start", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).To(ContainSubstring(`ENV.fetch("BP_STATICFILE_BASIC_AUTH", "false")`))
+					Expect(string(data)).To(ContainSubstring(basicAuthConf))
+				})
+
+				It("copies the Staticfile.auth to .htpasswd", func() {
+					Expect(filepath.Join(buildDir, "nginx", "conf", ".htpasswd")).To(BeARegularFile())
+				})
+			})
+
+			Context("there is not a Staticfile.auth", func() {
+				BeforeEach(func() {
+					staticfile.BasicAuth = false
+					staticfile.BasicAuthFile = false
+				})
+				It("it does not enable basic authenticaiont", func() {
+					data := readNginxConfAndStrip()
+					Expect(string(data)).NotTo(ContainSubstring(basicAuthConf))
+				})
+
+				It("does not create an .htpasswd", func() {
+					Expect(filepath.Join(buildDir, "nginx", "conf", ".htpasswd")).NotTo(BeAnExistingFile())
+				})
+			})
+		})
+
+		Context("locations are set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.SSI = false
+				staticfile.DirectoryIndex = false
+				staticfile.LocationInclude = ""
+				staticfile.StatusCodes = map[string]string{"404": "/404.html"}
+				staticfile.Locations = []finalize.Location{
+					{Match: "/downloads/", DirectoryIndex: "enabled", Headers: map[string]string{"X-Robots-Tag": `noindex, "nofollow"`}, Expires: "1h"},
+					{Match: "~* \\.pdf$", SSI: "off"},
+					{Match: "~ ^/[0-9a-f]{8}/", Expires: "1d"},
+				}
+			})
+
+			AfterEach(func() {
+				staticfile.StatusCodes = nil
+				staticfile.Locations = nil
+			})
+
+			It("renders a location block for each", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+
+				Expect(conf).To(ContainSubstring("location /downloads/ {\n"))
+				Expect(conf).To(ContainSubstring("<% if true %>\nautoindex on;"))
+				Expect(conf).To(ContainSubstring(`add_header X-Robots-Tag "noindex, \"nofollow\"" always;`))
+				Expect(conf).To(ContainSubstring("expires 1h;"))
+				Expect(conf).To(ContainSubstring(`location ~* "\\.pdf$" {` + "\n"))
+				Expect(conf).To(ContainSubstring(`location ~ "^/[0-9a-f]{8}/" {` + "\n"))
+				Expect(conf).To(ContainSubstring("<% if false %>\nssi on;"))
+			})
+
+			It("falls back to the top-level directives", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(regexp.MustCompile(`error_page 404 /404.html;`).FindAllString(string(data), -1)).To(HaveLen(4))
+				Expect(regexp.MustCompile(`ENV.fetch\("BP_STATICFILE_SSI", "false"\)`).FindAllString(string(data), -1)).To(HaveLen(3))
+			})
+
+			It("puts regex locations after the dotfiles rule", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := string(data)
+				Expect(strings.Index(conf, "location /downloads/")).To(BeNumerically("<", strings.Index(conf, `location ~ /\.`)))
+				Expect(strings.Index(conf, `location ~ /\.`)).To(BeNumerically("<", strings.Index(conf, `location ~* "\\.pdf$"`)))
+			})
+		})
+
+		Context("headers are set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.Headers = []finalize.ResponseHeader{
+					{Name: "Content-Disposition", Globs: []finalize.HeaderGlob{{Pattern: "/downloads/*.pdf", Regex: `^/downloads/[^/]*\.pdf$`, Value: "attachment"}}, Variable: "$staticfile_header_content_disposition"},
+					{Name: "X-Frame-Options", Value: "DENY"},
+				}
+				staticfile.Locations = []finalize.Location{
+					{Match: "/embed/", Headers: map[string]string{"X-Frame-Options": "SAMEORIGIN"}},
+					{Match: "/docs/"},
+				}
+			})
+
+			AfterEach(func() {
+				staticfile.Headers = nil
+				staticfile.Locations = nil
+			})
+
+			It("maps path glob headers on $uri", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("map $uri $staticfile_header_content_disposition {\n\"~^/downloads/[^/]*\\\\.pdf$\" \"attachment\";\ndefault \"\";\n}"))
+			})
+
+			It("repeats the headers in every location block", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := string(data)
+				Expect(strings.Count(conf, "add_header Content-Disposition $staticfile_header_content_disposition always;")).To(Equal(3))
+				Expect(strings.Count(conf, `add_header X-Frame-Options "DENY" always;`)).To(Equal(2))
+				Expect(strings.Count(conf, `add_header X-Frame-Options "SAMEORIGIN" always;`)).To(Equal(1))
+			})
+		})
+
+		Context("caching is set in staticfile", func() {
+			BeforeEach(func() {
+				for _, file := range []string{"index.html", "static/js/main.3f2a1b9c.js", "assets/index-BxYz12Ab.css", "static/css/site.css", "jquery-3.6.0.min.js"} {
+					Expect(os.MkdirAll(filepath.Dir(filepath.Join(buildDir, "public", file)), 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(buildDir, "public", file), []byte(""), 0644)).To(Succeed())
+				}
+				staticfile.Headers = []finalize.ResponseHeader{{Name: "Cache-Control", Value: "private"}, {Name: "X-Frame-Options", Value: "DENY"}}
+				staticfile.Caching = &finalize.Caching{
+					Preset:               "spa",
+					Default:              "1h",
+					Paths:                finalize.CachePaths{{Glob: "/static/**", Value: "7d"}},
+					Extensions:           map[string]finalize.CacheValue{"css": "30d", "js": "30d", "xml": "off"},
+					StaleWhileRevalidate: "1m",
+					SurrogateControl:     "1d",
+				}
+			})
+
+			AfterEach(func() {
+				staticfile.Headers = nil
+				staticfile.Caching = nil
+			})
+
+			It("maps Cache-Control on $uri, fingerprinted assets first", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("map_hash_max_size 2048;\nmap_hash_bucket_size 256;\n"))
+				Expect(conf).To(ContainSubstring(`map $uri $staticfile_cache_control {
+"/assets/index-BxYz12Ab.css" "public, max-age=31536000, immutable";
+"/static/js/main.3f2a1b9c.js" "public, max-age=31536000, immutable";
+"~/index\\.html$" "no-cache";
+"~^/static/.*$" "public, max-age=604800, stale-while-revalidate=60";
+"~\\.(?:xml)$" "";
+"~\\.(?:css|js)$" "public, max-age=2592000, stale-while-revalidate=60";
+default "public, max-age=3600, stale-while-revalidate=60";
+}`))
+			})
+
+			It("replaces Cache-Control from headers in every location block", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := string(data)
+				Expect(conf).NotTo(ContainSubstring(`"private"`))
+				Expect(conf).To(ContainSubstring("add_header Cache-Control $staticfile_cache_control always;"))
+				Expect(conf).To(ContainSubstring(`add_header Surrogate-Control "max-age=86400" always;`))
+				Expect(conf).To(ContainSubstring(`add_header X-Frame-Options "DENY" always;`))
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Cache-Control from headers is replaced by the caching section"))
+			})
+
+			It("logs the fingerprinted assets", func() {
+				Expect(buffer.String()).To(ContainSubstring("-----> Caching 2 fingerprinted assets with public, max-age=31536000, immutable\n"))
+			})
+		})
+
+		Context("redirects are set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.Redirects = []finalize.Redirect{
+					{From: "/old", To: "/new", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/old", To: "/newer", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/tmp", To: "/temp?from=tmp", Status: 307, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "/blog/", To: "https://blog.example.com/", Status: 308, Match: "prefix", Force: true},
+					{From: "^/(.*)$", To: "/index.html", Status: 200, Match: "regex", PreserveQuery: true},
+				}
+			})
+
+			AfterEach(func() {
+				staticfile.Redirects = nil
+			})
+
+			It("compiles exact rules into a map per status", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("map $uri $staticfile_redirect_301 {\n\"/old\" \"/new$is_args$args\";\ndefault \"\";\n}"))
+				Expect(conf).To(ContainSubstring("map $uri $staticfile_redirect_307 {\n\"/tmp\" \"/temp?from=tmp\";\ndefault \"\";\n}"))
+				Expect(conf).To(ContainSubstring("if ($staticfile_redirect_301) {\nreturn 301 $staticfile_redirect_301;\n}"))
+				Expect(conf).To(ContainSubstring("absolute_redirect off;"))
+			})
+
+			It("tests prefix and regex rules in order", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("if ($uri ~ \"^/blog/(.*)$\") {\nreturn 308 \"https://blog.example.com/$1\";\n}"))
+				Expect(conf).To(ContainSubstring("set $staticfile_shadow \"\";\nif (-e $request_filename) {\nset $staticfile_shadow \"shadowed\";\n}"))
+				Expect(conf).To(ContainSubstring("if ($staticfile_shadow$uri ~ \"^/(.*)$\") {\nrewrite \"^/(.*)$\" \"/index.html\" last;\n}"))
+			})
+		})
+
+		Context("the app has _headers and _redirects files", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(buildDir, "public"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "public", "_headers"), []byte(`/*
+  X-Frame-Options: DENY
+/assets/:hash/*
+  Cache-Control: public
+  Cache-Control: max-age=31536000
+/admin/*
+  Basic-Auth: user:pass
+`), 0644)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "public", "_redirects"), []byte(`/home  /  301!
+/shop/* https://shop.example.com/:splat 302
+/ch/* /ch/index.html 200 Country=ch
+`), 0644)).To(Succeed())
+				staticfile.Headers = []finalize.ResponseHeader{{Name: "X-Frame-Options", Value: "SAMEORIGIN"}}
+			})
+
+			AfterEach(func() {
+				staticfile.Headers = nil
+				staticfile.Redirects = nil
+			})
+
+			It("translates the headers, keeping the Staticfile values", func() {
+				Expect(finalizer.Config.Headers).To(Equal([]finalize.ResponseHeader{
+					{Name: "X-Frame-Options", Value: "SAMEORIGIN"},
+					{
+						Name:     "Cache-Control",
+						Globs:    []finalize.HeaderGlob{{Pattern: "/assets/*/**", Regex: `^/assets/[^/]*/.*$`, Value: "public, max-age=31536000"}},
+						Variable: "$staticfile_header_cache_control",
+					},
+				}))
+				Expect(buffer.String()).To(ContainSubstring("-----> Enabling response header Cache-Control for /assets/*/**\n"))
+			})
+
+			It("translates the redirects", func() {
+				Expect(finalizer.Config.Redirects).To(Equal([]finalize.Redirect{
+					{From: "/home", To: "/", Status: 301, Match: "exact", PreserveQuery: true, Force: true},
+					{From: "^/shop/(.*)$", To: "https://shop.example.com/$1", Status: 302, Match: "regex", PreserveQuery: true, Force: false},
+				}))
+				Expect(buffer.String()).To(ContainSubstring("/home -> / (301)"))
+			})
+
+			It("reports the features it skipped", func() {
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Skipping _headers line 7, column 3: Basic-Auth is not supported, use Staticfile.auth for basic authentication"))
+				Expect(buffer.String()).To(ContainSubstring(`**WARNING** Skipping _redirects line 3, column 1: unsupported option "Country=ch"`))
+			})
+
+			It("does not serve the files", func() {
+				Expect(filepath.Join(buildDir, "public", "_headers")).NotTo(BeAnExistingFile())
+				Expect(filepath.Join(buildDir, "public", "_redirects")).NotTo(BeAnExistingFile())
+			})
+		})
+
+		Context("proxy is set in staticfile", func() {
+			BeforeEach(func() {
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("user:$apr1$x$y"), 0644)).To(Succeed())
+				staticfile.BasicAuth = true
+				staticfile.Headers = []finalize.ResponseHeader{{Name: "X-Frame-Options", Value: "DENY"}}
+				staticfile.Locations = []finalize.Location{{
+					Match: "^~ /api/",
+					Proxy: &finalize.Proxy{
+						Upstream:              "https://api.example.com/v1/",
+						ReadTimeout:           "2m",
+						Host:                  "$proxy_host",
+						SetHeaders:            map[string]string{"X-Api-Key": "secret"},
+						RemoveHeaders:         []string{"Cookie"},
+						WebSocket:             true,
+						Buffering:             true,
+						TLS:                   true,
+						TLSVerify:             true,
+						TLSVerifyDepth:        2,
+						TLSTrustedCertificate: "/etc/ssl/certs/ca-certificates.crt",
+					},
+				}}
+			})
+
+			AfterEach(func() {
+				staticfile.BasicAuth = false
+				staticfile.Headers = nil
+				staticfile.Locations = nil
+			})
+
+			It("renders the proxy location", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("map $http_upgrade $connection_upgrade {\ndefault upgrade;\n''      close;\n}"))
+				Expect(conf).To(ContainSubstring("location ^~ /api/ {\nproxy_pass \"https://api.example.com/v1/\";\nproxy_http_version 1.1;\nproxy_set_header Host $proxy_host;\n"))
+				Expect(conf).To(ContainSubstring("proxy_set_header Upgrade $http_upgrade;\nproxy_set_header Connection $connection_upgrade;\n"))
+				Expect(conf).To(ContainSubstring("proxy_set_header X-Api-Key \"secret\";\n"))
+				Expect(conf).To(ContainSubstring("proxy_set_header Cookie \"\";\n"))
+				Expect(conf).To(ContainSubstring("proxy_read_timeout 2m;\nproxy_send_timeout 2m;\n"))
+				Expect(conf).To(ContainSubstring("proxy_ssl_server_name on;\n"))
+				Expect(conf).To(ContainSubstring("proxy_ssl_verify on;\nproxy_ssl_verify_depth 2;\nproxy_ssl_trusted_certificate \"/etc/ssl/certs/ca-certificates.crt\";\n"))
+				Expect(conf).NotTo(ContainSubstring("proxy_buffering off;"))
+			})
+
+			It("keeps auth, HSTS and headers but not pushstate in the proxy location", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := string(data)
+				proxy := conf[strings.Index(conf, "location ^~ /api/"):]
+				proxy = proxy[:strings.Index(proxy, "\n    }")]
+				Expect(proxy).To(ContainSubstring(`auth_basic "Restricted";`))
+				Expect(proxy).To(ContainSubstring(`<% if %w(enabled true on visible).include?(ENV.fetch("BP_STATICFILE_HTTP_STRICT_TRANSPORT_SECURITY", "false").downcase) %>`))
+				Expect(proxy).To(ContainSubstring(`add_header X-Frame-Options "DENY" always;`))
+				Expect(proxy).NotTo(ContainSubstring("rewrite ^(.*)$ / break;"))
+				Expect(proxy).NotTo(ContainSubstring("index index.html"))
+			})
+		})
+
+		Context("access is set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.Access = &finalize.Access{
+					TrustedProxies: finalize.AddressList{"10.0.0.0/8", "172.16.0.0/12"},
+					Allow:          finalize.AddressList{"192.168.0.0/16"},
+					Deny:           finalize.AddressList{"192.168.1.1"},
+					DenyUserAgents: finalize.UserAgentList{"BadBot"},
+				}
+				staticfile.Locations = []finalize.Location{{
+					Match:  "~* \\.(png|jpg)$",
+					Access: &finalize.LocationAccess{Allow: finalize.AddressList{"all"}, ValidReferers: finalize.RefererList{"none", "server_names"}},
+				}}
+			})
+
+			AfterEach(func() {
+				staticfile.Access = nil
+				staticfile.Locations = nil
+			})
+
+			It("uses the client address from X-Forwarded-For and logs it", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("log_format cloudfoundry '$remote_addr - $http_referer"))
+				Expect(conf).To(ContainSubstring("set_real_ip_from 10.0.0.0/8;\nset_real_ip_from 172.16.0.0/12;\nreal_ip_header X-Forwarded-For;\nreal_ip_recursive on;\n"))
+			})
+
+			It("denies user agents for the whole server", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("map $http_user_agent $staticfile_denied_agent {\n\"~*BadBot\" 1;\ndefault 0;\n}"))
+				Expect(conf).To(ContainSubstring("if ($staticfile_denied_agent) {\nreturn 403;\n}"))
+			})
+
+			It("renders the address and referer rules per location", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				root := conf[strings.Index(conf, "location / {"):]
+				Expect(root[:strings.Index(root, "location ~ /\\.")]).To(ContainSubstring("deny 192.168.1.1;\nallow 192.168.0.0/16;\ndeny all;\n"))
+				images := conf[strings.Index(conf, `location ~* "\\.(png|jpg)$" {`):]
+				Expect(images).To(ContainSubstring("allow all;\ndeny all;\nvalid_referers none server_names;\nif ($invalid_referer) {\nreturn 403;\n}"))
+				Expect(images).NotTo(ContainSubstring("deny 192.168.1.1;"))
+			})
+		})
+
+		Context("logging is set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.Logging = &finalize.AccessLog{
+					Format:     "json",
+					JSON:       `{"status":$status,"app":"<%= ENV["STATICFILE_APP_NAME"] %>"}`,
+					ErrorLevel: "warn",
+					Exclude:    []string{"/healthz"},
+				}
+			})
 
-		Context("custom nginx.conf exists", func() {
+			AfterEach(func() {
+				staticfile.Logging = nil
+			})
+
+			It("writes json access logs and sets the error log level", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring(`error_log <%= ENV["APP_ROOT"] %>/nginx/logs/error.log warn;`))
+				Expect(conf).To(ContainSubstring(`log_format json escape=json '{"status":$status,"app":"<%= ENV["STATICFILE_APP_NAME"] %>"}';`))
+				Expect(conf).To(ContainSubstring("map $http_x_vcap_request_id $staticfile_request_id {\n\"\"      $request_id;\ndefault $http_x_vcap_request_id;\n}"))
+				Expect(conf).To(ContainSubstring("map $uri $staticfile_log {\n\"/healthz\" 0;\ndefault 1;\n}"))
+				Expect(conf).To(ContainSubstring(`access_log <%= ENV["APP_ROOT"] %>/nginx/logs/access.log json if=$staticfile_log;`))
+			})
+
+			Context("with sampling", func() {
+				BeforeEach(func() {
+					staticfile.Logging.Sample = "10%"
+				})
+
+				It("combines the excluded paths with the sample", func() {
+					data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+					Expect(err).To(BeNil())
+					conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+					Expect(conf).To(ContainSubstring("map $uri $staticfile_log_path {\n\"/healthz\" 0;\ndefault 1;\n}"))
+					Expect(conf).To(ContainSubstring("split_clients $request_id $staticfile_log_sample {\n10% 1;\n*       0;\n}"))
+					Expect(conf).To(ContainSubstring("map \"$staticfile_log_path$staticfile_log_sample\" $staticfile_log {\n\"11\"    1;\ndefault 0;\n}"))
+				})
+			})
+		})
+
+		Context("logging redacts query parameters", func() {
+			var conf string
+
+			BeforeEach(func() {
+				staticfile.Logging = &finalize.AccessLog{Format: "cloudfoundry", Redact: []string{"code", "access_token"}}
+			})
+
+			AfterEach(func() {
+				staticfile.Logging = nil
+			})
+
+			JustBeforeEach(func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+			})
+
+			It("logs the redacted request line and referer", func() {
+				Expect(conf).To(ContainSubstring(`- $staticfile_log_referer - [$time_local] "$staticfile_log_request" $status $body_bytes_sent';`))
+			})
+
+			It("chains the maps of each parameter", func() {
+				Expect(conf).To(ContainSubstring("map $request $staticfile_redact_request_0 {\n\"~*^(.*?[?&]code=)[^&#\\\\s]*(.*)$\" \"$1REDACTED$2\";\ndefault $request;\n}"))
+				Expect(conf).To(ContainSubstring("map $staticfile_redact_request_0 $staticfile_redact_request_1 {\n\"~*^((?:.*?[?&]code=[^&#\\\\s]*){1}.*?[?&]code=)[^&#\\\\s]*(.*)$\" \"$1REDACTED$2\";\n"))
+				Expect(conf).To(ContainSubstring("map $staticfile_redact_request_2 $staticfile_redact_request_3 {\n\"~*^((?:.*?[?&]code=[^&#\\\\s]*){3}.*?[?&]code=)[^#\\\\s]*(.*)$\" \"$1REDACTED$2\";\n"))
+				Expect(conf).To(ContainSubstring("map $staticfile_redact_request_6 $staticfile_log_request {\n\"~*^((?:.*?[?&]access_token="))
+				Expect(conf).To(ContainSubstring("map $request_uri $staticfile_redact_uri_8 {"))
+				Expect(conf).To(ContainSubstring("map $staticfile_redact_uri_14 $staticfile_log_uri {"))
+				Expect(conf).To(ContainSubstring("map $http_referer $staticfile_redact_referer_16 {"))
+				Expect(conf).To(ContainSubstring("map $staticfile_redact_referer_22 $staticfile_log_referer {"))
+			})
+
+			redact := func(source, value string) string {
+				maps := regexp.MustCompile(`map \S+ \$staticfile_(?:redact|log)_`+source+`\S* \{\n"~\*(.*)" "\$1REDACTED\$2";`).FindAllStringSubmatch(conf, -1)
+				Expect(maps).To(HaveLen(8))
+				for _, m := range maps {
+					pattern := strings.Replace(m[1], `\\`, `\`, -1)
+					value = regexp.MustCompile("(?i)"+pattern).ReplaceAllString(value, "${1}REDACTED${2}")
+				}
+				return value
+			}
+
+			It("masks the parameter values", func() {
+				Expect(redact("request", "GET /callback?state=xyz&Code=s3cr3t&access_token=t0k3n#top HTTP/1.1")).To(Equal("GET /callback?state=xyz&Code=REDACTED&access_token=REDACTED#top HTTP/1.1"))
+				Expect(redact("request", "GET /callback?xcode=1&code=2 HTTP/1.1")).To(Equal("GET /callback?xcode=1&code=REDACTED HTTP/1.1"))
+			})
+
+			It("masks every occurrence of a repeated parameter", func() {
+				Expect(redact("request", "GET /cb?code=a&state=1&code=b&code=c HTTP/1.1")).To(Equal("GET /cb?code=REDACTED&state=1&code=REDACTED&code=REDACTED HTTP/1.1"))
+				Expect(redact("uri", "/cb?code=a&code=b&code=c&code=d&state=1&code=e#top")).To(Equal("/cb?code=REDACTED&code=REDACTED&code=REDACTED&code=REDACTED#top"))
+			})
+
+			It("masks the parameter values in the referer", func() {
+				Expect(redact("referer", "https://app.example.com/callback?code=s3cr3t&state=xyz&code=again")).To(Equal("https://app.example.com/callback?code=REDACTED&state=xyz&code=REDACTED"))
+			})
+		})
+
+		Context("healthcheck is set in staticfile", func() {
+			var conf string
+
+			BeforeEach(func() {
+				staticfile.Healthcheck = &finalize.Healthcheck{Path: "/healthz", Readiness: true}
+				staticfile.ForceHTTPS = true
+				staticfile.BasicAuth = true
+			})
+
+			AfterEach(func() {
+				staticfile.Healthcheck = nil
+				staticfile.ForceHTTPS = false
+				staticfile.BasicAuth = false
+			})
+
+			JustBeforeEach(func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+			})
+
+			It("rewrites the path ahead of the HTTPS redirect", func() {
+				rewrite := strings.Index(conf, "if ($uri = \"/healthz\") {\nrewrite ^ /.staticfile/healthz last;\n}")
+				Expect(rewrite).To(BeNumerically(">", 0))
+				Expect(rewrite).To(BeNumerically("<", strings.Index(conf, `return 301 https://`)))
+			})
+
+			It("answers without auth, files or access logs", func() {
+				Expect(conf).To(ContainSubstring("location = /.staticfile/healthz {\ninternal;\naccess_log off;\ndefault_type text/plain;\n" +
+					"if (!-f <%= ENV[\"APP_ROOT\"] %>/nginx/run/ready) {\nreturn 503 \"starting\\n\";\n}\nreturn 200 \"ok\\n\";\n}"))
+			})
+		})
+
+		Context("metrics is set in staticfile", func() {
+			var conf string
+
+			BeforeEach(func() {
+				staticfile.Metrics = &finalize.Metrics{Port: 9113, Prefixes: []string{"/api/"}}
+			})
+
+			AfterEach(func() {
+				staticfile.Metrics = nil
+			})
+
+			JustBeforeEach(func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+			})
+
+			It("writes the metrics log next to the access log", func() {
+				Expect(conf).To(ContainSubstring("access_log <%= ENV[\"APP_ROOT\"] %>/nginx/logs/access.log cloudfoundry;\nlog_format staticfile_metrics '$status $request_time $uri';\naccess_log <%= ENV[\"APP_ROOT\"] %>/nginx/logs/metrics.log staticfile_metrics;\n"))
+			})
+
+			It("serves stub_status on a unix socket", func() {
+				Expect(conf).To(ContainSubstring("server {\nlisten unix:<%= ENV[\"APP_ROOT\"] %>/nginx/run/status.sock;\naccess_log off;\nlocation = /stub_status {\nstub_status;\n}\n}"))
+				Expect(filepath.Join(buildDir, "nginx", "run")).To(BeADirectory())
+			})
+
+			It("writes metrics.json", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "metrics.json"))
+				Expect(err).To(BeNil())
+				Expect(data).To(MatchJSON(`{"port": 9113, "log": "nginx/logs/metrics.log", "status": "nginx/run/status.sock", "prefixes": ["/api/"], "buckets": null}`))
+			})
+		})
+
+		Context("access and logging are not set in staticfile", func() {
+			It("logs X-Forwarded-For in the cloudfoundry format", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring("log_format cloudfoundry '$http_x_forwarded_for - $http_referer"))
+				Expect(string(data)).NotTo(ContainSubstring("real_ip_header"))
+				Expect(string(data)).To(ContainSubstring(`access_log <%= ENV["APP_ROOT"] %>/nginx/logs/access.log cloudfoundry;`))
+				Expect(string(data)).To(ContainSubstring(`error_log <%= ENV["APP_ROOT"] %>/nginx/logs/error.log;`))
+			})
+		})
+
+		Context("proxy is bound to a service", func() {
+			BeforeEach(func() {
+				staticfile.Locations = []finalize.Location{{
+					Match: "^~ /api/",
+					Proxy: &finalize.Proxy{
+						Host:                  "$proxy_host",
+						Buffering:             true,
+						RequestBuffering:      true,
+						TLS:                   true,
+						TLSVerify:             true,
+						TLSTrustedCertificate: `<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_0/ca.crt`,
+						ClientCertificate:     `<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_0/client.crt`,
+						ClientCertificateKey:  `<%= ENV["APP_ROOT"] %>/nginx/conf/services/upstream_0/client.key`,
+						Service: &finalize.ServiceBinding{
+							ServiceRef: finalize.ServiceRef{Tag: "api", Field: "url", ClientCertField: "cert", ClientKeyField: "key", CAField: "ca"},
+							Prefix:     "/api/",
+							Env:        "STATICFILE_UPSTREAM_0",
+							Dir:        "nginx/conf/services/upstream_0",
+						},
+					},
+				}}
+			})
+
+			AfterEach(func() {
+				staticfile.Locations = nil
+			})
+
+			It("proxies to the upstream resolved at start", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("location ^~ /api/ {\nproxy_pass \"<%= ENV[\"STATICFILE_UPSTREAM_0\"] %>\";\n"))
+				Expect(conf).To(ContainSubstring("proxy_ssl_trusted_certificate \"<%= ENV[\"APP_ROOT\"] %>/nginx/conf/services/upstream_0/ca.crt\";\n"))
+				Expect(conf).To(ContainSubstring("proxy_ssl_certificate <%= ENV[\"APP_ROOT\"] %>/nginx/conf/services/upstream_0/client.crt;\nproxy_ssl_certificate_key <%= ENV[\"APP_ROOT\"] %>/nginx/conf/services/upstream_0/client.key;\n"))
+			})
+
+			It("writes the service bindings for the launcher", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "services.json"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(MatchJSON(`[{"tag": "api", "field": "url", "client_cert_field": "cert", "client_key_field": "key", "ca_field": "ca",
+					"prefix": "/api/", "env": "STATICFILE_UPSTREAM_0", "dir": "nginx/conf/services/upstream_0"}]`))
+				Expect(filepath.Join(buildDir, "nginx", "conf", "services.rb")).NotTo(BeAnExistingFile())
+
+				Expect(finalizer.WriteStartupFiles()).To(Succeed())
+				config, err := launcher.ReadConfig(filepath.Join(buildDir, "nginx", "conf", "launch.json"))
+				Expect(err).To(BeNil())
+				Expect(config.Services).To(Equal("nginx/conf/services.json"))
+			})
+		})
+
+		Context("custom mime.types exists", func() {
 			BeforeEach(func() {
 				err = os.MkdirAll(filepath.Join(buildDir, "public"), 0755)
 				Expect(err).To(BeNil())
 
-				err = ioutil.WriteFile(filepath.Join(buildDir, "public", "nginx.conf"), []byte("nginx configuration"), 0644)
+				err = ioutil.WriteFile(filepath.Join(buildDir, "public", "mime.types"), []byte("mime types info"), 0644)
 				Expect(err).To(BeNil())
 			})
 
 			It("uses the custom configuration", func() {
-				Expect(filepath.Join(buildDir, "nginx", "conf", "nginx.conf")).To(BeARegularFile())
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
+				Expect(err).To(BeNil())
+				Expect(data).To(Equal([]byte("mime types info")))
+			})
+		})
+
+		Context("custom mime.types does NOT exist", func() {
+			It("uses the provided mime.types", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(Equal(finalize.MimeTypes))
+			})
+		})
+
+		Context("mime_types are set in staticfile", func() {
+			BeforeEach(func() {
+				staticfile.MimeTypes = map[string]string{"json": "application/vnd.api+json", "glb": "model/gltf-binary"}
+				staticfile.Locations = []finalize.Location{{Match: "= /.well-known/apple-app-site-association", ContentType: "application/json"}}
+			})
+
+			AfterEach(func() {
+				staticfile.MimeTypes = nil
+				staticfile.Locations = nil
+			})
+
+			It("merges the extensions into the provided mime.types", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring("  application/json map;\n"))
+				Expect(string(data)).To(HaveSuffix("  model/gltf-binary glb;\n  application/vnd.api+json json;\n}\n"))
+				Expect(strings.Count(string(data), " json;")).To(Equal(1))
+			})
+
+			It("serves the paths with their type", func() {
 				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
 				Expect(err).To(BeNil())
-				Expect(data).To(Equal([]byte("nginx configuration")))
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(MatchRegexp(`(?s)location = /\.well-known/apple-app-site-association \{\n.*types \{ \}\ndefault_type application/json;\n`))
 			})
 
-			It("removes the copy in the public directory", func() {
-				Expect(filepath.Join(buildDir, "public", "nginx.conf")).ToNot(BeARegularFile())
+			Context("custom mime.types exists", func() {
+				BeforeEach(func() {
+					Expect(os.MkdirAll(filepath.Join(buildDir, "public"), 0755)).To(Succeed())
+					Expect(ioutil.WriteFile(filepath.Join(buildDir, "public", "mime.types"), []byte("# custom\ntypes {\n  application/json json;\n  text/html html;\n}\n"), 0644)).To(Succeed())
+				})
+
+				It("merges the extensions into the custom mime.types", func() {
+					data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(Equal("\ntypes {\n  text/html html;\n  model/gltf-binary glb;\n  application/vnd.api+json json;\n}\n"))
+					Expect(buffer.String()).To(ContainSubstring("Merging mime_types into the mime.types of the app"))
+				})
 			})
+		})
 
-			It("warns the user", func() {
-				Expect(buffer.String()).To(ContainSubstring("overriding nginx.conf is deprecated and highly discouraged, as it breaks the functionality of the Staticfile and Staticfile.auth configuration directives. Please use the NGINX buildpack available at: https://github.com/cloudfoundry/nginx-buildpack"))
+		Context("compression is not set in staticfile", func() {
+			It("compresses the default types", func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf := regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+				Expect(conf).To(ContainSubstring("gzip on;\ngzip_disable \"msie6\";\ngzip_comp_level 6;\ngzip_min_length 1100;\ngzip_buffers 16 8k;\ngzip_proxied any;\n"))
+				Expect(conf).To(ContainSubstring("gzip_types text/plain text/css text/js text/xml text/javascript application/javascript application/x-javascript application/json application/xml application/xml+rss " +
+					"application/xhtml+xml application/atom+xml application/rss+xml application/manifest+json application/wasm image/svg+xml font/ttf font/otf application/vnd.ms-fontobject;\n"))
+				Expect(conf).NotTo(ContainSubstring("gzip off;"))
 			})
 		})
 
-		Context("custom nginx.conf does NOT exist", func() {
-			leadCloseWsp := regexp.MustCompile(`(?m)^\s+`)
-			stripStartWsp := func(inp string) string { return leadCloseWsp.ReplaceAllString(inp, "") }
-			readNginxConfAndStrip := func() string {
+		Context("compression is set in staticfile", func() {
+			var conf string
+
+			BeforeEach(func() {
+				staticfile.Compression = &finalize.Compression{Level: 4, MinLength: 256, Types: []string{"text/css"}, Proxied: "off", Exclude: []string{"/downloads/"}}
+				staticfile.Locations = []finalize.Location{{Match: "^~ /downloads/", Uncompressed: true}}
+			})
+
+			AfterEach(func() {
+				staticfile.Compression = nil
+				staticfile.Locations = nil
+			})
+
+			JustBeforeEach(func() {
 				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
 				Expect(err).To(BeNil())
-				return stripStartWsp(string(data))
-			}
+				rendered, err := launcher.RenderERB("nginx.conf", string(data), func(string) (string, bool) { return "", false })
+				Expect(err).To(BeNil())
+				conf = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(rendered, "")
+			})
 
-			hostDotConf := stripStartWsp(`
-				location ~ /\. {
-					deny all;
-					return 404;
-				}
-		  `)
-			pushStateConf := stripStartWsp(`
-        if (!-e $request_filename) {
-          rewrite ^(.*)$ / break;
-        }
-			`)
-			enableHttp2Conf := stripStartWsp(`
-				listen <%= ENV["PORT"] %> http2;
-			`)
-			enableHttp2Erb := stripStartWsp(`
-				<% if ENV["ENABLE_HTTP2"] %>
-				  listen <%= ENV["PORT"] %> http2;
-				<% else %>
-				  listen <%= ENV["PORT"] %>;
-				<% end %>
-			`)
-			forceHTTPSConf := stripStartWsp(`
-				if ($best_proto != "https") {
-					return 301 https://$best_host$best_prefix$request_uri;
-				}
-			`)
-			forceHTTPSErb := stripStartWsp(`
-				<% if ENV["FORCE_HTTPS"] %>
-					if ($best_proto != "https") {
-						return 301 https://$best_host$best_prefix$request_uri;
-					}
-				<% end %>
-			`)
-			xForwardedHostMappingConf := stripStartWsp(`
-				map $http_x_forwarded_host $best_host {
-					"~^([^,]+),?.*$" $1;
-					''               $host;
-				}
-			`)
-			xForwardedPrefixMappingConf := stripStartWsp(`
-				map $http_x_forwarded_prefix $best_prefix {
-					"~^([^,]+),?.*$" $1;
-					''               '';
-				}
-			`)
-			xForwardedProtoMappingConf := stripStartWsp(`
-				map $http_x_forwarded_proto $best_proto {
-					"~^([^,]+),?.*$" $1;
-					''               '';
+			It("writes the settings", func() {
+				Expect(conf).To(ContainSubstring("gzip off;\ngzip_disable \"msie6\";\ngzip_comp_level 4;\ngzip_min_length 256;\ngzip_buffers 16 8k;\ngzip_proxied off;\n"))
+				Expect(conf).To(ContainSubstring("gzip_types text/css;\n"))
+			})
+
+			It("serves the excluded paths uncompressed", func() {
+				Expect(conf).To(MatchRegexp(`(?s)location \^~ /downloads/ \{\n.*gzip off;\ngzip_static off;\n}`))
+			})
+		})
+
+		Context("brotli is set in staticfile", func() {
+			var (
+				conf  string
+				probe string
+			)
+
+			BeforeEach(func() {
+				staticfile.Brotli = &finalize.Brotli{Types: []string{"text/css", "image/svg+xml"}}
+				modulesDir := filepath.Join(depDir, "nginx", "modules")
+				Expect(os.MkdirAll(modulesDir, 0755)).To(Succeed())
+				for _, module := range []string{"ngx_http_brotli_filter_module.so", "ngx_http_brotli_static_module.so"} {
+					Expect(ioutil.WriteFile(filepath.Join(modulesDir, module), []byte("module"), 0644)).To(Succeed())
 				}
-			`)
-			basicAuthConf := stripStartWsp(`
-        auth_basic "Restricted";  #For Basic Auth
-        auth_basic_user_file <%= ENV["APP_ROOT"] %>/nginx/conf/.htpasswd;
-			`)
 
-			Context("host_dot_files is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HostDotFiles = true
-				})
-				It("allows dotfiles to be hosted", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring(hostDotConf))
+				nginx := filepath.Join(depDir, "nginx", "sbin", "nginx")
+				mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), nginx, "-t", "-q", "-p", gomock.Any(), "-c", gomock.Any()).
+					DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+						contents, err := ioutil.ReadFile(args[5])
+						Expect(err).To(BeNil())
+						probe = string(contents)
+						return nil
+					})
+			})
+
+			AfterEach(func() {
+				staticfile.Brotli = nil
+			})
+
+			JustBeforeEach(func() {
+				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				conf = regexp.MustCompile(`(?m)^\s+`).ReplaceAllString(string(data), "")
+			})
+
+			It("checks that nginx loads the modules", func() {
+				Expect(probe).To(Equal("load_module " + filepath.Join(depDir, "nginx", "modules", "ngx_http_brotli_filter_module.so") + ";\n" +
+					"load_module " + filepath.Join(depDir, "nginx", "modules", "ngx_http_brotli_static_module.so") + ";\n" +
+					"events {}\nhttp {\n  brotli on;\n  brotli_static on;\n}\n"))
+			})
+
+			It("loads the modules from the deps dir", func() {
+				idx := filepath.Base(depDir)
+				Expect(conf).To(ContainSubstring("daemon off;\nload_module <%= ENV[\"DEPS_DIR\"] %>/" + idx + "/nginx/modules/ngx_http_brotli_filter_module.so;\n" +
+					"load_module <%= ENV[\"DEPS_DIR\"] %>/" + idx + "/nginx/modules/ngx_http_brotli_static_module.so;\n"))
+			})
+
+			It("enables brotli for the types", func() {
+				Expect(conf).To(ContainSubstring("gzip_vary on;\nbrotli on;\nbrotli_static on;\nbrotli_min_length 1100;\nbrotli_types text/css image/svg+xml;\n"))
+			})
+		})
+	})
+
+	Describe("ConfigureNginx with brotli", func() {
+		BeforeEach(func() {
+			staticfile.Brotli = &finalize.Brotli{Types: []string{"text/css"}}
+		})
+
+		AfterEach(func() {
+			staticfile.Brotli = nil
+		})
+
+		Context("nginx has no brotli module", func() {
+			BeforeEach(func() {
+				mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+						stderr.Write([]byte("nginx: [emerg] unknown directive \"brotli\" in nginx.conf:2\n"))
+						return errors.New("exit status 1")
+					})
+			})
+
+			It("turns brotli off with a warning", func() {
+				Expect(finalizer.ConfigureNginx()).To(Succeed())
+				Expect(finalizer.Config.Brotli).To(BeNil())
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** brotli is not available, as the nginx dependency has no brotli module and the buildpack manifest has no nginx-brotli dependency for it; serving gzip only"))
+
+				data, err := ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).NotTo(ContainSubstring("brotli"))
+			})
+		})
+
+		Context("nginx is unable to load the module", func() {
+			BeforeEach(func() {
+				Expect(os.MkdirAll(filepath.Join(depDir, "nginx", "modules"), 0755)).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(depDir, "nginx", "modules", "ngx_http_brotli_filter_module.so"), []byte("module"), 0644)).To(Succeed())
+				mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+						stderr.Write([]byte("nginx: [emerg] module is not binary compatible\n"))
+						return errors.New("exit status 1")
+					})
+			})
+
+			It("fails with a clear message", func() {
+				err = finalizer.ConfigureNginx()
+				Expect(err).NotTo(BeNil())
+				Expect(err.Error()).To(HavePrefix("brotli is enabled, but nginx is unable to load the brotli modules"))
+				Expect(err.Error()).To(HaveSuffix(": nginx: [emerg] module is not binary compatible"))
+			})
+		})
+	})
+
+	Describe("CheckNginxConf", func() {
+		var (
+			nginx    string
+			rendered string
+		)
+
+		BeforeEach(func() {
+			nginx = filepath.Join(depDir, "nginx", "sbin", "nginx")
+			Expect(os.MkdirAll(filepath.Dir(nginx), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(nginx, []byte("nginx binary"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(buildDir, "public"), 0755)).To(Succeed())
+			rendered = ""
+		})
+
+		JustBeforeEach(func() {
+			Expect(finalizer.ConfigureNginx()).To(Succeed())
+		})
+
+		failWith := func(output func(confDir string) string) {
+			mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), nginx, "-t", "-q", "-p", gomock.Any(), "-c", gomock.Any()).
+				DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+					stderr.Write([]byte(output(filepath.Dir(args[5]))))
+					return errors.New("exit status 1")
 				})
-			})
+		}
 
-			Context("host_dot_files is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HostDotFiles = false
-				})
-				It("allows dotfiles to be hosted", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(hostDotConf))
-				})
+		Context("nginx accepts the configuration", func() {
+			BeforeEach(func() {
+				mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), nginx, "-t", "-q", "-p", gomock.Any(), "-c", gomock.Any()).
+					DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+						Expect(args[3]).To(Equal(filepath.Join(dir, "nginx")))
+						Expect(filepath.Join(dir, "public")).To(BeADirectory())
+						contents, err := ioutil.ReadFile(args[5])
+						Expect(err).To(BeNil())
+						rendered = string(contents)
+						Expect(ioutil.ReadFile(filepath.Join(filepath.Dir(args[5]), "mime.types"))).To(Equal([]byte(finalize.MimeTypes)))
+						Expect(ioutil.WriteFile(filepath.Join(dir, "nginx", "logs", "error.log"), nil, 0644)).To(Succeed())
+						return nil
+					})
 			})
 
-			Context("location_include is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.LocationInclude = "a/b/c"
-				})
-				It("includes the file", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring("include a/b/c;"))
-				})
+			It("tests the configuration rendered with placeholders", func() {
+				Expect(finalizer.CheckNginxConf()).To(Succeed())
+				Expect(rendered).NotTo(ContainSubstring("<%"))
+				Expect(rendered).To(ContainSubstring("listen 8080"))
+				Expect(buffer.String()).To(ContainSubstring("-----> Checking nginx.conf\n"))
 			})
 
-			Context("location_include is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.LocationInclude = ""
-				})
-				It("does not include the file", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring("include ;"))
-				})
+			It("leaves the staged logs alone", func() {
+				Expect(finalizer.CheckNginxConf()).To(Succeed())
+				Expect(filepath.Join(buildDir, "nginx", "logs", "error.log")).NotTo(BeAnExistingFile())
 			})
+		})
 
-			Context("directory is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.DirectoryIndex = true
-				})
-				It("sets autoindex on", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring("autoindex on;"))
+		Context("a location_include is broken", func() {
+			BeforeEach(func() {
+				staticfile.LocationInclude = "includes/*.conf"
+				Expect(os.MkdirAll(filepath.Join(buildDir, "nginx", "conf", "includes"), 0755)).To(Succeed())
+				failWith(func(confDir string) string {
+					return "nginx: [emerg] unknown directive \"expire\" in " + filepath.Join(confDir, "includes", "cache.conf") + ":3\n" +
+						"nginx: configuration file " + filepath.Join(confDir, "nginx.conf") + " test failed\n"
 				})
 			})
 
-			Context("directory is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.DirectoryIndex = false
-				})
-				It("does not set autoindex on", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring("autoindex on;"))
-				})
+			AfterEach(func() {
+				staticfile.LocationInclude = ""
 			})
 
-			Context("ssi is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.SSI = true
-				})
-				It("enables SSI", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring("ssi on;"))
-				})
+			It("points at the file of the app", func() {
+				err = finalizer.CheckNginxConf()
+				Expect(err).To(MatchError(`nginx rejects the configuration: [emerg] unknown directive "expire" in nginx/conf/includes/cache.conf line 3`))
 			})
+		})
 
-			Context("ssi is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.SSI = false
-				})
-				It("does not enable SSI", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring("ssi on;"))
+		Context("the app overrides nginx.conf", func() {
+			BeforeEach(func() {
+				conf := "events {}\n<% if ENV[\"UNSET\"] %>\nhttp {}\n<% end %>\nhttp {\n  listen <%= ENV[\"PORT\"] %>;\n}\n"
+				Expect(ioutil.WriteFile(filepath.Join(buildDir, "public", "nginx.conf"), []byte(conf), 0644)).To(Succeed())
+				failWith(func(confDir string) string {
+					return "nginx: [emerg] \"listen\" directive is not allowed here in " + filepath.Join(confDir, "nginx.conf") + ":4\n"
 				})
 			})
 
-			Context("pushstate is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.PushState = true
-				})
-				It("it adds the configuration", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(pushStateConf))
-				})
+			It("points at the line of the app's nginx.conf", func() {
+				err = finalizer.CheckNginxConf()
+				Expect(err).To(MatchError(`nginx rejects the configuration: [emerg] "listen" directive is not allowed here in nginx.conf line 6`))
 			})
+		})
 
-			Context("pushstate is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.PushState = false
-				})
-				It("it does not add the configuration", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring(pushStateConf))
+		Context("the generated nginx.conf is rejected", func() {
+			BeforeEach(func() {
+				failWith(func(confDir string) string {
+					return "nginx: [emerg] invalid parameter in " + filepath.Join(confDir, "nginx.conf") + ":1\n"
 				})
 			})
 
-			Context("http_strict_transport_security is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HSTS = true
-				})
-				It("it adds the HSTS header", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000";`))
-				})
+			It("names it", func() {
+				err = finalizer.CheckNginxConf()
+				Expect(err).To(MatchError(HavePrefix(`nginx rejects the configuration: [emerg] invalid parameter in the generated nginx.conf line `)))
 			})
+		})
 
-			Context("http_strict_transport_security and http_strict_transport_security_include_subdomain is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HSTS = true
-					staticfile.HSTSIncludeSubDomains = true
-				})
-				It("it adds the HSTS header", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains";`))
-				})
+		Context("a proxy upstream only resolves from the app", func() {
+			BeforeEach(func() {
+				staticfile.Locations = []finalize.Location{{Match: "/api/", Proxy: &finalize.Proxy{Upstream: "https://backend.invalid:8443/v1/", Host: "backend.invalid"}}}
+				mockCmd.EXPECT().Execute(gomock.Any(), gomock.Any(), gomock.Any(), nginx, "-t", "-q", "-p", gomock.Any(), "-c", gomock.Any()).
+					DoAndReturn(func(dir string, stdout, stderr io.Writer, program string, args ...string) error {
+						contents, err := ioutil.ReadFile(args[5])
+						Expect(err).To(BeNil())
+						rendered = string(contents)
+						if strings.Contains(rendered, "proxy_pass \"https://backend.invalid") {
+							stderr.Write([]byte("nginx: [emerg] host not found in upstream \"backend.invalid:8443\" in " + args[5] + ":1\n"))
+							return errors.New("exit status 1")
+						}
+						return nil
+					})
 			})
 
-			Context("http_strict_transport_security, http_strict_transport_security_include_subdomain, and http_strict_transport_security_preload is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HSTS = true
-					staticfile.HSTSIncludeSubDomains = true
-					staticfile.HSTSPreload = true
-				})
-				It("it adds the HSTS header", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000; includeSubDomains; preload";`))
-				})
+			AfterEach(func() {
+				staticfile.Locations = nil
 			})
 
-			Context("http_strict_transport_security is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HSTS = false
-				})
-				It("it does not add the HSTS header", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000";`))
-				})
+			It("tests the configuration with a placeholder host", func() {
+				Expect(finalizer.CheckNginxConf()).To(Succeed())
+				Expect(rendered).To(ContainSubstring(`proxy_pass "https://127.0.0.1:8443/v1/";`))
+				Expect(rendered).To(ContainSubstring("proxy_set_header Host backend.invalid;"))
+
+				data, err := ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+				Expect(err).To(BeNil())
+				Expect(string(data)).To(ContainSubstring(`proxy_pass "https://backend.invalid:8443/v1/";`))
 			})
+		})
 
-			Context("http_strict_transport_security is NOT set in staticfile, but http_strict_transport_security_preload or http_strict_transport_security_include_subdomain are set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.HSTS = false
-					staticfile.HSTSIncludeSubDomains = true
-					staticfile.HSTSPreload = true
-				})
-				It("it does not add the HSTS header", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring(`add_header Strict-Transport-Security "max-age=31536000";`))
-				})
+		Context("a bound service provides certificates", func() {
+			BeforeEach(func() {
+				staticfile.Locations = []finalize.Location{{Match: "/api/", Proxy: &finalize.Proxy{Service: &finalize.ServiceBinding{ServiceRef: finalize.ServiceRef{Tag: "api", CAField: "ca"}}}}}
 			})
 
-			Context("enable_http2 is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.EnableHttp2 = true
-				})
-				It("the listener uses the http2 directive", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(enableHttp2Conf))
-					Expect(string(data)).NotTo(ContainSubstring(`<% if ENV["ENABLE_HTTP2"] %>`))
-				})
+			AfterEach(func() {
+				staticfile.Locations = nil
 			})
 
-			Context("enable_http2 is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.EnableHttp2 = false
-				})
-				It("using the http2 directive depends on ENV['ENABLE_HTTP2']", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(enableHttp2Erb))
-				})
+			It("skips the check", func() {
+				Expect(finalizer.CheckNginxConf()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Skipping the check of nginx.conf, the certificates of /api/ are only written at start"))
 			})
+		})
 
-			Context("force_https is set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.ForceHTTPS = true
-				})
-				It("the 301 redirect does not depend on ENV['FORCE_HTTPS']", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(forceHTTPSConf))
-					Expect(string(data)).To(ContainSubstring(xForwardedHostMappingConf))
-					Expect(string(data)).To(ContainSubstring(xForwardedPrefixMappingConf))
-					Expect(string(data)).To(ContainSubstring(xForwardedProtoMappingConf))
-					Expect(string(data)).NotTo(ContainSubstring(`<% if ENV["FORCE_HTTPS"] %>`))
-				})
+		Context("nginx is not installed", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(nginx)).To(Succeed())
 			})
 
-			Context("force_https is NOT set in staticfile", func() {
-				BeforeEach(func() {
-					staticfile.ForceHTTPS = false
-				})
-				It("the 301 redirect does depend on ENV['FORCE_HTTPS']", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(forceHTTPSErb))
-					Expect(string(data)).To(ContainSubstring(xForwardedHostMappingConf))
-					Expect(string(data)).To(ContainSubstring(xForwardedPrefixMappingConf))
-					Expect(string(data)).To(ContainSubstring(xForwardedProtoMappingConf))
-					Expect(string(data)).To(ContainSubstring(`<% if ENV["FORCE_HTTPS"] %>`))
-				})
+			It("warns", func() {
+				Expect(finalizer.CheckNginxConf()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("**WARNING** Unable to check nginx.conf, nginx is not installed"))
 			})
+		})
+	})
 
-			Context("there is a Staticfile.auth", func() {
-				BeforeEach(func() {
-					staticfile.BasicAuth = true
-					err = ioutil.WriteFile(filepath.Join(buildDir, "Staticfile.auth"), []byte("authentication info"), 0644)
-					Expect(err).To(BeNil())
-				})
+	Describe("Precompress", func() {
+		var (
+			cacheDir  string
+			publicDir string
+			script    []byte
+		)
 
-				It("it enables basic authentication", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).To(ContainSubstring(basicAuthConf))
-				})
+		gunzip := func(path string) string {
+			f, err := os.Open(path)
+			Expect(err).To(BeNil())
+			defer f.Close()
+			r, err := gzip.NewReader(f)
+			Expect(err).To(BeNil())
+			contents, err := ioutil.ReadAll(r)
+			Expect(err).To(BeNil())
+			return string(contents)
+		}
 
-				It("copies the Staticfile.auth to .htpasswd", func() {
-					data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", ".htpasswd"))
-					Expect(err).To(BeNil())
-					Expect(string(data)).To(Equal("authentication info"))
-				})
+		BeforeEach(func() {
+			cacheDir, err = ioutil.TempDir("", "staticfile-buildpack.cache.")
+			Expect(err).To(BeNil())
+
+			Expect(os.MkdirAll(filepath.Join(buildDir, "nginx", "conf"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"), []byte(finalize.MimeTypes), 0644)).To(Succeed())
+
+			publicDir = filepath.Join(buildDir, "public")
+			Expect(os.MkdirAll(filepath.Join(publicDir, "js"), 0755)).To(Succeed())
+			script = bytes.Repeat([]byte("console.log('hello');\n"), 100)
+			random := make([]byte, 4096)
+			_, err = rand.Read(random)
+			Expect(err).To(BeNil())
+			files := map[string][]byte{
+				"js/app.js":            script,
+				"index.html":           []byte("<html></html>"),
+				"photo.jpg":            bytes.Repeat([]byte("jpeg"), 1000),
+				"random.json":          random,
+				"war_and_peace.txt":    bytes.Repeat([]byte("Leo Tolstoy\n"), 200),
+				"war_and_peace.txt.gz": []byte("shipped"),
+			}
+			for name, contents := range files {
+				Expect(ioutil.WriteFile(filepath.Join(publicDir, name), contents, 0644)).To(Succeed())
+			}
+
+			staticfile.Precompress = &finalize.Precompress{MinSize: 1100, Types: []string{"text/plain", "application/javascript", "application/json", "image/svg+xml"}}
+		})
+
+		JustBeforeEach(func() {
+			finalizer.CacheDir = cacheDir
+		})
+
+		AfterEach(func() {
+			staticfile.Precompress = nil
+			Expect(os.RemoveAll(cacheDir)).To(Succeed())
+		})
+
+		It("compresses large files of the configured types", func() {
+			Expect(finalizer.Precompress()).To(Succeed())
+
+			Expect(gunzip(filepath.Join(publicDir, "js", "app.js.gz"))).To(Equal(string(script)))
+			Expect(filepath.Join(publicDir, "index.html.gz")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(publicDir, "photo.jpg.gz")).NotTo(BeAnExistingFile())
+			Expect(filepath.Join(publicDir, "random.json.gz")).NotTo(BeAnExistingFile())
+			Expect(buffer.String()).To(ContainSubstring("-----> Precompressing assets in public\n"))
+			Expect(buffer.String()).To(ContainSubstring("Wrote 1 .gz files, 0 of them from the cache\n"))
+		})
+
+		It("keeps the .gz files shipped with the app", func() {
+			Expect(finalizer.Precompress()).To(Succeed())
+
+			Expect(ioutil.ReadFile(filepath.Join(publicDir, "war_and_peace.txt.gz"))).To(Equal([]byte("shipped")))
+			Expect(buffer.String()).To(ContainSubstring("Kept 1 .gz files shipped with the app\n"))
+		})
+
+		It("reuses the cache on the next push and drops stale entries", func() {
+			Expect(os.MkdirAll(filepath.Join(cacheDir, "precompress"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(cacheDir, "precompress", "stale.gz"), []byte("stale"), 0644)).To(Succeed())
+			Expect(finalizer.Precompress()).To(Succeed())
+			Expect(filepath.Join(cacheDir, "precompress", "stale.gz")).NotTo(BeAnExistingFile())
+
+			Expect(os.Remove(filepath.Join(publicDir, "js", "app.js.gz"))).To(Succeed())
+			Expect(finalizer.Precompress()).To(Succeed())
+			Expect(gunzip(filepath.Join(publicDir, "js", "app.js.gz"))).To(Equal(string(script)))
+			Expect(buffer.String()).To(ContainSubstring("Wrote 1 .gz files, 1 of them from the cache\n"))
+		})
+
+		Context("brotli is enabled", func() {
+			BeforeEach(func() {
+				staticfile.Brotli = &finalize.Brotli{}
+				Expect(ioutil.WriteFile(filepath.Join(publicDir, "war_and_peace.txt.br"), []byte("shipped"), 0644)).To(Succeed())
 			})
 
-			Context("there is not a Staticfile.auth", func() {
-				BeforeEach(func() {
-					staticfile.BasicAuth = false
-				})
-				It("it does not enable basic authenticaiont", func() {
-					data := readNginxConfAndStrip()
-					Expect(string(data)).NotTo(ContainSubstring(basicAuthConf))
-				})
+			AfterEach(func() {
+				staticfile.Brotli = nil
+			})
 
-				It("does not create an .htpasswd", func() {
-					Expect(filepath.Join(buildDir, "nginx", "conf", ".htpasswd")).NotTo(BeAnExistingFile())
-				})
+			It("writes .br files next to the .gz files", func() {
+				Expect(finalizer.Precompress()).To(Succeed())
+
+				compressed, err := ioutil.ReadFile(filepath.Join(publicDir, "js", "app.js.br"))
+				Expect(err).To(BeNil())
+				contents, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(compressed)))
+				Expect(err).To(BeNil())
+				Expect(string(contents)).To(Equal(string(script)))
+				Expect(filepath.Join(publicDir, "js", "app.js.gz")).To(BeAnExistingFile())
+				Expect(filepath.Join(publicDir, "random.json.br")).NotTo(BeAnExistingFile())
+				Expect(buffer.String()).To(ContainSubstring("Wrote 1 .br files, 0 of them from the cache\n"))
+				Expect(buffer.String()).To(ContainSubstring("Kept 1 .br files shipped with the app\n"))
+			})
+
+			It("caches the .br files apart from the .gz files", func() {
+				Expect(finalizer.Precompress()).To(Succeed())
+				Expect(os.Remove(filepath.Join(publicDir, "js", "app.js.br"))).To(Succeed())
+				Expect(finalizer.Precompress()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("Wrote 1 .br files, 1 of them from the cache\n"))
+				Expect(buffer.String()).To(ContainSubstring("Wrote 0 .gz files, 0 of them from the cache\n"))
 			})
 		})
 
-		Context("custom mime.types exists", func() {
+		Context("compression excludes a path", func() {
 			BeforeEach(func() {
-				err = os.MkdirAll(filepath.Join(buildDir, "public"), 0755)
-				Expect(err).To(BeNil())
+				staticfile.Compression = &finalize.Compression{Exclude: []string{"/js/"}}
+			})
 
-				err = ioutil.WriteFile(filepath.Join(buildDir, "public", "mime.types"), []byte("mime types info"), 0644)
-				Expect(err).To(BeNil())
+			AfterEach(func() {
+				staticfile.Compression = nil
 			})
 
-			It("uses the custom configuration", func() {
-				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
-				Expect(err).To(BeNil())
-				Expect(data).To(Equal([]byte("mime types info")))
+			It("leaves the files under the path alone", func() {
+				Expect(finalizer.Precompress()).To(Succeed())
+				Expect(filepath.Join(publicDir, "js", "app.js.gz")).NotTo(BeAnExistingFile())
+				Expect(buffer.String()).To(ContainSubstring("Wrote 0 .gz files, 0 of them from the cache\n"))
 			})
 		})
 
-		Context("custom mime.types does NOT exist", func() {
-			It("uses the provided mime.types", func() {
-				data, err = ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "mime.types"))
-				Expect(err).To(BeNil())
-				Expect(string(data)).To(Equal(finalize.MimeTypes))
+		Context("precompress is disabled", func() {
+			BeforeEach(func() {
+				staticfile.Precompress = nil
+			})
+
+			It("writes no .gz files", func() {
+				Expect(finalizer.Precompress()).To(Succeed())
+				Expect(filepath.Join(publicDir, "js", "app.js.gz")).NotTo(BeAnExistingFile())
+				Expect(buffer.String()).NotTo(ContainSubstring("Precompressing"))
 			})
 		})
 	})
@@ -1041,3 +3628,48 @@ var _ = Describe("Compile", func() {
 		})
 	})
 })
+
+var _ = Describe("MimeTypes", func() {
+	var types map[string]string
+
+	BeforeEach(func() {
+		types = map[string]string{}
+		body := finalize.MimeTypes[strings.Index(finalize.MimeTypes, "{")+1 : strings.LastIndex(finalize.MimeTypes, "}")]
+		for _, entry := range strings.Split(body, ";") {
+			fields := strings.Fields(entry)
+			if len(fields) < 2 {
+				continue
+			}
+			for _, ext := range fields[1:] {
+				Expect(types).NotTo(HaveKey(ext), "extension %s is listed twice", ext)
+				types[ext] = fields[0]
+			}
+		}
+	})
+
+	It("maps modern extensions", func() {
+		for ext, contentType := range map[string]string{
+			"wasm":        "application/wasm",
+			"mjs":         "application/javascript",
+			"avif":        "image/avif",
+			"webmanifest": "application/manifest+json",
+			"map":         "application/json",
+			"jsonld":      "application/ld+json",
+			"ics":         "text/calendar",
+			"apk":         "application/vnd.android.package-archive",
+			"otf":         "font/otf",
+			"eot":         "application/vnd.ms-fontobject",
+			"docx":        "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+			"vtt":         "text/vtt",
+		} {
+			Expect(types).To(HaveKeyWithValue(ext, contentType))
+		}
+	})
+
+	It("keeps the classic extensions", func() {
+		Expect(types).To(HaveKeyWithValue("html", "text/html"))
+		Expect(types).To(HaveKeyWithValue("js", "application/javascript"))
+		Expect(types).To(HaveKeyWithValue("svg", "image/svg+xml"))
+		Expect(types).To(HaveKeyWithValue("woff2", "font/woff2"))
+	})
+})
@@ -0,0 +1,294 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ResponseHeader is a header from `headers:`. When it is scoped to path
+// globs, Variable names the `map $uri` that picks its value per request.
+type ResponseHeader struct {
+	Name     string
+	Value    string
+	Globs    []HeaderGlob
+	Variable string
+}
+
+// HeaderGlob sets a header for the URIs matching Regex, or for the URI
+// Pattern itself when Regex is empty.
+type HeaderGlob struct {
+	Pattern string
+	Regex   string
+	Value   string
+}
+
+// MapKey is the `map $uri` key matching the glob.
+func (g HeaderGlob) MapKey() string {
+	if g.Regex == "" {
+		return g.Pattern
+	}
+	return "~" + g.Regex
+}
+
+// HeaderRules is the `headers:` mapping. A key starting with / is a path
+// glob holding its own headers; any other key is a header for every path.
+type HeaderRules []HeaderRule
+
+type HeaderRule struct {
+	Key     string
+	Value   string
+	Headers map[string]string
+}
+
+func (h *HeaderRules) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml2.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+
+	*h = nil
+	for _, item := range order {
+		rule := HeaderRule{Key: fmt.Sprint(item.Key)}
+		switch value := item.Value.(type) {
+		case yaml2.MapSlice:
+			rule.Headers = map[string]string{}
+			for _, header := range value {
+				rule.Headers[fmt.Sprint(header.Key)] = fmt.Sprint(header.Value)
+			}
+		case nil:
+		default:
+			rule.Value = fmt.Sprint(value)
+		}
+		*h = append(*h, rule)
+	}
+	return nil
+}
+
+func (h HeaderRules) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind != yaml.MappingNode {
+		return []schemaError{{Line: node.Line, Column: node.Column, Message: key + ": expected a mapping"}}
+	}
+
+	var errs []schemaError
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if strings.HasPrefix(k.Value, "/") {
+			if err := checkGlob(k.Value); err != nil {
+				errs = append(errs, schemaError{Line: k.Line, Column: k.Column, Message: fmt.Sprintf("%s: %s", key, err)})
+				continue
+			}
+			errs = append(errs, checkNode(v, typeOfHeaderValues, joinKey(key, k.Value))...)
+			continue
+		}
+
+		var err error
+		if v.Kind != yaml.ScalarNode {
+			err = fmt.Errorf("expected a header value or, for a path glob starting with /, a mapping of headers")
+		} else if err = checkHeaderName(k.Value); err == nil {
+			err = checkHeaderValue(v.Value)
+		}
+		if err != nil {
+			errs = append(errs, schemaError{Line: k.Line, Column: k.Column, Message: fmt.Sprintf("%s: %s", joinKey(key, k.Value), err)})
+		}
+	}
+	return errs
+}
+
+// HeaderValues maps header names to values.
+type HeaderValues map[string]string
+
+var typeOfHeaderValues = reflect.TypeOf(HeaderValues{})
+
+func (h HeaderValues) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := checkHeaderName(node.Content[i].Value); err != nil {
+			return nodeError{node.Content[i], err.Error()}
+		}
+		if err := checkHeaderValue(node.Content[i+1].Value); err != nil {
+			return nodeError{node.Content[i+1], err.Error()}
+		}
+	}
+	return nil
+}
+
+var (
+	headerNamePattern = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+	nonVariableChars  = regexp.MustCompile("[^0-9A-Za-z_]")
+)
+
+// managedHeaders are set by nginx itself; adding them again produces
+// duplicate or conflicting headers.
+var managedHeaders = map[string]bool{
+	"connection":        true,
+	"content-length":    true,
+	"content-type":      true,
+	"date":              true,
+	"keep-alive":        true,
+	"server":            true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+func checkHeaderName(name string) error {
+	if !headerNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if managedHeaders[strings.ToLower(name)] {
+		return fmt.Errorf("header %s is managed by nginx and cannot be set", name)
+	}
+	return nil
+}
+
+func checkHeaderValue(value string) error {
+	for _, r := range value {
+		if (r < ' ' && r != '\t') || r == 0x7f {
+			return fmt.Errorf("header value %q contains control characters", value)
+		}
+	}
+	return nil
+}
+
+func checkGlob(glob string) error {
+	if strings.ContainsAny(glob, " \t;\"'") {
+		return fmt.Errorf("invalid path glob %q", glob)
+	}
+	if _, err := regexp.Compile(globToRegex(glob)); err != nil || strings.Count(glob, "{") != strings.Count(glob, "}") {
+		return fmt.Errorf("invalid path glob %q", glob)
+	}
+	return nil
+}
+
+// globToRegex translates a path glob to an anchored regular expression:
+// * matches within a path segment, ** across segments, ? one character and
+// {a,b} either alternative.
+func globToRegex(glob string) string {
+	var re strings.Builder
+	re.WriteString("^")
+	inBraces := false
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '{':
+			re.WriteString("(?:")
+			inBraces = true
+		case c == '}' && inBraces:
+			re.WriteString(")")
+			inBraces = false
+		case c == ',' && inBraces:
+			re.WriteString("|")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// loadHeaders resolves header rules, logging them under key: the
+// Staticfile directive or the file they were read from.
+func (sf *Finalizer) loadHeaders(key string, rules HeaderRules) []ResponseHeader {
+	byName := map[string]*ResponseHeader{}
+	var names []string
+	header := func(name string) *ResponseHeader {
+		canonical := strings.ToLower(name)
+		if _, ok := byName[canonical]; !ok {
+			byName[canonical] = &ResponseHeader{Name: name}
+			names = append(names, canonical)
+		}
+		return byName[canonical]
+	}
+
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Key, "/") {
+			if checkHeaderName(rule.Key) == nil && checkHeaderValue(rule.Value) == nil {
+				header(rule.Key).Value = rule.Value
+			}
+			continue
+		}
+
+		if checkGlob(rule.Key) != nil {
+			continue
+		}
+		for _, name := range sortedKeys(rule.Headers) {
+			value := rule.Headers[name]
+			if checkHeaderName(name) != nil || checkHeaderValue(value) != nil {
+				continue
+			}
+			h := header(name)
+			h.Globs = append(h.Globs, HeaderGlob{Pattern: rule.Key, Regex: globToRegex(rule.Key), Value: value})
+		}
+	}
+
+	var headers []ResponseHeader
+	sort.Strings(names)
+	for _, name := range names {
+		h := *byName[name]
+		if len(h.Globs) > 0 {
+			h.Variable = "$staticfile_header_" + nonVariableChars.ReplaceAllString(name, "_")
+		}
+		headers = append(headers, h)
+	}
+
+	for _, h := range headers {
+		if h.Value != "" {
+			sf.beginStep(key, "Enabling response header %s", h.Name)
+		}
+		for _, glob := range h.Globs {
+			sf.beginStep(key, "Enabling response header %s for %s", h.Name, glob.Pattern)
+		}
+	}
+	return headers
+}
+
+// renderedHeader is one add_header line of a location block.
+type renderedHeader struct {
+	Name  string
+	Value string
+}
+
+// locationHeaders lists the add_header lines for a location block. nginx
+// drops inherited add_header directives as soon as a block has its own, so
+// every block repeats the top-level headers and overrides them by name.
+func locationHeaders(s locationScope) []renderedHeader {
+	var headers []renderedHeader
+	local := map[string]string{}
+	for name, value := range s.Location.Headers {
+		local[strings.ToLower(name)] = value
+	}
+
+	for _, h := range s.Config.Headers {
+		if _, ok := local[strings.ToLower(h.Name)]; ok {
+			continue
+		}
+		if h.Variable != "" {
+			headers = append(headers, renderedHeader{h.Name, h.Variable})
+		} else {
+			headers = append(headers, renderedHeader{h.Name, nginxQuote(h.Value)})
+		}
+	}
+	for _, name := range sortedKeys(s.Location.Headers) {
+		headers = append(headers, renderedHeader{name, nginxQuote(s.Location.Headers[name])})
+	}
+	return headers
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
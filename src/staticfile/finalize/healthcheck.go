@@ -0,0 +1,75 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Healthcheck is an endpoint answering 200 from nginx itself, ahead of the
+// HTTPS redirect, redirects and access rules. With Readiness it answers 503
+// until the launcher has seen nginx accept a connection.
+type Healthcheck struct {
+	Path      string
+	Readiness bool
+}
+
+// defaultHealthcheckPath is the endpoint of `healthcheck: enabled`.
+const defaultHealthcheckPath = "/healthz"
+
+// HealthcheckTemp is `healthcheck:`, either a toggle or a mapping of
+// options, which enables it.
+type HealthcheckTemp struct {
+	Enabled Toggle
+	HealthcheckOptions
+}
+
+type HealthcheckOptions struct {
+	Path      HealthcheckPath `yaml:"path"`
+	Readiness Toggle          `yaml:"readiness"`
+}
+
+func (h *HealthcheckTemp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled string
+	if err := unmarshal(&enabled); err == nil {
+		h.Enabled = Toggle(enabled)
+		return nil
+	}
+	h.Enabled = "enabled"
+	return unmarshal(&h.HealthcheckOptions)
+}
+
+func (h HealthcheckTemp) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind == yaml.MappingNode {
+		return checkNode(node, reflect.TypeOf(HealthcheckOptions{}), key)
+	}
+	return checkNode(node, reflect.TypeOf(Toggle("")), key)
+}
+
+// HealthcheckPath is the URI of the health check endpoint.
+type HealthcheckPath string
+
+func (p HealthcheckPath) checkValue(node *yaml.Node) error {
+	if !strings.HasPrefix(node.Value, "/") || strings.ContainsAny(node.Value, " \t;{}\"'$?#") {
+		return fmt.Errorf("invalid health check path %q, expected a path starting with /", node.Value)
+	}
+	return nil
+}
+
+func (sf *Finalizer) loadHealthcheck(rule HealthcheckTemp) *Healthcheck {
+	if !rule.Enabled.Enabled() {
+		return nil
+	}
+	healthcheck := &Healthcheck{Path: defaultHealthcheckPath, Readiness: rule.Readiness.Enabled()}
+	if isValid(rule.Path, string(rule.Path)) {
+		healthcheck.Path = string(rule.Path)
+	}
+
+	sf.beginStep("healthcheck", "Enabling health check at %s", healthcheck.Path)
+	if healthcheck.Readiness {
+		sf.Log.Info("%s answers 503 until nginx accepts connections", healthcheck.Path)
+	}
+	return healthcheck
+}
@@ -0,0 +1,179 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// launchPrefix names the buildpack's launch-time binaries on the PATH of
+// the app, e.g. bin/logs in the buildpack becomes staticfile-logs.
+const launchPrefix = "staticfile-"
+
+const (
+	// defaultDrainTimeout leaves the log forwarder time to write the last
+	// lines before Cloud Foundry kills the app, 10 seconds after SIGTERM.
+	defaultDrainTimeout = 8
+	maxRestarts         = 10
+	readyMarker         = "nginx/run/ready"
+)
+
+// Launcher is how staticfile-launcher, the web process, runs nginx.
+type Launcher struct {
+	BeforeStart []string
+	// DrainTimeout is in seconds.
+	DrainTimeout int
+	Restarts     int
+}
+
+// Launch is the `launch:` section.
+type Launch struct {
+	BeforeStart  Commands     `yaml:"before_start"`
+	DrainTimeout DrainTimeout `yaml:"drain_timeout"`
+	Restarts     Restarts     `yaml:"restarts"`
+}
+
+func (l Launch) isSet() bool {
+	return !reflect.DeepEqual(l, Launch{})
+}
+
+// Commands are shell commands, run in order from the app directory.
+type Commands []string
+
+func (c Commands) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !validCommand(item.Value) {
+			return nodeError{item, fmt.Sprintf("invalid command %q, expected a command on a single line", item.Value)}
+		}
+	}
+	return nil
+}
+
+func validCommand(command string) bool {
+	return strings.TrimSpace(command) != "" && !strings.ContainsAny(command, "\r\n")
+}
+
+// DrainTimeout is how long nginx has to finish the requests in flight.
+type DrainTimeout string
+
+func (d DrainTimeout) checkValue(node *yaml.Node) error {
+	if Duration(node.Value).checkValue(node) != nil || Duration(node.Value).seconds() == 0 {
+		return fmt.Errorf("invalid drain timeout %q, expected a duration such as 8s", node.Value)
+	}
+	return nil
+}
+
+// Restarts is how many times nginx is started again after crashing.
+type Restarts string
+
+func (r Restarts) checkValue(node *yaml.Node) error {
+	if n, err := strconv.Atoi(node.Value); err != nil || n < 0 || n > maxRestarts {
+		return fmt.Errorf("invalid restarts %q, expected a number from 0 to %d", node.Value, maxRestarts)
+	}
+	return nil
+}
+
+func (sf *Finalizer) loadLaunch(launch Launch) *Launcher {
+	l := &Launcher{DrainTimeout: defaultDrainTimeout}
+	for _, command := range launch.BeforeStart {
+		if validCommand(command) {
+			l.BeforeStart = append(l.BeforeStart, command)
+		}
+	}
+	if isValid(launch.DrainTimeout, string(launch.DrainTimeout)) {
+		l.DrainTimeout = Duration(launch.DrainTimeout).seconds()
+	}
+	if isValid(launch.Restarts, string(launch.Restarts)) {
+		l.Restarts, _ = strconv.Atoi(string(launch.Restarts))
+	}
+
+	sf.beginStep("launch", "Draining requests for up to %d seconds on shutdown", l.DrainTimeout)
+	if l.DrainTimeout > 10 {
+		sf.Log.Warning("Cloud Foundry stops apps 10 seconds after SIGTERM unless the platform allows longer")
+	}
+	for _, command := range l.BeforeStart {
+		sf.Log.Info("Running %s before nginx starts", command)
+	}
+	if l.Restarts > 0 {
+		sf.Log.Info("Restarting nginx up to %d times after a crash", l.Restarts)
+	}
+	return l
+}
+
+// installBinary copies a launch-time binary from the buildpack into the
+// bin directory of the dependency, which is on the PATH at launch.
+func (sf *Finalizer) installBinary(name string) error {
+	source := filepath.Join(sf.BinDir, name)
+	if _, err := os.Stat(source); err != nil {
+		return fmt.Errorf("the buildpack has no %s binary: %s", name, err)
+	}
+	binDir := filepath.Join(sf.DepDir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		return err
+	}
+	return libbuildpack.CopyFile(source, filepath.Join(binDir, launchPrefix+name))
+}
+
+// logFIFOs lists the FIFOs nginx logs to, relative to the app directory.
+func (sf *Finalizer) logFIFOs() []string {
+	fifos := []string{"nginx/logs/access.log", "nginx/logs/error.log"}
+	if sf.Config.Metrics != nil {
+		fifos = append(fifos, metricsLog)
+	}
+	return fifos
+}
+
+// writeLaunchConfig stages launch.json, which boot.sh hands to the
+// launcher.
+func (sf *Finalizer) writeLaunchConfig() error {
+	l := sf.Config.Launcher
+	if l == nil {
+		l = &Launcher{DrainTimeout: defaultDrainTimeout}
+	}
+	config := launcher.Config{
+		Conf:  "nginx/conf/nginx.conf",
+		FIFOs: sf.logFIFOs(),
+		Forward: []launcher.Stream{
+			{Path: "nginx/logs/access.log", Out: "stdout"},
+			{Path: "nginx/logs/error.log", Out: "stderr"},
+		},
+		BeforeStart:  l.BeforeStart,
+		DrainTimeout: l.DrainTimeout,
+		Restarts:     l.Restarts,
+	}
+	if sf.Config.Logging != nil {
+		config.LogPrefix = sf.Config.Logging.Prefix
+	}
+	if sf.Config.Healthcheck != nil && sf.Config.Healthcheck.Readiness {
+		config.Ready = readyMarker
+	}
+	if sf.Config.Metrics != nil {
+		config.Metrics = "nginx/conf/metrics.json"
+		config.Sockets = []string{metricsSocket}
+	}
+	if len(sf.serviceBindings()) > 0 {
+		config.Services = "nginx/conf/services.json"
+	}
+	if sf.authSource != nil {
+		config.Auth = "nginx/conf/auth.json"
+	}
+
+	confDir := filepath.Join(sf.BuildDir, "nginx", "conf")
+	if err := os.MkdirAll(confDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(confDir, "launch.json"), data, 0644)
+}
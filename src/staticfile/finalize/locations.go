@@ -0,0 +1,307 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Location is a `locations:` entry of the Staticfile, rendered as its own
+// nginx location block. Toggles left empty inherit the top-level directive.
+type Location struct {
+	Match             string
+	DirectoryIndex    Toggle
+	SSI               Toggle
+	PushState         Toggle
+	HSTS              Toggle
+	BasicAuth         Toggle
+	BasicAuthUserFile string
+	BasicAuthRealm    string
+	LocationInclude   string
+	StatusCodes       map[string]string
+	Headers           map[string]string
+	Expires           string
+	Access            *LocationAccess
+	Proxy             *Proxy
+	// Uncompressed is set for the paths compression.exclude lists.
+	Uncompressed bool
+	// ContentType is the type of a path of mime_types.
+	ContentType string
+}
+
+// IsRegex reports whether nginx matches the location by regular expression,
+// which makes its position relative to other regex locations significant.
+func (l Location) IsRegex() bool {
+	modifier, _ := splitLocationMatch(l.Match)
+	return modifier == "~" || modifier == "~*"
+}
+
+type LocationTemp struct {
+	DirectoryIndex  Toggle         `yaml:"directory"`
+	SSI             Toggle         `yaml:"ssi"`
+	PushState       Toggle         `yaml:"pushstate"`
+	HSTS            Toggle         `yaml:"http_strict_transport_security"`
+	BasicAuth       Toggle         `yaml:"basic_auth"`
+	BasicAuthFile   AuthFile       `yaml:"basic_auth_file"`
+	BasicAuthRealm  AuthRealm      `yaml:"basic_auth_realm"`
+	LocationInclude string         `yaml:"location_include"`
+	StatusCodes     StatusCodes    `yaml:"status_codes"`
+	Headers         HeaderValues   `yaml:"headers"`
+	Expires         string         `yaml:"expires"`
+	Access          LocationAccess `yaml:"access"`
+}
+
+type LocationRule struct {
+	Match string
+	LocationTemp
+}
+
+// LocationRules keeps the `locations:` mapping in Staticfile order, since
+// nginx tries regex locations in the order they appear.
+type LocationRules []LocationRule
+
+func (l *LocationRules) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml2.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var rules map[string]LocationTemp
+	if err := unmarshal(&rules); err != nil {
+		return err
+	}
+
+	*l = nil
+	for _, item := range order {
+		match := fmt.Sprint(item.Key)
+		*l = append(*l, LocationRule{Match: match, LocationTemp: rules[match]})
+	}
+	return nil
+}
+
+func (l LocationRules) mapValueType() reflect.Type {
+	return reflect.TypeOf(LocationTemp{})
+}
+
+func (l LocationRules) checkValue(node *yaml.Node) error {
+	seen := map[string]bool{"/": true}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if err := checkLocationMatch(key.Value); err != nil {
+			return nodeError{key, err.Error()}
+		}
+		modifier, path := splitLocationMatch(key.Value)
+		if modifier == "^~" {
+			modifier = ""
+		}
+		normalized := modifier + " " + path
+		if path == "/" && modifier == "" {
+			return nodeError{key, "use the top-level directives for location /"}
+		}
+		if seen[normalized] {
+			return nodeError{key, fmt.Sprintf("duplicate location %q", key.Value)}
+		}
+		seen[normalized] = true
+	}
+	return nil
+}
+
+// splitLocationMatch splits an nginx location match such as "~* \.pdf$"
+// into its modifier and path.
+func splitLocationMatch(match string) (string, string) {
+	fields := strings.Fields(match)
+	if len(fields) > 1 {
+		switch fields[0] {
+		case "=", "~", "~*", "^~":
+			return fields[0], strings.TrimSpace(strings.TrimPrefix(match, fields[0]))
+		}
+	}
+	return "", strings.TrimSpace(match)
+}
+
+func checkLocationMatch(match string) error {
+	modifier, path := splitLocationMatch(match)
+	if path == "" {
+		return fmt.Errorf("empty location")
+	}
+	if modifier == "~" || modifier == "~*" {
+		if unescapedChar.MatchString(path) {
+			return fmt.Errorf("invalid location %q, escape \" and ; in a regular expression with \\", match)
+		}
+		return checkRegex(path)
+	}
+	if strings.ContainsAny(path, "{};") {
+		return fmt.Errorf("invalid location %q", match)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("location %q must start with /, or with ~ or ~* for a regular expression", match)
+	}
+	return nil
+}
+
+// unescapedChar matches a " or ; that is not escaped with a backslash.
+var unescapedChar = regexp.MustCompile(`(^|[^\\])(\\\\)*[";]`)
+
+// locationMatch renders a location match for nginx.conf. Regular
+// expressions are quoted, so that nginx does not take the braces of a
+// quantifier such as {8} for a block.
+func locationMatch(match string) string {
+	modifier, path := splitLocationMatch(match)
+	if modifier == "~" || modifier == "~*" {
+		return modifier + " " + nginxQuote(path)
+	}
+	return match
+}
+
+// checkRegex reports a regular expression that is broken in any dialect;
+// nginx uses PCRE, which accepts more than Go's RE2 syntax.
+func checkRegex(re string) error {
+	_, err := syntax.Parse(re, syntax.Perl)
+	if e, ok := err.(*syntax.Error); ok && e.Code != syntax.ErrInvalidPerlOp && e.Code != syntax.ErrInvalidEscape {
+		return fmt.Errorf("invalid regular expression %q: %s", re, e.Code)
+	}
+	return nil
+}
+
+func (sf *Finalizer) loadLocations(rules LocationRules) []Location {
+	var locations []Location
+
+	for _, rule := range rules {
+		if err := checkLocationMatch(rule.Match); err != nil {
+			continue
+		}
+		if modifier, path := splitLocationMatch(rule.Match); modifier == "" && path == "/" {
+			continue
+		}
+
+		location := Location{
+			Match:           rule.Match,
+			DirectoryIndex:  rule.DirectoryIndex,
+			SSI:             rule.SSI,
+			PushState:       rule.PushState,
+			HSTS:            rule.HSTS,
+			BasicAuth:       rule.BasicAuth,
+			LocationInclude: rule.LocationInclude,
+			Headers:         rule.Headers,
+			Expires:         rule.Expires,
+		}
+		if len(rule.StatusCodes) > 0 {
+			location.StatusCodes = map[string]string{}
+			for code, page := range sf.Config.StatusCodes {
+				location.StatusCodes[code] = page
+			}
+			for code, page := range sf.getStatusCodes(rule.StatusCodes) {
+				location.StatusCodes[code] = page
+			}
+		}
+
+		if rule.Access.isSet() {
+			location.Access = sf.locationAccess(rule.Access)
+		}
+		if isValid(rule.BasicAuthRealm, string(rule.BasicAuthRealm)) {
+			location.BasicAuthRealm = string(rule.BasicAuthRealm)
+		}
+
+		sf.beginStep("locations", "Enabling rules for location %s", rule.Match)
+		if rule.BasicAuthFile != "" {
+			if file, ok := sf.authFiles[string(rule.BasicAuthFile)]; ok {
+				location.BasicAuthUserFile = file.Name
+				if location.BasicAuth == "" {
+					location.BasicAuth = "enabled"
+				}
+			} else {
+				sf.Log.Warning("basic_auth is enabled for location %s, but there is no %s with credentials", rule.Match, rule.BasicAuthFile)
+			}
+		} else if location.BasicAuth.Enabled() && !sf.Config.BasicAuthFile {
+			sf.Log.Warning("basic_auth is enabled for location %s, but there is no Staticfile.auth with credentials", rule.Match)
+		}
+
+		locations = append(locations, location)
+	}
+
+	return sortLocations(locations)
+}
+
+// locationIndex finds the location for match, a prefix match with or
+// without ^~ being the same location, or returns -1.
+func locationIndex(locations []Location, match string) int {
+	modifier, path := splitLocationMatch(match)
+	if modifier == "^~" {
+		modifier = ""
+	}
+	for i, location := range locations {
+		m, p := splitLocationMatch(location.Match)
+		if m == "^~" {
+			m = ""
+		}
+		if m == modifier && p == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// sortLocations orders location blocks the way nginx evaluates them: exact
+// matches, then prefixes from the longest, then regexes in Staticfile order.
+func sortLocations(locations []Location) []Location {
+	rank := func(l Location) int {
+		modifier, _ := splitLocationMatch(l.Match)
+		switch modifier {
+		case "=":
+			return 0
+		case "~", "~*":
+			return 2
+		}
+		return 1
+	}
+
+	sort.SliceStable(locations, func(i, j int) bool {
+		ri, rj := rank(locations[i]), rank(locations[j])
+		if ri != rj || ri == 2 {
+			return ri < rj
+		}
+		_, pi := splitLocationMatch(locations[i].Match)
+		_, pj := splitLocationMatch(locations[j].Match)
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return pi < pj
+	})
+	return locations
+}
+
+// locationScope is what the "location" template renders: one location
+// block, falling back to the top-level directives.
+type locationScope struct {
+	Config   Staticfile
+	Location Location
+}
+
+func rootScope(config Staticfile) locationScope {
+	return locationScope{Config: config, Location: Location{Match: "/"}}
+}
+
+func scope(config Staticfile, location Location) locationScope {
+	return locationScope{Config: config, Location: location}
+}
+
+// inheritToggle renders the ERB condition for a toggle in a location block.
+// A location that sets the toggle fixes it at staging; otherwise it follows
+// the top-level directive, including its start-time override.
+func inheritToggle(key string, local Toggle, global bool) string {
+	if local != "" {
+		return fmt.Sprint(local.Enabled())
+	}
+	return erbToggle(key, global)
+}
+
+// nginxQuote quotes a value for use as a single nginx directive argument.
+func nginxQuote(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,323 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Logging is the `logging:` section.
+type Logging struct {
+	Format     LogFormat  `yaml:"format"`
+	Fields     LogFields  `yaml:"fields"`
+	ErrorLevel LogLevel   `yaml:"error_level"`
+	Exclude    LogPaths   `yaml:"exclude"`
+	SampleRate SampleRate `yaml:"sample_rate"`
+	Redact     LogParams  `yaml:"redact"`
+	Prefix     LogPrefix  `yaml:"prefix"`
+}
+
+func (l Logging) isSet() bool {
+	return !reflect.DeepEqual(l, Logging{})
+}
+
+// LogFormat is cloudfoundry, the default one-line format, or json.
+type LogFormat string
+
+func (f LogFormat) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "cloudfoundry", "json")
+}
+
+// LogLevel is the error_log severity.
+type LogLevel string
+
+func (l LogLevel) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "debug", "info", "notice", "warn", "error", "crit", "alert", "emerg")
+}
+
+// logFields maps the fields of the json format to their values. Values
+// that are always numbers are written unquoted.
+var logFields = map[string]struct {
+	Value   string
+	Numeric bool
+}{
+	"time":                  {Value: "$time_iso8601"},
+	"client":                {Value: "$http_x_forwarded_for"},
+	"forwarded_for":         {Value: "$http_x_forwarded_for"},
+	"method":                {Value: "$request_method"},
+	"uri":                   {Value: "$request_uri"},
+	"protocol":              {Value: "$server_protocol"},
+	"status":                {Value: "$status", Numeric: true},
+	"bytes":                 {Value: "$body_bytes_sent", Numeric: true},
+	"request_time":          {Value: "$request_time", Numeric: true},
+	"referer":               {Value: "$http_referer"},
+	"user_agent":            {Value: "$http_user_agent"},
+	"host":                  {Value: "$best_host"},
+	"request_id":            {Value: "$staticfile_request_id"},
+	"upstream_time":         {Value: "$upstream_response_time"},
+	"upstream_connect_time": {Value: "$upstream_connect_time"},
+	"upstream_status":       {Value: "$upstream_status"},
+	"app":                   {Value: `<%= ENV["STATICFILE_APP_NAME"] %>`},
+	"instance":              {Value: `<%= ENV["CF_INSTANCE_INDEX"] %>`},
+}
+
+// defaultLogFields are logged by the json format without `fields:`, along
+// with upstream_time when the Staticfile proxies.
+var defaultLogFields = []string{"time", "client", "method", "uri", "status", "bytes", "request_time", "referer", "user_agent", "host", "request_id", "app", "instance"}
+
+// LogFields lists the fields of the json format, in order.
+type LogFields []string
+
+func (f LogFields) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if _, ok := logFields[item.Value]; !ok {
+			return nodeError{item, fmt.Sprintf("unknown log field %q", item.Value)}
+		}
+	}
+	return nil
+}
+
+// LogPaths lists path globs left out of the access log.
+type LogPaths []string
+
+func (p LogPaths) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !strings.HasPrefix(item.Value, "/") {
+			return nodeError{item, fmt.Sprintf("path glob %q must start with /", item.Value)}
+		}
+		if err := checkGlob(item.Value); err != nil {
+			return nodeError{item, err.Error()}
+		}
+	}
+	return nil
+}
+
+// LogPrefix is prepended to every line forwarded from the access and error
+// logs, e.g. "[web] ".
+type LogPrefix string
+
+func (p LogPrefix) checkValue(node *yaml.Node) error {
+	if len(node.Value) > 64 || strings.ContainsAny(node.Value, "\r\n\x00") {
+		return fmt.Errorf("invalid log prefix %q, expected a single line of up to 64 characters", node.Value)
+	}
+	return nil
+}
+
+// LogParams lists query parameters by name.
+type LogParams []string
+
+var queryParamPattern = regexp.MustCompile(`^[A-Za-z0-9_.~\[\]-]+$`)
+
+func (p LogParams) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !queryParamPattern.MatchString(item.Value) {
+			return nodeError{item, fmt.Sprintf("invalid query parameter %q", item.Value)}
+		}
+	}
+	return nil
+}
+
+// SampleRate is the fraction of requests logged, above 0 and up to 1.
+type SampleRate string
+
+var sampleRatePattern = regexp.MustCompile(`^(0(\.\d{1,4})?|1(\.0*)?|\.\d{1,4})$`)
+
+func (r SampleRate) checkValue(node *yaml.Node) error {
+	if rate, err := strconv.ParseFloat(node.Value, 64); err != nil || rate <= 0 || !sampleRatePattern.MatchString(node.Value) {
+		return fmt.Errorf("invalid sample rate %q, expected a fraction above 0 and up to 1 such as 0.1", node.Value)
+	}
+	return nil
+}
+
+// percent renders the rate for split_clients, or "" when every request is
+// logged.
+func (r SampleRate) percent() string {
+	rate, err := strconv.ParseFloat(string(r), 64)
+	if err != nil || rate >= 1 {
+		return ""
+	}
+	return strconv.FormatFloat(rate*100, 'f', -1, 64) + "%"
+}
+
+// AccessLog is how nginx.conf writes the access and error logs.
+type AccessLog struct {
+	Format     string
+	JSON       string
+	ErrorLevel string
+	Exclude    []string
+	Sample     string
+	Redact     []string
+	Prefix     string
+}
+
+// Filtered reports whether access_log needs the $staticfile_log condition.
+func (l AccessLog) Filtered() bool {
+	return len(l.Exclude) > 0 || l.Sample != ""
+}
+
+// loadLogging resolves the `logging:` section. It runs after access and
+// proxy, which decide the client and upstream_time fields.
+func (sf *Finalizer) loadLogging(logging Logging) *AccessLog {
+	log := &AccessLog{Format: "cloudfoundry"}
+	if isValid(logging.Format, string(logging.Format)) {
+		log.Format = strings.ToLower(string(logging.Format))
+	}
+	if isValid(logging.ErrorLevel, string(logging.ErrorLevel)) {
+		log.ErrorLevel = strings.ToLower(string(logging.ErrorLevel))
+	}
+	for _, glob := range logging.Exclude {
+		if checkGlob(glob) != nil || !strings.HasPrefix(glob, "/") {
+			continue
+		}
+		if strings.ContainsAny(glob, "*?{") {
+			log.Exclude = append(log.Exclude, "~"+globToRegex(glob))
+		} else {
+			log.Exclude = append(log.Exclude, glob)
+		}
+	}
+	if isValid(logging.SampleRate, string(logging.SampleRate)) {
+		log.Sample = logging.SampleRate.percent()
+	}
+	if isValid(logging.Prefix, string(logging.Prefix)) {
+		log.Prefix = string(logging.Prefix)
+	}
+	for _, param := range logging.Redact {
+		if queryParamPattern.MatchString(param) {
+			log.Redact = append(log.Redact, param)
+		}
+	}
+
+	if log.Format == "json" {
+		fields := []string(logging.Fields)
+		if len(fields) == 0 {
+			fields = append([]string{}, defaultLogFields...)
+			if hasProxy(sf.Config.Locations) {
+				fields = append(fields, "upstream_time")
+			}
+		}
+		log.JSON = sf.jsonLogFormat(fields, len(log.Redact) > 0)
+	}
+
+	sf.beginStep("logging", "Enabling %s access logs", log.Format)
+	if len(log.Exclude) > 0 {
+		sf.Log.Info("Leaving %s out of the access log", strings.Join(logging.Exclude, ", "))
+	}
+	if log.Sample != "" {
+		sf.Log.Info("Logging %s of requests", log.Sample)
+	}
+	if len(log.Redact) > 0 {
+		sf.Log.Info("Redacting the query parameters %s", strings.Join(log.Redact, ", "))
+	}
+	if log.Prefix != "" {
+		sf.Log.Info("Prefixing log lines with %q", log.Prefix)
+	}
+	return log
+}
+
+// jsonLogFormat renders the json log_format, to be used with escape=json.
+func (sf *Finalizer) jsonLogFormat(fields []string, redact bool) string {
+	pairs := make([]string, 0, len(fields))
+	for _, name := range fields {
+		field, ok := logFields[name]
+		if !ok {
+			continue
+		}
+		value := field.Value
+		if name == "client" && trustsProxies(sf.Config) {
+			value = "$remote_addr"
+		}
+		if (name == "uri" || name == "referer") && redact {
+			value = "$staticfile_log_" + name
+		}
+		if field.Numeric {
+			pairs = append(pairs, fmt.Sprintf(`"%s":%s`, name, value))
+		} else {
+			pairs = append(pairs, fmt.Sprintf(`"%s":"%s"`, name, value))
+		}
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func hasProxy(locations []Location) bool {
+	for _, l := range locations {
+		if l.Proxy != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// redactMap masks one query parameter in the logged request line, URI or
+// referer. Maps are chained, several per parameter, the last setting
+// Variable to $staticfile_log_request, $staticfile_log_uri or
+// $staticfile_log_referer.
+type redactMap struct {
+	Source   string
+	Variable string
+	Regex    string
+}
+
+// redactOccurrences is how many occurrences of a repeated parameter are
+// masked one by one. A map only replaces one match, so each occurrence
+// takes a map; the map after them masks the rest of the query string from
+// the next occurrence on.
+const redactOccurrences = 3
+
+// redactSources are the variables redactMaps masks, by the name of the
+// variable holding the result.
+var redactSources = []struct{ Name, Source string }{
+	{"request", "$request"},
+	{"uri", "$request_uri"},
+	{"referer", "$http_referer"},
+}
+
+// redactMaps masks the value of each `logging.redact` parameter in
+// $request, $request_uri and $http_referer before they are logged.
+func redactMaps(log *AccessLog) []redactMap {
+	if log == nil || len(log.Redact) == 0 {
+		return nil
+	}
+	var maps []redactMap
+	for _, source := range redactSources {
+		from := source.Source
+		for _, param := range log.Redact {
+			for _, regex := range redactRegexes(param) {
+				variable := fmt.Sprintf("$staticfile_redact_%s_%d", source.Name, len(maps))
+				maps = append(maps, redactMap{Source: from, Variable: variable, Regex: regex})
+				from = variable
+			}
+		}
+		maps[len(maps)-1].Variable = "$staticfile_log_" + source.Name
+	}
+	return maps
+}
+
+// redactRegexes matches the value of each occurrence of param in turn,
+// skipping the occurrences before it, then everything from the occurrence
+// after those to the end of the query string.
+func redactRegexes(param string) []string {
+	occurrence := `.*?[?&]` + regexp.QuoteMeta(param) + `=`
+	regexes := make([]string, 0, redactOccurrences+1)
+	for i := 0; i <= redactOccurrences; i++ {
+		value := `[^&#\s]*`
+		if i == redactOccurrences {
+			value = `[^#\s]*`
+		}
+		skip := ""
+		if i > 0 {
+			skip = fmt.Sprintf(`(?:%s[^&#\s]*){%d}`, occurrence, i)
+		}
+		regexes = append(regexes, `^(`+skip+occurrence+`)`+value+`(.*)$`)
+	}
+	return regexes
+}
+
+// redactsQuery reports whether the cloudfoundry format logs the redacted
+// request line.
+func redactsQuery(conf Staticfile) bool {
+	return conf.Logging != nil && len(conf.Logging.Redact) > 0
+}
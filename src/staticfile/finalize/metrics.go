@@ -0,0 +1,164 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/metrics"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Metrics is the Prometheus listener of the staticfile-metrics process,
+// which the launcher starts next to nginx. It reads stub_status from a unix
+// socket and counts requests from a second access log written to a FIFO.
+type Metrics struct {
+	Port     int
+	Prefixes []string
+	Buckets  []float64
+}
+
+const (
+	// defaultMetricsPort is the port of the nginx Prometheus exporter.
+	defaultMetricsPort = 9113
+	metricsLog         = "nginx/logs/metrics.log"
+	metricsSocket      = "nginx/run/status.sock"
+)
+
+// MetricsTemp is `metrics:`, either a toggle or a mapping of options,
+// which enables it.
+type MetricsTemp struct {
+	Enabled Toggle
+	MetricsOptions
+}
+
+type MetricsOptions struct {
+	Port         MetricsPort     `yaml:"port"`
+	PathPrefixes MetricsPrefixes `yaml:"path_prefixes"`
+	Buckets      MetricsBuckets  `yaml:"buckets"`
+}
+
+func (m *MetricsTemp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled string
+	if err := unmarshal(&enabled); err == nil {
+		m.Enabled = Toggle(enabled)
+		return nil
+	}
+	m.Enabled = "enabled"
+	return unmarshal(&m.MetricsOptions)
+}
+
+func (m MetricsTemp) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind == yaml.MappingNode {
+		return checkNode(node, reflect.TypeOf(MetricsOptions{}), key)
+	}
+	return checkNode(node, reflect.TypeOf(Toggle("")), key)
+}
+
+// MetricsPort is the container port of the metrics listener.
+type MetricsPort string
+
+func (p MetricsPort) checkValue(node *yaml.Node) error {
+	if port, err := strconv.Atoi(node.Value); err != nil || port < 1024 || port > 65535 || port == 8080 {
+		return fmt.Errorf("invalid metrics port %q, expected a port from 1024 to 65535 other than 8080", node.Value)
+	}
+	return nil
+}
+
+// MetricsPrefixes lists the path prefixes requests are counted by.
+type MetricsPrefixes []string
+
+func (p MetricsPrefixes) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !validMetricsPrefix(item.Value) {
+			return nodeError{item, fmt.Sprintf("invalid path prefix %q, expected a path starting with /", item.Value)}
+		}
+	}
+	return nil
+}
+
+func validMetricsPrefix(prefix string) bool {
+	return strings.HasPrefix(prefix, "/") && !strings.ContainsAny(prefix, " \t\"")
+}
+
+// MetricsBuckets lists the upper bounds, in seconds, of the latency
+// histogram buckets.
+type MetricsBuckets []string
+
+func (b MetricsBuckets) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if _, ok := metricsBucket(item.Value); !ok {
+			return nodeError{item, fmt.Sprintf("invalid bucket %q, expected a number of seconds above 0", item.Value)}
+		}
+	}
+	return nil
+}
+
+func metricsBucket(value string) (float64, bool) {
+	bound, err := strconv.ParseFloat(value, 64)
+	return bound, err == nil && bound > 0
+}
+
+func (sf *Finalizer) loadMetrics(rule MetricsTemp) *Metrics {
+	if !rule.Enabled.Enabled() {
+		return nil
+	}
+	m := &Metrics{Port: defaultMetricsPort}
+	if isValid(rule.Port, string(rule.Port)) {
+		m.Port, _ = strconv.Atoi(string(rule.Port))
+	}
+	for _, prefix := range rule.PathPrefixes {
+		if validMetricsPrefix(prefix) {
+			m.Prefixes = append(m.Prefixes, prefix)
+		}
+	}
+	seen := map[float64]bool{}
+	for _, value := range rule.Buckets {
+		if bound, ok := metricsBucket(value); ok && !seen[bound] {
+			seen[bound] = true
+			m.Buckets = append(m.Buckets, bound)
+		}
+	}
+	sort.Float64s(m.Buckets)
+
+	sf.beginStep("metrics", "Serving Prometheus metrics on port %d", m.Port)
+	if len(m.Prefixes) > 0 {
+		sf.Log.Info("Counting requests under %s", strings.Join(m.Prefixes, ", "))
+	}
+	sf.Log.Protip("Map a route to the metrics port to scrape it", "https://docs.cloudfoundry.org/devguide/custom-ports.html")
+	return m
+}
+
+// writeMetricsConfig stages metrics.json for the metrics process.
+func (sf *Finalizer) writeMetricsConfig(confDir string) error {
+	m := sf.Config.Metrics
+	if m == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(sf.BuildDir, filepath.Dir(metricsSocket)), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(metrics.Config{
+		Port:     m.Port,
+		Log:      metricsLog,
+		Status:   metricsSocket,
+		Prefixes: m.Prefixes,
+		Buckets:  m.Buckets,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(confDir, "metrics.json"), data, 0644)
+}
+
+// metricsLogFormat is the log_format of the metrics log.
+func metricsLogFormat() string {
+	return metrics.LogFormat
+}
@@ -0,0 +1,129 @@
+package finalize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// MimeTypeMap is `mime_types:`. A key is a file extension, added to
+// mime.types in place of its default type, or a path starting with /,
+// served with the type whatever its name. A path ending with / covers the
+// files under it.
+type MimeTypeMap map[string]string
+
+var mimeExtensionPattern = regexp.MustCompile(`^\.?[A-Za-z0-9_+-]+$`)
+
+func (m MimeTypeMap) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !validMimeKey(key.Value) {
+			return nodeError{key, fmt.Sprintf("invalid key %q, expected a file extension such as wasm or a path starting with /", key.Value)}
+		}
+		if !mimeTypePattern.MatchString(value.Value) {
+			return nodeError{value, fmt.Sprintf("invalid MIME type %q, expected a type such as text/html", value.Value)}
+		}
+	}
+	return nil
+}
+
+func validMimeKey(key string) bool {
+	if strings.HasPrefix(key, "/") {
+		return !strings.ContainsAny(key, " \t{};\"'")
+	}
+	return mimeExtensionPattern.MatchString(key)
+}
+
+// loadMimeTypes splits `mime_types:` into the extensions merged into
+// mime.types and a location for each path.
+func (sf *Finalizer) loadMimeTypes(types MimeTypeMap) map[string]string {
+	keys := make([]string, 0, len(types))
+	for key := range types {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sf.beginStep("mime_types", "Adding MIME types")
+	extensions := map[string]string{}
+	for _, key := range keys {
+		contentType := types[key]
+		if !validMimeKey(key) || !mimeTypePattern.MatchString(contentType) {
+			continue
+		}
+		if !strings.HasPrefix(key, "/") {
+			ext := strings.ToLower(strings.TrimPrefix(key, "."))
+			extensions[ext] = contentType
+			sf.Log.Info("Serving .%s as %s", ext, contentType)
+			continue
+		}
+
+		match := "= " + key
+		if strings.HasSuffix(key, "/") {
+			match = "^~ " + key
+		}
+		if i := locationIndex(sf.Config.Locations, match); i >= 0 {
+			sf.Config.Locations[i].ContentType = contentType
+		} else {
+			sf.Config.Locations = append(sf.Config.Locations, Location{Match: match, ContentType: contentType})
+		}
+		sf.Log.Info("Serving %s as %s", key, contentType)
+	}
+	sf.Config.Locations = sortLocations(sf.Config.Locations)
+	return extensions
+}
+
+// mergeMimeTypes renders an nginx mime.types file with the types of conf,
+// without the extensions of extensions, followed by extensions. nginx
+// warns about an extension listed twice.
+func mergeMimeTypes(conf string, extensions map[string]string) string {
+	conf = mimeTypesComment.ReplaceAllString(conf, "")
+	start := strings.Index(conf, "{")
+	end := strings.LastIndex(conf, "}")
+	if start < 0 || end < start {
+		start, end = -1, 0
+	}
+
+	var merged strings.Builder
+	merged.WriteString("\ntypes {\n")
+	for _, entry := range strings.Split(conf[start+1:end], ";") {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			continue
+		}
+		var kept []string
+		for _, ext := range fields[1:] {
+			if _, ok := extensions[strings.ToLower(ext)]; !ok {
+				kept = append(kept, ext)
+			}
+		}
+		if len(kept) > 0 {
+			fmt.Fprintf(&merged, "  %s %s;\n", fields[0], strings.Join(kept, " "))
+		}
+	}
+
+	exts := make([]string, 0, len(extensions))
+	for ext := range extensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		fmt.Fprintf(&merged, "  %s %s;\n", extensions[ext], ext)
+	}
+	merged.WriteString("}\n")
+	return merged.String()
+}
+
+// mergeCustomMimeTypes merges mime_types into the mime.types file of the
+// app, which replaces the default one.
+func (sf *Finalizer) mergeCustomMimeTypes(path string) error {
+	custom, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sf.Log.Info("Merging mime_types into the mime.types of the app")
+	return ioutil.WriteFile(path, []byte(mergeMimeTypes(string(custom), sf.Config.MimeTypes)), 0644)
+}
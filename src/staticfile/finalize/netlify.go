@@ -0,0 +1,175 @@
+package finalize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unsupportedNetlifyHeaders are _headers entries Netlify interprets itself
+// instead of sending them.
+var unsupportedNetlifyHeaders = map[string]string{
+	"basic-auth": "use Staticfile.auth for basic authentication",
+}
+
+// parseNetlifyHeaders reads the _headers format: a path line, then its
+// headers indented below it as `Name: value`. In paths, * matches anything
+// and :placeholder one path segment. Values of a repeated header are
+// joined with commas, as Netlify does.
+func parseNetlifyHeaders(source string, data []byte) (HeaderRules, []schemaError) {
+	var rules HeaderRules
+	var problems []schemaError
+	var current *HeaderRule
+
+	for i, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) {
+			problems = append(problems, schemaError{Source: source, Line: i + 1, Column: len(line) - len(strings.TrimLeft(line, " \t")) + 1, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if line == trimmed {
+			current = nil
+			if !strings.HasPrefix(trimmed, "/") {
+				fail("domain-level paths are not supported")
+				continue
+			}
+			rules = append(rules, HeaderRule{Key: netlifyGlob(trimmed), Headers: map[string]string{}})
+			current = &rules[len(rules)-1]
+			continue
+		}
+
+		if current == nil {
+			fail("header without a path")
+			continue
+		}
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			fail("expected Name: value")
+			continue
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if reason, ok := unsupportedNetlifyHeaders[strings.ToLower(name)]; ok {
+			fail("%s is not supported, %s", name, reason)
+			continue
+		}
+		if err := checkHeaderName(name); err != nil {
+			fail("%s", err)
+			continue
+		}
+		if err := checkHeaderValue(value); err != nil {
+			fail("%s", err)
+			continue
+		}
+		if previous, ok := current.Headers[name]; ok {
+			value = previous + ", " + value
+		}
+		current.Headers[name] = value
+	}
+
+	// A rule for every path is cheaper as plain top-level headers.
+	var flattened HeaderRules
+	for _, rule := range rules {
+		if rule.Key != "/**" {
+			flattened = append(flattened, rule)
+			continue
+		}
+		for _, name := range sortedKeys(rule.Headers) {
+			flattened = append(flattened, HeaderRule{Key: name, Value: rule.Headers[name]})
+		}
+	}
+	return flattened, problems
+}
+
+// netlifyGlob translates a _headers path into a `headers:` path glob.
+func netlifyGlob(path string) string {
+	segments := strings.Split(strings.ReplaceAll(path, "*", "**"), "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// configureNetlifyFiles translates _headers and _redirects files staged in
+// public into nginx configuration, and removes them so they are not served.
+// Their rules follow those of the Staticfile.
+func (sf *Finalizer) configureNetlifyFiles() error {
+	publicDir := filepath.Join(sf.BuildDir, "public")
+
+	headersFile := filepath.Join(publicDir, "_headers")
+	if data, err := ioutil.ReadFile(headersFile); err == nil {
+		sf.Log.BeginStep("Translating _headers")
+		rules, problems := parseNetlifyHeaders("_headers", data)
+		sf.logSkipped(problems)
+		sf.Config.Headers = mergeHeaders(sf.Config.Headers, sf.loadHeaders("_headers", rules))
+		if err := os.Remove(headersFile); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	redirectsFile := filepath.Join(publicDir, "_redirects")
+	if data, err := ioutil.ReadFile(redirectsFile); err == nil {
+		if sf.redirectsFile != "" {
+			sf.Log.BeginStep("Ignoring _redirects, the Staticfile imports %s", sf.redirectsFile)
+		} else {
+			sf.Log.BeginStep("Translating _redirects")
+			rules, problems := parseNetlifyRedirects("_redirects", data)
+			sf.logSkipped(problems)
+			for _, rule := range rules {
+				sf.Log.Info("%s -> %s (%d)", rule.From, rule.To, rule.Status)
+			}
+			redirects, err := sf.loadRedirects(append(sf.redirectRules, rules...))
+			if err != nil {
+				return err
+			}
+			sf.Config.Redirects = redirects
+		}
+		if err := os.Remove(redirectsFile); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (sf *Finalizer) logSkipped(problems []schemaError) {
+	for _, problem := range problems {
+		sf.Log.Warning("Skipping %s", problem)
+	}
+}
+
+// mergeHeaders adds headers by name: a top-level value in base wins, and
+// path globs from extra are tried after those of base.
+func mergeHeaders(base, extra []ResponseHeader) []ResponseHeader {
+	merged := append([]ResponseHeader{}, base...)
+	for _, h := range extra {
+		found := false
+		for i := range merged {
+			if !strings.EqualFold(merged[i].Name, h.Name) {
+				continue
+			}
+			found = true
+			if merged[i].Value == "" {
+				merged[i].Value = h.Value
+			}
+			merged[i].Globs = append(merged[i].Globs, h.Globs...)
+			if merged[i].Variable == "" {
+				merged[i].Variable = h.Variable
+			}
+		}
+		if !found {
+			merged = append(merged, h)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,383 @@
+package finalize
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Precompress writes a .gz file, and a .br file with brotli, next to each
+// compressible file in public, which gzip_static and brotli_static serve
+// instead of compressing the file per request.
+type Precompress struct {
+	MinSize int
+	Types   []string
+}
+
+// PrecompressTemp is `precompress:`, either a toggle or a mapping of
+// options. Precompression is off unless the toggle or a mapping enables it,
+// as it adds a .gz and a .br file to the droplet for every asset.
+type PrecompressTemp struct {
+	Enabled Toggle
+	PrecompressOptions
+}
+
+type PrecompressOptions struct {
+	MinSize ByteSize     `yaml:"min_size"`
+	Types   MimeTypeList `yaml:"types"`
+}
+
+func (p *PrecompressTemp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled string
+	if err := unmarshal(&enabled); err == nil {
+		p.Enabled = Toggle(enabled)
+		return nil
+	}
+	p.Enabled = "enabled"
+	return unmarshal(&p.PrecompressOptions)
+}
+
+func (p PrecompressTemp) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind == yaml.MappingNode {
+		return checkNode(node, reflect.TypeOf(PrecompressOptions{}), key)
+	}
+	return checkNode(node, reflect.TypeOf(Toggle("")), key)
+}
+
+// ByteSize is a number of bytes, optionally with a k or m unit.
+type ByteSize string
+
+var byteSizePattern = regexp.MustCompile(`^(\d+)([kKmM]?)$`)
+
+func (s ByteSize) checkValue(node *yaml.Node) error {
+	if !byteSizePattern.MatchString(node.Value) {
+		return fmt.Errorf("invalid size %q, expected a number of bytes or a value such as 512k or 1m", node.Value)
+	}
+	return nil
+}
+
+func (s ByteSize) bytes() int {
+	match := byteSizePattern.FindStringSubmatch(string(s))
+	if match == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	switch strings.ToLower(match[2]) {
+	case "k":
+		n *= 1024
+	case "m":
+		n *= 1024 * 1024
+	}
+	return n
+}
+
+// MimeTypeList holds MIME types such as text/html.
+type MimeTypeList []string
+
+var mimeTypePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.+-]*/[a-z0-9][a-z0-9.+-]*$`)
+
+func (l MimeTypeList) checkValue(node *yaml.Node) error {
+	for _, item := range node.Content {
+		if !mimeTypePattern.MatchString(item.Value) {
+			return nodeError{item, fmt.Sprintf("invalid MIME type %q, expected a type such as text/html", item.Value)}
+		}
+	}
+	return nil
+}
+
+func (l MimeTypeList) valid() []string {
+	var types []string
+	for _, t := range l {
+		if mimeTypePattern.MatchString(t) {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// loadPrecompress defaults to the threshold and types of compression, plus
+// text/html.
+func (sf *Finalizer) loadPrecompress(rule PrecompressTemp, compression *Compression) *Precompress {
+	if !rule.Enabled.Enabled() {
+		return nil
+	}
+	p := &Precompress{MinSize: compression.MinLength, Types: append([]string{"text/html"}, compression.Types...)}
+	if isValid(rule.MinSize, string(rule.MinSize)) {
+		p.MinSize = rule.MinSize.bytes()
+	}
+	if types := rule.Types.valid(); len(types) > 0 {
+		p.Types = types
+	}
+	return p
+}
+
+// encoding is a compressed variant of the files in public.
+type encoding struct {
+	ext    string
+	writer func(io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	gzipEncoding = encoding{".gz", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	}}
+	brotliEncoding = encoding{".br", func(w io.Writer) (io.WriteCloser, error) {
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	}}
+)
+
+// Precompress compresses the files in public that nginx serves with one of
+// the configured types, at the highest level. A .gz or .br file the app
+// ships is left alone. The results are kept in the cache dir, keyed by
+// content, so that unchanged files are not compressed again on the next
+// push.
+func (sf *Finalizer) Precompress() error {
+	p := sf.Config.Precompress
+	if p == nil {
+		return nil
+	}
+	sf.beginStep("precompress", "Precompressing assets in public")
+
+	encodings := []encoding{gzipEncoding}
+	if sf.Config.Brotli != nil {
+		encodings = append(encodings, brotliEncoding)
+	}
+
+	mimeTypes, err := ioutil.ReadFile(filepath.Join(sf.BuildDir, "nginx", "conf", "mime.types"))
+	if err != nil {
+		return err
+	}
+	extensions := map[string]bool{}
+	compressible := map[string]bool{}
+	for _, t := range p.Types {
+		compressible[t] = true
+	}
+	for ext, t := range parseMimeTypes(string(mimeTypes)) {
+		if compressible[t] {
+			extensions[ext] = true
+		}
+	}
+
+	var jobs []compressJob
+	shipped := map[string]int{}
+	compression := compressionOf(sf.Config)
+	publicDir := filepath.Join(sf.BuildDir, "public")
+	err = filepath.Walk(publicDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || info.Size() < int64(p.MinSize) {
+			return err
+		}
+		if rel, err := filepath.Rel(publicDir, path); err == nil && compression.excluded("/"+filepath.ToSlash(rel)) {
+			return nil
+		}
+		if !extensions[strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))] {
+			return nil
+		}
+		for _, e := range encodings {
+			if _, err := os.Lstat(path + e.ext); err == nil {
+				shipped[e.ext]++
+				continue
+			}
+			jobs = append(jobs, compressJob{path, e})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cacheDir := ""
+	if sf.CacheDir != "" {
+		cacheDir = filepath.Join(sf.CacheDir, "precompress")
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return err
+		}
+	}
+	c := &compressor{cacheDir: cacheDir, used: map[string]bool{}, written: map[string]int{}, hits: map[string]int{}}
+	if err := c.run(jobs); err != nil {
+		return err
+	}
+	if err := c.prune(); err != nil {
+		return err
+	}
+
+	for _, e := range encodings {
+		sf.Log.Info("Wrote %d %s files, %d of them from the cache", c.written[e.ext], e.ext, c.hits[e.ext])
+		if shipped[e.ext] > 0 {
+			sf.Log.Info("Kept %d %s files shipped with the app", shipped[e.ext], e.ext)
+		}
+	}
+	return nil
+}
+
+type compressJob struct {
+	path     string
+	encoding encoding
+}
+
+// compressor compresses files on every CPU.
+type compressor struct {
+	cacheDir string
+
+	mu      sync.Mutex
+	used    map[string]bool
+	written map[string]int
+	hits    map[string]int
+}
+
+func (c *compressor) run(jobs []compressJob) error {
+	queue := make(chan compressJob)
+	errs := make(chan error, len(jobs))
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := c.compress(job.path, job.encoding); err != nil {
+					errs <- fmt.Errorf("%s: %s", job.path, err)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// compress writes the encoded file next to path, unless it would not be
+// smaller than path.
+func (c *compressor) compress(path string, e encoding) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:]) + e.ext
+
+	var compressed []byte
+	hit := false
+	if c.cacheDir != "" {
+		if cached, err := ioutil.ReadFile(filepath.Join(c.cacheDir, key)); err == nil {
+			compressed, hit = cached, true
+		}
+	}
+	if !hit {
+		buffer := new(bytes.Buffer)
+		w, err := e.writer(buffer)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		compressed = buffer.Bytes()
+		if c.cacheDir != "" {
+			if err := c.store(key, compressed); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.used[key] = true
+	c.mu.Unlock()
+	if len(compressed) >= len(data) {
+		return nil
+	}
+	if err := ioutil.WriteFile(path+e.ext, compressed, 0644); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written[e.ext]++
+	if hit {
+		c.hits[e.ext]++
+	}
+	return nil
+}
+
+// store caches compressed under key. Identical files share a key, so it is
+// renamed into place for the other workers never to read it half written.
+func (c *compressor) store(key string, compressed []byte) error {
+	f, err := ioutil.TempFile(c.cacheDir, key+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(compressed)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(c.cacheDir, key))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// prune removes the cached files no longer in public.
+func (c *compressor) prune() error {
+	if c.cacheDir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(c.cacheDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !c.used[entry.Name()] {
+			if err := os.Remove(filepath.Join(c.cacheDir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var mimeTypesComment = regexp.MustCompile(`#[^\n]*`)
+
+// parseMimeTypes maps the extensions of an nginx mime.types file to their
+// types.
+func parseMimeTypes(conf string) map[string]string {
+	types := map[string]string{}
+	conf = mimeTypesComment.ReplaceAllString(conf, "")
+	start := strings.Index(conf, "{")
+	end := strings.LastIndex(conf, "}")
+	if start < 0 || end < start {
+		return types
+	}
+	for _, entry := range strings.Split(conf[start+1:end], ";") {
+		fields := strings.Fields(entry)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			types[strings.ToLower(ext)] = fields[0]
+		}
+	}
+	return types
+}
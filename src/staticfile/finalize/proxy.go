@@ -0,0 +1,302 @@
+package finalize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	yaml2 "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Proxy forwards a path prefix to an upstream URL. It is rendered as a
+// location block that keeps the top-level basic_auth, HSTS and response
+// headers, but serves nothing from public. A TLSTrustedCertificate in the
+// app directory is staged next to nginx.conf.
+type Proxy struct {
+	Upstream              string
+	ConnectTimeout        string
+	ReadTimeout           string
+	Host                  string
+	SetHeaders            map[string]string
+	RemoveHeaders         []string
+	WebSocket             bool
+	Buffering             bool
+	RequestBuffering      bool
+	TLS                   bool
+	TLSVerify             bool
+	TLSVerifyDepth        int
+	TLSServerName         string
+	TLSTrustedCertificate string
+	ClientCertificate     string
+	ClientCertificateKey  string
+	Service               *ServiceBinding
+}
+
+type ProxyTemp struct {
+	Upstream              Upstream     `yaml:"upstream"`
+	ConnectTimeout        Duration     `yaml:"connect_timeout"`
+	ReadTimeout           Duration     `yaml:"read_timeout"`
+	Host                  string       `yaml:"host"`
+	SetHeaders            HeaderValues `yaml:"set_headers"`
+	RemoveHeaders         HeaderNames  `yaml:"remove_headers"`
+	WebSocket             Toggle       `yaml:"websocket"`
+	Buffering             Toggle       `yaml:"buffering"`
+	RequestBuffering      Toggle       `yaml:"request_buffering"`
+	TLSVerify             Toggle       `yaml:"tls_verify"`
+	TLSVerifyDepth        VerifyDepth  `yaml:"tls_verify_depth"`
+	TLSServerName         string       `yaml:"tls_server_name"`
+	TLSTrustedCertificate CertFile     `yaml:"tls_trusted_certificate"`
+}
+
+// Upstream is an http or https URL or, written as a mapping, a reference
+// to a bound service that holds the URL. As with proxy_pass, a path in the
+// URL replaces the proxied prefix.
+type Upstream struct {
+	URL string
+	ServiceRef
+}
+
+func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&u.URL); err == nil {
+		return nil
+	}
+	return unmarshal(&u.ServiceRef)
+}
+
+func (u Upstream) isSet() bool {
+	return u.URL != "" || u.ServiceRef != ServiceRef{}
+}
+
+func (u Upstream) String() string {
+	if u.URL != "" {
+		return u.URL
+	}
+	return u.ServiceRef.String()
+}
+
+func (u Upstream) checkNode(node *yaml.Node, key string) []schemaError {
+	if node.Kind == yaml.MappingNode {
+		return checkNode(node, reflect.TypeOf(ServiceRef{}), key)
+	}
+	if node.Kind == yaml.ScalarNode {
+		if err := checkUpstream(node.Value); err != nil {
+			return []schemaError{{Line: node.Line, Column: node.Column, Message: fmt.Sprintf("%s: %s", key, err)}}
+		}
+		return nil
+	}
+	return []schemaError{{Line: node.Line, Column: node.Column, Message: key + ": expected a URL or a service reference"}}
+}
+
+func checkUpstream(upstream string) error {
+	parsed, err := url.Parse(upstream)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid upstream %q, expected an http:// or https:// URL", upstream)
+	}
+	if strings.ContainsAny(upstream, " \t;{}") {
+		return fmt.Errorf("invalid upstream %q", upstream)
+	}
+	return nil
+}
+
+// VerifyDepth is proxy_ssl_verify_depth, how many certificates may stand
+// between the upstream certificate and a trusted CA.
+type VerifyDepth string
+
+// defaultVerifyDepth allows an upstream chain with intermediate CAs, which
+// the nginx default of 1 rejects.
+const defaultVerifyDepth = 3
+
+func (d VerifyDepth) checkValue(node *yaml.Node) error {
+	if n, err := strconv.Atoi(node.Value); err != nil || n < 1 || n > 10 {
+		return fmt.Errorf("invalid verify depth %q, expected a number from 1 to 10", node.Value)
+	}
+	return nil
+}
+
+// HeaderNames lists request headers by name.
+type HeaderNames []string
+
+func (h HeaderNames) checkValue(node *yaml.Node) error {
+	for _, name := range node.Content {
+		if !headerNamePattern.MatchString(name.Value) {
+			return nodeError{name, fmt.Sprintf("invalid header name %q", name.Value)}
+		}
+	}
+	return nil
+}
+
+type ProxyRule struct {
+	Prefix string
+	ProxyTemp
+}
+
+// ProxyRules is the `proxy:` mapping of path prefixes to upstreams.
+type ProxyRules []ProxyRule
+
+func (p *ProxyRules) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var order yaml2.MapSlice
+	if err := unmarshal(&order); err != nil {
+		return err
+	}
+	var rules map[string]ProxyTemp
+	if err := unmarshal(&rules); err != nil {
+		return err
+	}
+
+	*p = nil
+	for _, item := range order {
+		prefix := fmt.Sprint(item.Key)
+		*p = append(*p, ProxyRule{Prefix: prefix, ProxyTemp: rules[prefix]})
+	}
+	return nil
+}
+
+func (p ProxyRules) mapValueType() reflect.Type {
+	return reflect.TypeOf(ProxyTemp{})
+}
+
+func (p ProxyRules) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if err := checkProxyPrefix(key.Value); err != nil {
+			return nodeError{key, err.Error()}
+		}
+		var rule ProxyTemp
+		if err := value.Decode(&rule); err == nil && !rule.Upstream.isSet() {
+			return nodeError{key, fmt.Sprintf("proxy %s needs an upstream", key.Value)}
+		}
+	}
+	return nil
+}
+
+func checkProxyPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, " \t;{}\"'") {
+		return fmt.Errorf("invalid proxy path %q, expected a path prefix starting with /", prefix)
+	}
+	if prefix == "/" {
+		return fmt.Errorf("proxying / would hide every file in public")
+	}
+	return nil
+}
+
+// CertFile is a PEM file in the app directory or, with an absolute path, on
+// the stack.
+type CertFile string
+
+func (f CertFile) checkValue(node *yaml.Node) error {
+	if strings.ContainsAny(node.Value, `"\;{}`) || strings.Contains(node.Value, "<%") || strings.IndexFunc(node.Value, isControl) >= 0 ||
+		!filepath.IsAbs(node.Value) && strings.HasPrefix(filepath.Clean(node.Value), "..") {
+		return fmt.Errorf("invalid certificate file %q, expected an absolute path or a path inside the app directory", node.Value)
+	}
+	return nil
+}
+
+// stageCertFile reads a certificate file of the app, which is staged as
+// nginx/conf/<name> rather than served from public.
+func (sf *Finalizer) stageCertFile(source string) (string, error) {
+	if file, ok := sf.certFiles[source]; ok {
+		return file.Name, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(sf.BuildDir, source))
+	if err != nil {
+		return "", err
+	}
+	name := "trusted-" + unsafeFileChars.ReplaceAllString(filepath.ToSlash(filepath.Clean(source)), "_")
+	sf.certFiles[source] = stagedFile{Name: name, Data: data}
+	return name, nil
+}
+
+// caCertificates is the CA bundle of the cflinuxfs stacks, used to verify
+// HTTPS upstreams without a tls_trusted_certificate.
+const caCertificates = "/etc/ssl/certs/ca-certificates.crt"
+
+// loadProxies adds `proxy:` to the location blocks, matched with ^~ so the
+// regex locations of the Staticfile do not take their requests. A proxy
+// replaces a location with the same path.
+func (sf *Finalizer) loadProxies(rules ProxyRules, locations []Location) []Location {
+	sf.certFiles = map[string]stagedFile{}
+	bound := 0
+	for _, rule := range rules {
+		if checkProxyPrefix(rule.Prefix) != nil {
+			continue
+		}
+		if rule.Upstream.URL != "" && checkUpstream(rule.Upstream.URL) != nil {
+			continue
+		}
+		if rule.Upstream.URL == "" && rule.Upstream.ServiceRef.check() != nil {
+			continue
+		}
+
+		proxy := Proxy{
+			Upstream:              rule.Upstream.URL,
+			ConnectTimeout:        string(rule.ConnectTimeout),
+			ReadTimeout:           string(rule.ReadTimeout),
+			SetHeaders:            rule.SetHeaders,
+			RemoveHeaders:         rule.RemoveHeaders,
+			WebSocket:             rule.WebSocket.Enabled(),
+			Buffering:             rule.Buffering == "" || rule.Buffering.Enabled(),
+			RequestBuffering:      rule.RequestBuffering == "" || rule.RequestBuffering.Enabled(),
+			TLS:                   strings.HasPrefix(rule.Upstream.URL, "https://"),
+			TLSVerify:             rule.TLSVerify == "" || rule.TLSVerify.Enabled(),
+			TLSVerifyDepth:        defaultVerifyDepth,
+			TLSServerName:         rule.TLSServerName,
+			TLSTrustedCertificate: caCertificates,
+		}
+		switch rule.Host {
+		case "", "upstream":
+			proxy.Host = "$proxy_host"
+		case "client":
+			proxy.Host = "$best_host"
+		default:
+			proxy.Host = nginxQuote(rule.Host)
+		}
+		if isValid(rule.TLSVerifyDepth, string(rule.TLSVerifyDepth)) {
+			proxy.TLSVerifyDepth, _ = strconv.Atoi(string(rule.TLSVerifyDepth))
+		}
+		if cert := string(rule.TLSTrustedCertificate); cert != "" && isValid(rule.TLSTrustedCertificate, cert) {
+			if filepath.IsAbs(cert) {
+				proxy.TLSTrustedCertificate = cert
+			} else if name, err := sf.stageCertFile(cert); err != nil {
+				sf.Log.Warning("Unable to read the tls_trusted_certificate of proxy %s, verifying with the CA bundle of the stack: %s", rule.Prefix, err)
+			} else {
+				proxy.TLSTrustedCertificate = `<%= ENV["APP_ROOT"] %>/nginx/conf/` + name
+			}
+		}
+
+		if rule.Upstream.URL == "" {
+			bindProxyService(&proxy, rule.Prefix, rule.Upstream.ServiceRef, bound)
+			bound++
+		}
+
+		sf.beginStep("proxy", "Enabling proxy from %s to %s", rule.Prefix, rule.Upstream)
+		if proxy.TLS && !proxy.TLSVerify {
+			sf.Log.Warning("TLS verification is disabled for the proxy from %s to %s", rule.Prefix, rule.Upstream)
+		}
+		kept := locations[:0]
+		for _, l := range locations {
+			if modifier, path := splitLocationMatch(l.Match); path == rule.Prefix && (modifier == "" || modifier == "^~") {
+				sf.Log.Warning("proxy %s replaces the location %s", rule.Prefix, l.Match)
+				continue
+			}
+			kept = append(kept, l)
+		}
+		locations = append(kept, Location{Match: "^~ " + rule.Prefix, Proxy: &proxy})
+	}
+	return sortLocations(locations)
+}
+
+// hasWebSocketProxy reports whether nginx.conf needs the Connection header
+// map for WebSocket upgrades.
+func hasWebSocketProxy(locations []Location) bool {
+	for _, l := range locations {
+		if l.Proxy != nil && l.Proxy.WebSocket {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,487 @@
+package finalize
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Redirect is a `redirects:` rule. Status 200 rewrites the request
+// internally instead of redirecting. A rule that is not forced only applies
+// when no file exists at the requested path.
+type Redirect struct {
+	From          string
+	To            string
+	Status        int
+	Match         string
+	PreserveQuery bool
+	Force         bool
+}
+
+// IsRewrite reports whether the rule serves To without redirecting.
+func (r Redirect) IsRewrite() bool {
+	return r.Status == 200
+}
+
+// Regex is the regular expression a prefix or regex rule matches $uri
+// against.
+func (r Redirect) Regex() string {
+	if r.Match == "prefix" {
+		return "^" + regexp.QuoteMeta(r.From) + "(.*)$"
+	}
+	return r.From
+}
+
+// Subject is what the rule matches: $uri, prefixed with a marker when a
+// file exists at the path and the rule is not forced.
+func (r Redirect) Subject() string {
+	if r.Force {
+		return "$uri"
+	}
+	return "$staticfile_shadow$uri"
+}
+
+// Target is the rewrite or redirect destination, carrying over the query
+// string unless preserve_query is disabled.
+func (r Redirect) Target() string {
+	target := r.To
+	if r.Match == "prefix" {
+		target += "$1"
+	}
+	switch {
+	case r.IsRewrite() && !r.PreserveQuery:
+		return target + "?"
+	case !r.IsRewrite() && r.PreserveQuery && !strings.Contains(r.To, "?"):
+		return target + "$is_args$args"
+	}
+	return target
+}
+
+// RedirectRules is the `redirects:` list.
+type RedirectRules []RedirectRule
+
+type RedirectRule struct {
+	From          string `yaml:"from"`
+	To            string `yaml:"to"`
+	Status        int    `yaml:"status"`
+	Match         string `yaml:"match"`
+	PreserveQuery Toggle `yaml:"preserve_query"`
+	Force         Toggle `yaml:"force"`
+}
+
+func (r RedirectRule) checkValue(node *yaml.Node) error {
+	var rule RedirectRule
+	if err := node.Decode(&rule); err != nil {
+		return err
+	}
+	return checkRedirect(rule)
+}
+
+var redirectStatuses = map[int]bool{200: true, 301: true, 302: true, 303: true, 307: true, 308: true}
+
+func checkRedirect(rule RedirectRule) error {
+	if rule.From == "" || rule.To == "" {
+		return fmt.Errorf("a redirect needs both from and to")
+	}
+	if rule.Status != 0 && !redirectStatuses[rule.Status] {
+		return fmt.Errorf("invalid status %d, expected one of 200, 301, 302, 303, 307, 308", rule.Status)
+	}
+
+	switch rule.Match {
+	case "", "exact", "prefix":
+		if !strings.HasPrefix(rule.From, "/") {
+			return fmt.Errorf("redirect from %q must start with /", rule.From)
+		}
+	case "regex":
+		if err := checkRegex(rule.From); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid match %q, expected one of exact, prefix, regex", rule.Match)
+	}
+
+	if rule.Status == 200 && !strings.HasPrefix(rule.To, "/") {
+		return fmt.Errorf("rewrite to %q must start with /", rule.To)
+	}
+	if !strings.HasPrefix(rule.To, "/") && !strings.HasPrefix(rule.To, "http://") && !strings.HasPrefix(rule.To, "https://") {
+		return fmt.Errorf("redirect to %q must start with /, http:// or https://", rule.To)
+	}
+	if strings.ContainsAny(rule.From+rule.To, " \t\r\n") {
+		return fmt.Errorf("redirect from %q to %q contains whitespace", rule.From, rule.To)
+	}
+	return nil
+}
+
+// readRedirectsFile imports rules from `redirects_file:`, a CSV file with
+// from,to,status,match columns or a Netlify-style _redirects file.
+func (sf *Finalizer) readRedirectsFile(path string) (RedirectRules, []schemaError) {
+	data, err := ioutil.ReadFile(filepath.Join(sf.BuildDir, path))
+	if os.IsNotExist(err) {
+		return nil, []schemaError{{Source: "Staticfile", Message: fmt.Sprintf("redirects_file: %s does not exist", path)}}
+	} else if err != nil {
+		return nil, []schemaError{{Source: path, Message: err.Error()}}
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return parseRedirectsCSV(path, data)
+	}
+	return parseNetlifyRedirects(path, data)
+}
+
+func parseRedirectsCSV(source string, data []byte) (RedirectRules, []schemaError) {
+	var rules RedirectRules
+	var problems []schemaError
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problems = append(problems, schemaError{Source: source, Message: err.Error()})
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if first && strings.EqualFold(record[0], "from") {
+			continue
+		}
+
+		rule := RedirectRule{From: record[0]}
+		if len(record) > 1 {
+			rule.To = record[1]
+		}
+		if len(record) > 2 && record[2] != "" {
+			if rule.Status, err = strconv.Atoi(record[2]); err != nil {
+				problems = append(problems, schemaError{Source: source, Line: line, Column: 1, Message: fmt.Sprintf("invalid status %q", record[2])})
+				continue
+			}
+		}
+		if len(record) > 3 {
+			rule.Match = record[3]
+		}
+
+		if err := checkRedirect(rule); err != nil {
+			problems = append(problems, schemaError{Source: source, Line: line, Column: 1, Message: err.Error()})
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, problems
+}
+
+var (
+	netlifyStatus      = regexp.MustCompile(`^(\d{3})(!?)$`)
+	netlifyPlaceholder = regexp.MustCompile(`^:[A-Za-z0-9_]+`)
+)
+
+// parseNetlifyRedirects reads the _redirects format: `from to [status][!]`
+// per line, where from may hold :placeholders and a trailing * splat that
+// to refers to as :splat. Rules are only forced with a trailing !.
+func parseNetlifyRedirects(source string, data []byte) (RedirectRules, []schemaError) {
+	var rules RedirectRules
+	var problems []schemaError
+
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fail := func(format string, args ...interface{}) {
+			problems = append(problems, schemaError{Source: source, Line: i + 1, Column: 1, Message: fmt.Sprintf(format, args...)})
+		}
+
+		if len(fields) < 2 {
+			fail("expected from and to")
+			continue
+		}
+		if strings.Contains(fields[1], "=") {
+			fail("query parameter matching is not supported")
+			continue
+		}
+		if !strings.HasPrefix(fields[0], "/") {
+			fail("domain-level redirects are not supported")
+			continue
+		}
+
+		rule := RedirectRule{From: fields[0], To: fields[1], Status: 301, Force: "disabled"}
+		for _, option := range fields[2:] {
+			if strings.HasPrefix(option, "#") {
+				break
+			}
+			match := netlifyStatus.FindStringSubmatch(option)
+			if match == nil {
+				fail("unsupported option %q", option)
+				rule = RedirectRule{}
+				break
+			}
+			rule.Status, _ = strconv.Atoi(match[1])
+			if match[2] == "!" {
+				rule.Force = "enabled"
+			}
+		}
+		if rule.From == "" {
+			continue
+		}
+
+		rule.From, rule.To = netlifyPattern(rule.From, rule.To)
+		if rule.From != fields[0] {
+			rule.Match = "regex"
+		}
+		if err := checkRedirect(rule); err != nil {
+			fail("%s", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules, problems
+}
+
+// netlifyPattern translates a _redirects path with placeholders or a splat
+// into an anchored regex, and their names in to into captures. Paths
+// without either are returned unchanged.
+func netlifyPattern(from, to string) (string, string) {
+	if !strings.Contains(from, "*") && !strings.Contains(from, "/:") {
+		return from, to
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	captures := map[string]int{}
+	for i := 0; i < len(from); i++ {
+		switch {
+		case from[i] == '*':
+			captures["splat"] = len(captures) + 1
+			re.WriteString("(.*)")
+		case from[i] == ':' && i > 0 && from[i-1] == '/':
+			name := netlifyPlaceholder.FindString(from[i:])
+			if name == "" {
+				re.WriteString(":")
+				continue
+			}
+			captures[name[1:]] = len(captures) + 1
+			re.WriteString("([^/]+)")
+			i += len(name) - 1
+		default:
+			re.WriteString(regexp.QuoteMeta(from[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+
+	names := make([]string, 0, len(captures))
+	for name := range captures {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, name := range names {
+		to = strings.ReplaceAll(to, ":"+name, fmt.Sprintf("$%d", captures[name]))
+	}
+	return re.String(), to
+}
+
+func (sf *Finalizer) loadRedirects(rules RedirectRules) ([]Redirect, error) {
+	var redirects []Redirect
+	for _, rule := range rules {
+		if checkRedirect(rule) != nil {
+			continue
+		}
+		redirect := Redirect{
+			From:          rule.From,
+			To:            rule.To,
+			Status:        rule.Status,
+			Match:         rule.Match,
+			PreserveQuery: rule.PreserveQuery == "" || rule.PreserveQuery.Enabled(),
+			Force:         rule.Force == "" || rule.Force.Enabled(),
+		}
+		if redirect.Status == 0 {
+			redirect.Status = 301
+		}
+		if redirect.Match == "" {
+			redirect.Match = "exact"
+		}
+		redirects = append(redirects, redirect)
+	}
+
+	sf.beginStep("redirects", "Enabling %d redirect and rewrite rules", len(redirects))
+
+	if loops := redirectLoops(redirects); len(loops) > 0 {
+		if sf.Config.Strict {
+			return nil, fmt.Errorf("the redirects loop:\n  %s", strings.Join(loops, "\n  "))
+		}
+		for _, loop := range loops {
+			sf.Log.Warning("redirect loop: %s", loop)
+		}
+	}
+	return redirects, nil
+}
+
+// redirectLoops follows the redirects from every exact and prefix rule and
+// describes each chain that comes back to a path it already visited.
+// Rewrites end a chain, since nginx applies server rewrites only once.
+func redirectLoops(redirects []Redirect) []string {
+	exact := map[string]Redirect{}
+	var patterns []Redirect
+	var compiled []*regexp.Regexp
+	for _, r := range redirects {
+		if r.Match == "exact" {
+			if _, ok := exact[r.From]; !ok {
+				exact[r.From] = r
+			}
+			continue
+		}
+		if re, err := regexp.Compile(r.Regex()); err == nil {
+			patterns = append(patterns, r)
+			compiled = append(compiled, re)
+		}
+	}
+
+	next := func(uri string) (string, bool) {
+		if r, ok := exact[uri]; ok {
+			return r.To, !r.IsRewrite()
+		}
+		for i, r := range patterns {
+			if match := compiled[i].FindStringSubmatchIndex(uri); match != nil {
+				to := r.To
+				if r.Match == "prefix" {
+					to += "${1}"
+				}
+				to = regexp.MustCompile(`\$(\d)`).ReplaceAllString(to, "$${$1}")
+				return string(compiled[i].ExpandString(nil, to, uri, match)), !r.IsRewrite()
+			}
+		}
+		return "", false
+	}
+
+	var loops []string
+	reported := map[string]bool{}
+	for _, r := range redirects {
+		start := r.From
+		if r.Match == "regex" {
+			continue
+		} else if r.Match == "prefix" {
+			start += "loop-check"
+		}
+
+		chain := []string{start}
+		visited := map[string]bool{start: true}
+		for uri := start; len(chain) <= 20; {
+			to, redirected := next(uri)
+			if !redirected || !strings.HasPrefix(to, "/") {
+				break
+			}
+			uri = strings.SplitN(to, "?", 2)[0]
+			chain = append(chain, uri)
+			if visited[uri] {
+				if !reported[uri] {
+					for _, u := range chain {
+						reported[u] = true
+					}
+					loops = append(loops, strings.Join(chain, " -> "))
+				}
+				break
+			}
+			visited[uri] = true
+		}
+	}
+	return loops
+}
+
+// redirectMap is a `map $uri` holding the exact rules that share a status
+// and force, so nginx looks them up in a hash instead of testing each. The
+// first rule for a path wins, as it would for a chain of if blocks.
+type redirectMap struct {
+	Variable string
+	Subject  string
+	Status   int
+	Rewrite  bool
+	Entries  []HeaderGlob
+}
+
+func redirectMaps(redirects []Redirect) []redirectMap {
+	var maps []redirectMap
+	index := map[string]int{}
+	seen := map[string]bool{}
+	for _, r := range redirects {
+		if r.Match != "exact" {
+			continue
+		}
+		variable := fmt.Sprintf("$staticfile_redirect_%d", r.Status)
+		if !r.Force {
+			variable += "_unforced"
+		}
+		i, ok := index[variable]
+		if !ok {
+			i = len(maps)
+			index[variable] = i
+			maps = append(maps, redirectMap{Variable: variable, Subject: r.Subject(), Status: r.Status, Rewrite: r.IsRewrite()})
+		}
+		if seen[variable+" "+r.From] {
+			continue
+		}
+		seen[variable+" "+r.From] = true
+		maps[i].Entries = append(maps[i].Entries, HeaderGlob{Pattern: r.From, Value: r.Target()})
+	}
+	return maps
+}
+
+// hasUnforcedRedirects reports whether nginx.conf must check for a file at
+// the requested path before applying redirects.
+func hasUnforcedRedirects(redirects []Redirect) bool {
+	for _, r := range redirects {
+		if !r.Force {
+			return true
+		}
+	}
+	return false
+}
+
+type mapHashSize struct {
+	MaxSize    int
+	BucketSize int
+}
+
+// mapHash sizes the hash nginx builds for exact map keys: fingerprinted
+// assets from `caching:` and exact redirects. It is nil when no map has
+// exact keys and the nginx defaults do.
+func mapHash(config Staticfile) *mapHashSize {
+	var keys []string
+	for _, h := range config.Headers {
+		for _, glob := range h.Globs {
+			if glob.Regex == "" {
+				keys = append(keys, glob.Pattern)
+			}
+		}
+	}
+	for _, m := range redirectMaps(config.Redirects) {
+		for _, entry := range m.Entries {
+			keys = append(keys, entry.Pattern)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	size := &mapHashSize{MaxSize: 2048, BucketSize: 256}
+	if 4*len(keys) > size.MaxSize {
+		size.MaxSize = 4 * len(keys)
+	}
+	for _, key := range keys {
+		for len(key)+2*8 > size.BucketSize {
+			size.BucketSize *= 2
+		}
+	}
+	return size
+}
@@ -0,0 +1,337 @@
+package finalize
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Toggle is an on/off Staticfile directive. It accepts enabled/disabled,
+// true/false and on/off; visible/hidden are kept for the documented
+// `directory: visible`.
+type Toggle string
+
+var toggleValues = map[string]bool{
+	"enabled":  true,
+	"true":     true,
+	"on":       true,
+	"visible":  true,
+	"disabled": false,
+	"false":    false,
+	"off":      false,
+	"hidden":   false,
+}
+
+func (t Toggle) Enabled() bool {
+	return toggleValues[strings.ToLower(string(t))]
+}
+
+// UnmarshalYAML leaves a toggle the schema rejects unset, so that yaml.v2
+// does not read YAML 1.1 values such as yes and no as a setting.
+func (t *Toggle) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*t = ""
+	if _, ok := toggleValues[strings.ToLower(value)]; ok {
+		*t = Toggle(value)
+	}
+	return nil
+}
+
+func (t Toggle) checkValue(node *yaml.Node) error {
+	if _, ok := toggleValues[strings.ToLower(node.Value)]; !ok {
+		return fmt.Errorf("invalid value %q, expected one of enabled, disabled, true, false, on, off, visible, hidden", node.Value)
+	}
+	return nil
+}
+
+// StatusCodes maps an HTTP status code (or 4xx/5xx) to a custom error page.
+type StatusCodes map[string]string
+
+func (s StatusCodes) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if _, err := parseStatusCodes(node.Content[i].Value); err != nil {
+			return nodeError{node.Content[i], err.Error()}
+		}
+	}
+	return nil
+}
+
+var (
+	clientErrorCodes = []string{"400", "401", "402", "403", "404", "405", "406", "407", "408", "409", "410", "411", "412", "413", "414", "415", "416", "417", "418", "421", "422", "423", "424", "426", "428", "429", "431", "451"}
+	serverErrorCodes = []string{"500", "501", "502", "503", "504", "505", "506", "507", "508", "510", "511"}
+)
+
+// parseStatusCodes reads a status_codes key, one or more codes from 300 to
+// 599 or 4xx/5xx separated by spaces or commas, into the codes error_page
+// takes. The schema and the renderer both read keys with it.
+func parseStatusCodes(key string) ([]string, error) {
+	fields := strings.FieldsFunc(key, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid status code %q", key)
+	}
+	var codes []string
+	seen := map[string]bool{}
+	add := func(code string) {
+		if !seen[code] {
+			seen[code] = true
+			codes = append(codes, code)
+		}
+	}
+	for _, field := range fields {
+		switch strings.ToLower(field) {
+		case "4xx":
+			for _, code := range clientErrorCodes {
+				add(code)
+			}
+		case "5xx":
+			for _, code := range serverErrorCodes {
+				add(code)
+			}
+		default:
+			if n, err := strconv.Atoi(field); err != nil || n < 300 || n > 599 {
+				return nil, fmt.Errorf("invalid status code %q", key)
+			}
+			add(field)
+		}
+	}
+	return codes, nil
+}
+
+// valueChecker is implemented by Staticfile value types that need more
+// than a shape check.
+type valueChecker interface {
+	checkValue(node *yaml.Node) error
+}
+
+// orderedMapping is implemented by list types that are written as a YAML
+// mapping to keep the order of their keys.
+type orderedMapping interface {
+	mapValueType() reflect.Type
+}
+
+// nodeChecker is implemented by Staticfile value types whose YAML shape
+// checkNode cannot describe, such as mappings mixing values and sections.
+type nodeChecker interface {
+	checkNode(node *yaml.Node, key string) []schemaError
+}
+
+// nodeError points a checkValue failure at a node nested inside the
+// checked value.
+type nodeError struct {
+	node    *yaml.Node
+	message string
+}
+
+func (e nodeError) Error() string {
+	return e.message
+}
+
+type schemaError struct {
+	Source  string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e schemaError) String() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.Source, e.Message)
+	}
+	return fmt.Sprintf("%s line %d, column %d: %s", e.Source, e.Line, e.Column, e.Message)
+}
+
+// validateStaticfile checks the Staticfile against the StaticfileTemp
+// schema. It parses the file a second time with yaml.v3 because the
+// libbuildpack loader does not expose line and column information.
+func validateStaticfile(path string) ([]schemaError, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return validateYAML("Staticfile", data, reflect.TypeOf(StaticfileTemp{}))
+}
+
+func validateYAML(source string, data []byte, t reflect.Type) ([]schemaError, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	errs := checkNode(doc.Content[0], t, "")
+	for i := range errs {
+		errs[i].Source = source
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Column < errs[j].Column
+	})
+	return errs, nil
+}
+
+func checkNode(node *yaml.Node, t reflect.Type, key string) []schemaError {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+		return nil
+	}
+
+	fail := func(format string, args ...interface{}) []schemaError {
+		msg := fmt.Sprintf(format, args...)
+		if key != "" {
+			msg = fmt.Sprintf("%s: %s", key, msg)
+		}
+		return []schemaError{{Line: node.Line, Column: node.Column, Message: msg}}
+	}
+
+	if checker, ok := reflect.Zero(t).Interface().(nodeChecker); ok {
+		return checker.checkNode(node, key)
+	}
+
+	var errs []schemaError
+	valueType := t
+	if ordered, ok := reflect.Zero(t).Interface().(orderedMapping); ok {
+		t = reflect.MapOf(reflect.TypeOf(""), ordered.mapValueType())
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return fail("expected a mapping")
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			field, ok := fields[k.Value]
+			if !ok {
+				msg := fmt.Sprintf("unknown key %q", k.Value)
+				if guess := closestKey(k.Value, fields); guess != "" {
+					msg += fmt.Sprintf(" (did you mean %q?)", guess)
+				}
+				if key != "" {
+					msg = fmt.Sprintf("%s: %s", key, msg)
+				}
+				errs = append(errs, schemaError{Line: k.Line, Column: k.Column, Message: msg})
+				continue
+			}
+			errs = append(errs, checkNode(v, field.Type, joinKey(key, k.Value))...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return fail("expected a mapping")
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			k, v := node.Content[i], node.Content[i+1]
+			if k.Kind != yaml.ScalarNode {
+				errs = append(errs, schemaError{Line: k.Line, Column: k.Column, Message: fmt.Sprintf("%s: keys must be plain values", key)})
+				continue
+			}
+			errs = append(errs, checkNode(v, t.Elem(), joinKey(key, k.Value))...)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return fail("expected a list")
+		}
+		for i, v := range node.Content {
+			errs = append(errs, checkNode(v, t.Elem(), fmt.Sprintf("%s[%d]", key, i))...)
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			return fail("expected a single value")
+		}
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			return fail("expected true or false")
+		}
+	case reflect.Int:
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			return fail("expected a number")
+		}
+	}
+
+	if len(errs) == 0 {
+		if checker, ok := reflect.Zero(valueType).Interface().(valueChecker); ok {
+			if err := checker.checkValue(node); err != nil {
+				if nested, ok := err.(nodeError); ok {
+					node = nested.node
+				}
+				return fail("%s", err.Error())
+			}
+		}
+	}
+	return errs
+}
+
+func joinKey(parent, key string) string {
+	if parent == "" {
+		return key
+	}
+	return parent + "." + key
+}
+
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// closestKey suggests a known key for a typo, or "" when nothing is close.
+func closestKey(key string, fields map[string]reflect.StructField) string {
+	best, bestDistance := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,291 @@
+package finalize
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SecurityHeaders is the `security_headers:` section. A preset sets a
+// baseline; every other key overrides one header, and off removes it.
+type SecurityHeaders struct {
+	Preset                          SecurityPreset      `yaml:"preset"`
+	ContentTypeOptions              ContentTypeOptions  `yaml:"content_type_options"`
+	FrameOptions                    FrameOptions        `yaml:"frame_options"`
+	FrameAncestors                  CSPSources          `yaml:"frame_ancestors"`
+	ReferrerPolicy                  ReferrerPolicy      `yaml:"referrer_policy"`
+	PermissionsPolicy               PermissionsPolicy   `yaml:"permissions_policy"`
+	ContentSecurityPolicy           CSP                 `yaml:"content_security_policy"`
+	ContentSecurityPolicyReportOnly Toggle              `yaml:"content_security_policy_report_only"`
+	CrossOriginOpenerPolicy         CrossOriginOpener   `yaml:"cross_origin_opener_policy"`
+	CrossOriginEmbedderPolicy       CrossOriginEmbedder `yaml:"cross_origin_embedder_policy"`
+}
+
+func (s SecurityHeaders) isSet() bool {
+	return !reflect.DeepEqual(s, SecurityHeaders{})
+}
+
+type SecurityPreset string
+
+func (p SecurityPreset) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "basic", "strict")
+}
+
+type ContentTypeOptions string
+
+func (o ContentTypeOptions) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "nosniff", "off")
+}
+
+type FrameOptions string
+
+func (o FrameOptions) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "DENY", "SAMEORIGIN", "off")
+}
+
+type ReferrerPolicy string
+
+func (p ReferrerPolicy) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin",
+		"same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url", "off")
+}
+
+type CrossOriginOpener string
+
+func (p CrossOriginOpener) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "same-origin", "same-origin-allow-popups", "unsafe-none", "off")
+}
+
+type CrossOriginEmbedder string
+
+func (p CrossOriginEmbedder) checkValue(node *yaml.Node) error {
+	return checkChoice(node.Value, "require-corp", "credentialless", "unsafe-none", "off")
+}
+
+func checkChoice(value string, choices ...string) error {
+	for _, choice := range choices {
+		if strings.EqualFold(value, choice) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q, expected one of %s", value, strings.Join(choices, ", "))
+}
+
+var (
+	policyNamePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	cspSourcePattern  = regexp.MustCompile(`^[^\s;,'"]+$`)
+)
+
+// cspKeywords are CSP sources written without their single quotes in the
+// Staticfile.
+var cspKeywords = map[string]bool{
+	"self":             true,
+	"none":             true,
+	"unsafe-inline":    true,
+	"unsafe-eval":      true,
+	"unsafe-hashes":    true,
+	"strict-dynamic":   true,
+	"report-sample":    true,
+	"wasm-unsafe-eval": true,
+}
+
+// CSPSources lists the sources of one CSP directive, e.g. [self,
+// https://cdn.example.com].
+type CSPSources []string
+
+func (s CSPSources) checkValue(node *yaml.Node) error {
+	for _, source := range node.Content {
+		if !cspSourcePattern.MatchString(source.Value) {
+			return nodeError{source, fmt.Sprintf("invalid source %q", source.Value)}
+		}
+	}
+	return nil
+}
+
+func (s CSPSources) String() string {
+	sources := make([]string, len(s))
+	for i, source := range s {
+		if cspKeywords[source] || strings.HasPrefix(source, "nonce-") || strings.HasPrefix(source, "sha256-") ||
+			strings.HasPrefix(source, "sha384-") || strings.HasPrefix(source, "sha512-") {
+			source = "'" + source + "'"
+		}
+		sources[i] = source
+	}
+	return strings.Join(sources, " ")
+}
+
+// CSP builds Content-Security-Policy from directives and their sources.
+// Each directive replaces the one of the preset, and the other preset
+// directives are kept; an empty list renders the directive without sources,
+// e.g. upgrade-insecure-requests. An empty map, {}, drops the preset policy,
+// leaving only frame-ancestors when frame_ancestors is set.
+type CSP map[string]CSPSources
+
+func (c CSP) checkValue(node *yaml.Node) error {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if !policyNamePattern.MatchString(node.Content[i].Value) {
+			return nodeError{node.Content[i], fmt.Sprintf("invalid directive %q", node.Content[i].Value)}
+		}
+	}
+	return nil
+}
+
+// String renders the policy with default-src first and the other
+// directives sorted.
+func (c CSP) String() string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if (names[i] == "default-src") != (names[j] == "default-src") {
+			return names[i] == "default-src"
+		}
+		return names[i] < names[j]
+	})
+
+	directives := make([]string, len(names))
+	for i, name := range names {
+		directives[i] = strings.TrimSpace(name + " " + c[name].String())
+	}
+	return strings.Join(directives, "; ")
+}
+
+// PermissionsPolicy maps a feature to the origins allowed to use it; an
+// empty list disables the feature. {} removes the preset policy.
+type PermissionsPolicy map[string]CSPSources
+
+func (p PermissionsPolicy) checkValue(node *yaml.Node) error {
+	return CSP(p).checkValue(node)
+}
+
+func (p PermissionsPolicy) String() string {
+	features := make([]string, 0, len(p))
+	for feature := range p {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	for i, feature := range features {
+		origins := make([]string, len(p[feature]))
+		for j, origin := range p[feature] {
+			if origin == "self" || origin == "*" {
+				origins[j] = origin
+			} else {
+				origins[j] = `"` + origin + `"`
+			}
+		}
+		features[i] = fmt.Sprintf("%s=(%s)", feature, strings.Join(origins, " "))
+	}
+	return strings.Join(features, ", ")
+}
+
+// isValid reports whether a scalar setting is set and passes its schema
+// check; invalid settings were reported by checkStaticfile and fall back
+// to the preset.
+func isValid(checker valueChecker, value string) bool {
+	return value != "" && checker.checkValue(&yaml.Node{Kind: yaml.ScalarNode, Value: value}) == nil
+}
+
+var securityPresets = map[SecurityPreset]SecurityHeaders{
+	"basic": {
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "SAMEORIGIN",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+	},
+	"strict": {
+		ContentTypeOptions: "nosniff",
+		FrameOptions:       "DENY",
+		ReferrerPolicy:     "no-referrer",
+		PermissionsPolicy: PermissionsPolicy{
+			"camera":      {},
+			"geolocation": {},
+			"microphone":  {},
+			"payment":     {},
+			"usb":         {},
+		},
+		ContentSecurityPolicy: CSP{
+			"default-src":     {"self"},
+			"base-uri":        {"self"},
+			"form-action":     {"self"},
+			"frame-ancestors": {"none"},
+			"object-src":      {"none"},
+		},
+		CrossOriginOpenerPolicy: "same-origin",
+	},
+}
+
+// loadSecurityHeaders resolves `security_headers:` against its preset. A
+// header also set under `headers:` keeps that value.
+func (sf *Finalizer) loadSecurityHeaders(settings SecurityHeaders) []ResponseHeader {
+	resolved := securityPresets[settings.Preset]
+	if isValid(settings.ContentTypeOptions, string(settings.ContentTypeOptions)) {
+		resolved.ContentTypeOptions = settings.ContentTypeOptions
+	}
+	if isValid(settings.FrameOptions, string(settings.FrameOptions)) {
+		resolved.FrameOptions = FrameOptions(strings.ToUpper(string(settings.FrameOptions)))
+	}
+	if isValid(settings.ReferrerPolicy, string(settings.ReferrerPolicy)) {
+		resolved.ReferrerPolicy = settings.ReferrerPolicy
+	}
+	if isValid(settings.CrossOriginOpenerPolicy, string(settings.CrossOriginOpenerPolicy)) {
+		resolved.CrossOriginOpenerPolicy = settings.CrossOriginOpenerPolicy
+	}
+	if isValid(settings.CrossOriginEmbedderPolicy, string(settings.CrossOriginEmbedderPolicy)) {
+		resolved.CrossOriginEmbedderPolicy = settings.CrossOriginEmbedderPolicy
+	}
+	if settings.PermissionsPolicy != nil {
+		resolved.PermissionsPolicy = settings.PermissionsPolicy
+	}
+
+	csp := CSP{}
+	if settings.ContentSecurityPolicy == nil || len(settings.ContentSecurityPolicy) > 0 {
+		for name, sources := range resolved.ContentSecurityPolicy {
+			csp[name] = sources
+		}
+		for name, sources := range settings.ContentSecurityPolicy {
+			csp[name] = sources
+		}
+	}
+	if settings.FrameAncestors != nil {
+		csp["frame-ancestors"] = settings.FrameAncestors
+	}
+
+	cspHeader := "Content-Security-Policy"
+	if settings.ContentSecurityPolicyReportOnly.Enabled() {
+		cspHeader = "Content-Security-Policy-Report-Only"
+	}
+	values := map[string]string{
+		"X-Content-Type-Options":       string(resolved.ContentTypeOptions),
+		"X-Frame-Options":              string(resolved.FrameOptions),
+		"Referrer-Policy":              string(resolved.ReferrerPolicy),
+		"Permissions-Policy":           resolved.PermissionsPolicy.String(),
+		cspHeader:                      csp.String(),
+		"Cross-Origin-Opener-Policy":   string(resolved.CrossOriginOpenerPolicy),
+		"Cross-Origin-Embedder-Policy": string(resolved.CrossOriginEmbedderPolicy),
+	}
+
+	set := map[string]bool{}
+	for _, h := range sf.Config.Headers {
+		set[strings.ToLower(h.Name)] = true
+	}
+
+	var headers []ResponseHeader
+	for _, name := range sortedKeys(values) {
+		value := values[name]
+		if value == "" || strings.EqualFold(value, "off") || checkHeaderValue(value) != nil {
+			continue
+		}
+		if set[strings.ToLower(name)] {
+			sf.Log.Warning("%s is set under headers, which takes precedence over security_headers", name)
+			continue
+		}
+		sf.beginStep("security_headers", "Enabling %s: %s", name, value)
+		headers = append(headers, ResponseHeader{Name: name, Value: value})
+	}
+	return headers
+}
@@ -0,0 +1,115 @@
+package finalize
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// ServiceRef names a bound service, by name or by tag, and the credential
+// fields holding a proxy upstream and, for mutual TLS, its client
+// certificate. Nested fields are separated by dots, e.g. api.url.
+type ServiceRef struct {
+	Service         string `yaml:"service" json:"service,omitempty"`
+	Tag             string `yaml:"tag" json:"tag,omitempty"`
+	Field           string `yaml:"field" json:"field"`
+	ClientCertField string `yaml:"client_cert_field" json:"client_cert_field,omitempty"`
+	ClientKeyField  string `yaml:"client_key_field" json:"client_key_field,omitempty"`
+	CAField         string `yaml:"ca_field" json:"ca_field,omitempty"`
+}
+
+func (r ServiceRef) checkValue(node *yaml.Node) error {
+	var ref ServiceRef
+	if err := node.Decode(&ref); err != nil {
+		return err
+	}
+	return ref.check()
+}
+
+func (r ServiceRef) check() error {
+	if (r.Service == "") == (r.Tag == "") {
+		return fmt.Errorf("expected either service or tag")
+	}
+	if (r.ClientCertField == "") != (r.ClientKeyField == "") {
+		return fmt.Errorf("client_cert_field and client_key_field must be set together")
+	}
+	return nil
+}
+
+func (r ServiceRef) String() string {
+	field := r.Field
+	if field == "" {
+		field = "url"
+	}
+	if r.Service != "" {
+		return fmt.Sprintf("the %s of service %s", field, r.Service)
+	}
+	return fmt.Sprintf("the %s of the service tagged %s", field, r.Tag)
+}
+
+// ServiceBinding is a proxy upstream resolved from VCAP_SERVICES when the
+// app starts. The launcher sets the URL as Env for nginx.conf and writes the
+// client certificate files next to nginx.conf.
+type ServiceBinding struct {
+	ServiceRef
+	Prefix string `json:"prefix"`
+	Env    string `json:"env"`
+	Dir    string `json:"dir"`
+}
+
+// servicesDir holds the credentials the launcher writes, relative to the
+// app directory.
+const servicesDir = "nginx/conf/services"
+
+func bindProxyService(proxy *Proxy, prefix string, ref ServiceRef, index int) {
+	if ref.Field == "" {
+		ref.Field = "url"
+	}
+	binding := &ServiceBinding{
+		ServiceRef: ref,
+		Prefix:     prefix,
+		Env:        fmt.Sprintf("STATICFILE_UPSTREAM_%d", index),
+		Dir:        fmt.Sprintf("%s/upstream_%d", servicesDir, index),
+	}
+
+	proxy.Service = binding
+	// The scheme is only known at start; nginx ignores the TLS settings
+	// for an http upstream.
+	proxy.TLS = true
+	if ref.ClientCertField != "" {
+		proxy.ClientCertificate = `<%= ENV["APP_ROOT"] %>/` + binding.Dir + "/client.crt"
+		proxy.ClientCertificateKey = `<%= ENV["APP_ROOT"] %>/` + binding.Dir + "/client.key"
+	}
+	if ref.CAField != "" {
+		proxy.TLSTrustedCertificate = `<%= ENV["APP_ROOT"] %>/` + binding.Dir + "/ca.crt"
+	}
+}
+
+// serviceBindings lists the service-bound proxy upstreams.
+func (sf *Finalizer) serviceBindings() []*ServiceBinding {
+	var bindings []*ServiceBinding
+	for _, l := range sf.Config.Locations {
+		if l.Proxy != nil && l.Proxy.Service != nil {
+			bindings = append(bindings, l.Proxy.Service)
+		}
+	}
+	return bindings
+}
+
+// writeServiceBindings stages services.json, which the launcher resolves
+// the service-bound proxy upstreams from at start.
+func (sf *Finalizer) writeServiceBindings(confDir string) error {
+	bindings := sf.serviceBindings()
+	if len(bindings) == 0 {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(bindings, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(confDir, "services.json"), data, 0644)
+}
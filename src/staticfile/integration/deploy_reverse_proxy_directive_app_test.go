@@ -0,0 +1,39 @@
+package integration_test
+
+import (
+	"github.com/cloudfoundry/libbuildpack/cutlass"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("deploy a staticfile app with the proxy directive", func() {
+	var app *cutlass.App
+	AfterEach(func() {
+		if app != nil {
+			app.Destroy()
+		}
+		app = nil
+	})
+
+	BeforeEach(func() {
+		app = cutlass.New(Fixtures("reverse_proxy_directive"))
+		app.Buildpacks = []string{"staticfile_buildpack"}
+		PushAppAndConfirm(app)
+	})
+
+	It("proxies and keeps serving the app", func() {
+		indexBody, err := app.GetBody("/")
+		Expect(err).To(BeNil())
+
+		Expect(app.GetBody("/intl/en/policies")).To(ContainSubstring("Google Privacy Policy"))
+
+		By("keeps pushstate working for other paths", func() {
+			Expect(app.GetBody("/some/client/route")).To(Equal(indexBody))
+		})
+
+		By("does not warn about overriding nginx.conf", func() {
+			Expect(app.Stdout.String()).NotTo(ContainSubstring("overriding nginx.conf is deprecated"))
+		})
+	})
+})
@@ -0,0 +1,252 @@
+package launcher
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RuntimeAuthFile is the htpasswd file WriteAuth writes next to auth.json.
+const RuntimeAuthFile = ".htpasswd-runtime"
+
+// authSource is auth.json, which finalize stages for `basic_auth_from:`:
+// the environment variable or the bound service holding the users.
+type authSource struct {
+	Env     string `json:"env"`
+	Service string `json:"service"`
+	Tag     string `json:"tag"`
+	Field   string `json:"field"`
+}
+
+var (
+	validUser    = regexp.MustCompile(`^[^:\s]+$`)
+	hashedSecret = regexp.MustCompile(`^(\$2[aby]\$|\$[156]\$|\$apr1\$|\{SSHA\}|\{SHA\}|\{PLAIN\})`)
+)
+
+// WriteAuth writes the basic_auth users of the source in the auth.json at
+// path to RuntimeAuthFile, hashing plain-text passwords with SHA-512 crypt.
+// It returns a warning for each password passed through in a weak scheme.
+func WriteAuth(path string, env Env) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var source authSource
+	if err := json.Unmarshal(data, &source); err != nil {
+		return nil, err
+	}
+
+	users, err := authUsers(source, env)
+	if err != nil {
+		return nil, fmt.Errorf("Staticfile basic_auth_from: %s", err)
+	}
+	var lines, warnings []string
+	for _, user := range users {
+		password := user[1]
+		switch {
+		case strings.HasPrefix(password, "{PLAIN}"):
+			warnings = append(warnings, fmt.Sprintf("Staticfile basic_auth_from: the password of %s is plain text", user[0]))
+		case strings.HasPrefix(password, "{SHA}"):
+			warnings = append(warnings, fmt.Sprintf("Staticfile basic_auth_from: the password of %s is an unsalted SHA-1 hash", user[0]))
+		case !hashedSecret.MatchString(password):
+			if password, err = cryptPassword(password); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, user[0]+":"+password+"\n")
+	}
+	return warnings, ioutil.WriteFile(filepath.Join(filepath.Dir(path), RuntimeAuthFile), []byte(strings.Join(lines, "")), 0600)
+}
+
+// authUsers reads the user and password pairs of source.
+func authUsers(source authSource, env Env) ([][2]string, error) {
+	var name string
+	var value interface{}
+	if source.Env != "" {
+		name = source.Env
+		text, _ := env(name)
+		if strings.TrimSpace(text) == "" {
+			return nil, fmt.Errorf("%s is not set", name)
+		}
+		value = text
+		if strings.HasPrefix(strings.TrimSpace(text), "{") {
+			var object map[string]interface{}
+			if err := json.Unmarshal([]byte(text), &object); err != nil {
+				return nil, fmt.Errorf("%s is not a valid JSON object", name)
+			}
+			value = object
+		}
+	} else {
+		services, err := boundServices(env)
+		if err != nil {
+			return nil, err
+		}
+		s, err := findService(services, source.Service, source.Tag)
+		if err != nil {
+			return nil, err
+		}
+		name = serviceName(source.Service, source.Tag)
+		value = s.Credentials
+		if source.Field != "" {
+			value = credential(s.Credentials, source.Field)
+			name = fmt.Sprintf("the %s credential of %s", source.Field, name)
+		}
+	}
+
+	var users [][2]string
+	invalid := fmt.Errorf("%s has an invalid user, expected user:password", name)
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if username, ok := value["username"]; ok {
+			user, ok1 := username.(string)
+			password, ok2 := value["password"].(string)
+			if !ok1 || !ok2 {
+				return nil, invalid
+			}
+			users = append(users, [2]string{user, password})
+			break
+		}
+		var keys []string
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, user := range keys {
+			password, ok := value[user].(string)
+			if !ok {
+				return nil, invalid
+			}
+			users = append(users, [2]string{user, password})
+		}
+	case string:
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, ":", 2)
+			if len(parts) != 2 {
+				return nil, invalid
+			}
+			users = append(users, [2]string{parts[0], parts[1]})
+		}
+	}
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%s has no users", name)
+	}
+	for _, user := range users {
+		if !validUser.MatchString(user[0]) || user[1] == "" {
+			return nil, invalid
+		}
+	}
+	return users, nil
+}
+
+// cryptPassword hashes password with SHA-512 crypt and a random salt, which
+// nginx verifies with crypt(3).
+func cryptPassword(password string) (string, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return sha512Crypt(password, hex.EncodeToString(salt)), nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512Crypt is the $6$ scheme of crypt(3) with the default 5000 rounds.
+// The salt is at most 16 characters.
+func sha512Crypt(password, salt string) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(password), []byte(salt)
+
+	alt := sha512.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	b := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	for i := len(p); i > 0; i -= 64 {
+		if i > 64 {
+			a.Write(b)
+		} else {
+			a.Write(b[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(b)
+		} else {
+			a.Write(p)
+		}
+	}
+	sum := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatDigest(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(s)
+	}
+	sSeq := repeatDigest(ds.Sum(nil), len(s))
+
+	for round := 0; round < 5000; round++ {
+		c := sha512.New()
+		if round&1 != 0 {
+			c.Write(pSeq)
+		} else {
+			c.Write(sum)
+		}
+		if round%3 != 0 {
+			c.Write(sSeq)
+		}
+		if round%7 != 0 {
+			c.Write(pSeq)
+		}
+		if round&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(pSeq)
+		}
+		sum = c.Sum(nil)
+	}
+
+	out := []byte("$6$" + salt + "$")
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out = append(out, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		encode(sum[(i*22)%63], sum[(i*22+21)%63], sum[(i*22+42)%63], 4)
+	}
+	encode(0, 0, sum[63], 2)
+	return string(out)
+}
+
+// repeatDigest repeats digest to n bytes.
+func repeatDigest(digest []byte, n int) []byte {
+	seq := make([]byte, 0, n)
+	for len(seq)+len(digest) <= n {
+		seq = append(seq, digest...)
+	}
+	return append(seq, digest[:n-len(seq)]...)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "render":
+		rendered, err := launcher.RenderConfig(os.Args[2], os.TempDir(), launcher.LaunchEnv)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "staticfile-launcher: unable to render %s: %s\n", os.Args[2], err)
+			os.Exit(1)
+		}
+		fmt.Println(rendered)
+	case "run":
+		config, err := launcher.ReadConfig(os.Args[2])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "staticfile-launcher: unable to read %s: %s\n", os.Args[2], err)
+			os.Exit(1)
+		}
+		signals := make(chan os.Signal, 8)
+		signal.Notify(signals, launcher.Signals...)
+
+		supervisor := &launcher.Supervisor{
+			Config:       config,
+			AppRoot:      os.Getenv("APP_ROOT"),
+			Env:          launcher.LaunchEnv,
+			TmpDir:       os.TempDir(),
+			Addr:         net.JoinHostPort("127.0.0.1", os.Getenv("PORT")),
+			Stdout:       os.Stdout,
+			Stderr:       os.Stderr,
+			Nginx:        "nginx",
+			Logs:         "staticfile-logs",
+			Metrics:      "staticfile-metrics",
+			RestartDelay: time.Second,
+		}
+		status, err := supervisor.Run(signals)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "staticfile-launcher: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(status)
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s render <nginx.conf>\n       %s run <launch.json>\n", os.Args[0], os.Args[0])
+	os.Exit(2)
+}
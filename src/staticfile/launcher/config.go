@@ -0,0 +1,48 @@
+package launcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Config is launch.json, which finalize stages next to nginx.conf. Paths
+// are relative to the app directory.
+type Config struct {
+	Conf      string   `json:"conf"`
+	FIFOs     []string `json:"fifos"`
+	Forward   []Stream `json:"forward"`
+	LogPrefix string   `json:"log_prefix,omitempty"`
+	Ready     string   `json:"ready,omitempty"`
+	Metrics   string   `json:"metrics,omitempty"`
+	// Services are the proxy upstreams bound to services and Auth is the
+	// source of the basic_auth users, both resolved before nginx.conf is
+	// rendered.
+	Services string `json:"services,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+	// Sockets are the unix sockets nginx listens on. They are removed
+	// before nginx starts, as nginx fails to bind one left by a crash.
+	Sockets     []string `json:"sockets,omitempty"`
+	BeforeStart []string `json:"before_start,omitempty"`
+	// DrainTimeout is how many seconds nginx has to finish the requests in
+	// flight once the app is asked to stop.
+	DrainTimeout int `json:"drain_timeout"`
+	// Restarts is how many times nginx is started again after it crashes,
+	// counted since it last ran for a minute.
+	Restarts int `json:"restarts"`
+}
+
+// Stream is a log FIFO forwarded to stdout or stderr.
+type Stream struct {
+	Path string `json:"path"`
+	Out  string `json:"out"`
+}
+
+// ReadConfig reads launch.json.
+func ReadConfig(path string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	return config, json.Unmarshal(data, &config)
+}
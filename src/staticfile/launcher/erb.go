@@ -0,0 +1,210 @@
+// Package launcher starts nginx for a staticfile app and supervises it. It
+// renders the ERB tags of nginx.conf at launch, which the buildpack used to
+// leave to Ruby.
+package launcher
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Env looks up an environment variable, reporting whether it is set.
+type Env func(key string) (string, bool)
+
+// RenderERB evaluates the subset of ERB that nginx.conf templates use:
+// output, comment and control tags, with expressions built from ENV[...],
+// ENV.fetch(...), string and %w() literals, ==, !=, !, && and ||, and the
+// downcase, upcase, strip, to_s, empty?, nil? and include? methods. The
+// control tags are if, unless, elsif, else and end. Anything else fails
+// with the line of the tag.
+func RenderERB(name, src string, env Env) (string, error) {
+	out, _, err := RenderERBLines(name, src, env)
+	return out, err
+}
+
+// RenderERBLines is RenderERB that also returns the line of src each line
+// of the output starts on, which points an nginx error at its source.
+func RenderERBLines(name, src string, env Env) (string, []int, error) {
+	r := &renderer{env: env, lineStart: true}
+
+	line := 1
+	for len(src) > 0 {
+		start := strings.Index(src, "<%")
+		if start < 0 {
+			r.write(src, line)
+			line += strings.Count(src, "\n")
+			break
+		}
+		if strings.HasPrefix(src[start:], "<%%") {
+			r.write(src[:start]+"<%", line)
+			line += strings.Count(src[:start], "\n")
+			src = src[start+3:]
+			continue
+		}
+
+		text := src[:start]
+		rest := src[start+2:]
+		end := strings.Index(rest, "%>")
+		if end < 0 {
+			return "", nil, fmt.Errorf("%s line %d: unterminated ERB tag", name, line+strings.Count(text, "\n"))
+		}
+		tag := rest[:end]
+		src = rest[end+2:]
+		textLine := line
+		line += strings.Count(text, "\n")
+		tagLine := line
+		line += strings.Count(tag, "\n")
+
+		// <%- strips the indentation before the tag, -%> the newline after.
+		if strings.HasPrefix(tag, "-") {
+			text = strings.TrimRight(text, " \t")
+			tag = tag[1:]
+		}
+		if strings.HasSuffix(tag, "-") {
+			tag = tag[:len(tag)-1]
+			if strings.HasPrefix(src, "\n") {
+				src = src[1:]
+				line++
+			}
+		}
+
+		r.write(text, textLine)
+		if err := r.tag(tag, tagLine); err != nil {
+			return "", nil, fmt.Errorf("%s line %d: %s", name, tagLine, err)
+		}
+	}
+
+	if len(r.frames) > 0 {
+		return "", nil, fmt.Errorf("%s line %d: missing <%% end %%>", name, line)
+	}
+	return r.out.String(), r.lines, nil
+}
+
+// frame is an open if or unless block.
+type frame struct {
+	// outer reports whether the enclosing block is output, taken whether
+	// one of the branches of this block has been.
+	outer  bool
+	taken  bool
+	active bool
+}
+
+type renderer struct {
+	env    Env
+	out    strings.Builder
+	frames []frame
+	// lines holds the source line of each output line, which starts with
+	// the next output when lineStart is set.
+	lines     []int
+	lineStart bool
+}
+
+func (r *renderer) active() bool {
+	return len(r.frames) == 0 || r.frames[len(r.frames)-1].active
+}
+
+// write outputs text, which starts on line of the source, unless a
+// conditional leaves it out.
+func (r *renderer) write(text string, line int) {
+	if r.active() {
+		r.emit(text, line)
+	}
+}
+
+func (r *renderer) emit(text string, line int) {
+	for text != "" {
+		if r.lineStart {
+			r.lines = append(r.lines, line)
+			r.lineStart = false
+		}
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			r.out.WriteString(text)
+			return
+		}
+		r.out.WriteString(text[:i+1])
+		text = text[i+1:]
+		line++
+		r.lineStart = true
+	}
+}
+
+func (r *renderer) tag(tag string, line int) error {
+	switch {
+	case strings.HasPrefix(tag, "#"):
+		return nil
+	case strings.HasPrefix(tag, "="):
+		if !r.active() {
+			return nil
+		}
+		v, err := evaluate(tag[1:], r.env)
+		if err != nil {
+			return err
+		}
+		r.emit(v.String(), line)
+		return nil
+	}
+
+	code := strings.TrimSpace(tag)
+	keyword, expr := code, ""
+	if i := strings.IndexFunc(code, unicode.IsSpace); i >= 0 {
+		keyword, expr = code[:i], strings.TrimSpace(code[i:])
+	}
+
+	switch keyword {
+	case "if", "unless":
+		f := frame{outer: r.active()}
+		if f.outer {
+			v, err := evaluate(expr, r.env)
+			if err != nil {
+				return err
+			}
+			f.active = v.truthy() == (keyword == "if")
+			f.taken = f.active
+		}
+		r.frames = append(r.frames, f)
+	case "elsif":
+		f, err := r.top(keyword)
+		if err != nil {
+			return err
+		}
+		f.active = false
+		if f.outer && !f.taken {
+			v, err := evaluate(expr, r.env)
+			if err != nil {
+				return err
+			}
+			f.active = v.truthy()
+			f.taken = f.active
+		}
+	case "else", "end":
+		f, err := r.top(keyword)
+		if err != nil {
+			return err
+		}
+		if expr != "" {
+			return unsupported(code)
+		}
+		if keyword == "else" {
+			f.active = f.outer && !f.taken
+			f.taken = true
+		} else {
+			r.frames = r.frames[:len(r.frames)-1]
+		}
+	default:
+		return unsupported(code)
+	}
+	return nil
+}
+
+func (r *renderer) top(keyword string) (*frame, error) {
+	if len(r.frames) == 0 {
+		return nil, fmt.Errorf("<%% %s %%> without <%% if %%>", keyword)
+	}
+	return &r.frames[len(r.frames)-1], nil
+}
+
+func unsupported(code string) error {
+	return fmt.Errorf("unsupported ERB %q", code)
+}
@@ -0,0 +1,5 @@
+package launcher
+
+// SHA512Crypt exposes sha512Crypt, whose salt is random in WriteAuth, to
+// check it against known answers.
+var SHA512Crypt = sha512Crypt
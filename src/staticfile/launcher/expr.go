@@ -0,0 +1,413 @@
+package launcher
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type kind int
+
+const (
+	nilValue kind = iota
+	boolValue
+	stringValue
+	listValue
+)
+
+// value is a Ruby nil, boolean, string or array of strings.
+type value struct {
+	kind kind
+	b    bool
+	s    string
+	list []string
+}
+
+// truthy follows Ruby, where only nil and false are false.
+func (v value) truthy() bool {
+	switch v.kind {
+	case nilValue:
+		return false
+	case boolValue:
+		return v.b
+	}
+	return true
+}
+
+func (v value) String() string {
+	switch v.kind {
+	case boolValue:
+		return fmt.Sprint(v.b)
+	case stringValue:
+		return v.s
+	case listValue:
+		return fmt.Sprintf("%q", v.list)
+	}
+	return ""
+}
+
+func boolean(b bool) value {
+	return value{kind: boolValue, b: b}
+}
+
+func str(s string) value {
+	return value{kind: stringValue, s: s}
+}
+
+// evaluate parses and evaluates one ERB expression.
+func evaluate(code string, env Env) (value, error) {
+	tokens, err := tokenize(code)
+	if err != nil {
+		return value{}, err
+	}
+	p := &parser{tokens: tokens, env: env, code: strings.TrimSpace(code)}
+	v, err := p.or()
+	if err != nil {
+		return value{}, err
+	}
+	if !p.done() {
+		return value{}, p.fail()
+	}
+	return v, nil
+}
+
+type tokenKind int
+
+const (
+	identToken tokenKind = iota
+	stringToken
+	wordsToken
+	punctToken
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	words []string
+}
+
+var punctuation = []string{"||", "&&", "==", "!=", "!", "[", "]", "(", ")", ".", ","}
+
+func tokenize(code string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(code); {
+		c := rune(code[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			s, n, err := readString(code[i:])
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: stringToken, text: s})
+			i += n
+		case strings.HasPrefix(code[i:], "%w(") || strings.HasPrefix(code[i:], "%w["):
+			closing := ")"
+			if code[i+2] == '[' {
+				closing = "]"
+			}
+			end := strings.Index(code[i+3:], closing)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %%w literal in %q", strings.TrimSpace(code))
+			}
+			tokens = append(tokens, token{kind: wordsToken, words: strings.Fields(code[i+3 : i+3+end])})
+			i += 3 + end + 1
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(code) && (code[j] == '_' || unicode.IsLetter(rune(code[j])) || unicode.IsDigit(rune(code[j]))) {
+				j++
+			}
+			if j < len(code) && code[j] == '?' {
+				j++
+			}
+			tokens = append(tokens, token{kind: identToken, text: code[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, p := range punctuation {
+				if strings.HasPrefix(code[i:], p) {
+					tokens = append(tokens, token{kind: punctToken, text: p})
+					i += len(p)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unsupported ERB %q", strings.TrimSpace(code))
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// readString reads a Ruby string literal, returning its value and length.
+func readString(code string) (string, int, error) {
+	quote := code[0]
+	var s strings.Builder
+	for i := 1; i < len(code); i++ {
+		switch c := code[i]; {
+		case c == quote:
+			return s.String(), i + 1, nil
+		case c == '\\' && i+1 < len(code):
+			i++
+			next := code[i]
+			switch {
+			case quote == '\'' && next != '\'' && next != '\\':
+				s.WriteByte('\\')
+				s.WriteByte(next)
+			case quote == '"' && next == 'n':
+				s.WriteByte('\n')
+			case quote == '"' && next == 't':
+				s.WriteByte('\t')
+			default:
+				s.WriteByte(next)
+			}
+		default:
+			s.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string in %q", strings.TrimSpace(code))
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	env    Env
+	code   string
+	// skip is above 0 while parsing the operand that && or || short
+	// circuits, where Ruby would not raise.
+	skip int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek(text string) bool {
+	return !p.done() && p.tokens[p.pos].kind != stringToken && p.tokens[p.pos].text == text
+}
+
+func (p *parser) accept(text string) bool {
+	if p.peek(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.fail()
+	}
+	return nil
+}
+
+func (p *parser) fail() error {
+	return fmt.Errorf("unsupported ERB %q", p.code)
+}
+
+// undefined fails a method call on a value without that method, unless
+// the call is short circuited.
+func (p *parser) undefined(method string) error {
+	if p.skip > 0 {
+		return nil
+	}
+	return fmt.Errorf("undefined method %s in %q", method, p.code)
+}
+
+func (p *parser) or() (value, error) {
+	v, err := p.and()
+	for err == nil && (p.accept("||") || p.accept("or")) {
+		if v.truthy() {
+			p.skip++
+			_, err = p.and()
+			p.skip--
+		} else {
+			v, err = p.and()
+		}
+	}
+	return v, err
+}
+
+func (p *parser) and() (value, error) {
+	v, err := p.not()
+	for err == nil && (p.accept("&&") || p.accept("and")) {
+		if v.truthy() {
+			v, err = p.not()
+		} else {
+			p.skip++
+			_, err = p.not()
+			p.skip--
+		}
+	}
+	return v, err
+}
+
+func (p *parser) not() (value, error) {
+	if p.accept("!") || p.accept("not") {
+		v, err := p.not()
+		return boolean(!v.truthy()), err
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (value, error) {
+	left, err := p.postfix()
+	if err != nil {
+		return left, err
+	}
+	for _, op := range []string{"==", "!="} {
+		if p.accept(op) {
+			right, err := p.postfix()
+			equal := left.kind == right.kind && left.String() == right.String()
+			return boolean(equal == (op == "==")), err
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) postfix() (value, error) {
+	v, err := p.primary()
+	for err == nil && p.accept(".") {
+		if p.done() || p.tokens[p.pos].kind != identToken {
+			return v, p.fail()
+		}
+		method := p.tokens[p.pos].text
+		p.pos++
+		v, err = p.call(v, method)
+	}
+	return v, err
+}
+
+func (p *parser) call(v value, method string) (value, error) {
+	switch method {
+	case "nil?":
+		return boolean(v.kind == nilValue), nil
+	case "to_s":
+		return str(v.String()), nil
+	case "include?":
+		if err := p.expect("("); err != nil {
+			return v, err
+		}
+		arg, err := p.or()
+		if err != nil {
+			return v, err
+		}
+		if err := p.expect(")"); err != nil {
+			return v, err
+		}
+		switch v.kind {
+		case listValue:
+			for _, word := range v.list {
+				if arg.kind == stringValue && word == arg.s {
+					return boolean(true), nil
+				}
+			}
+			return boolean(false), nil
+		case stringValue:
+			return boolean(arg.kind == stringValue && strings.Contains(v.s, arg.s)), nil
+		}
+		return v, p.undefined(method)
+	}
+
+	if v.kind != stringValue {
+		return v, p.undefined(method)
+	}
+	switch method {
+	case "downcase":
+		return str(strings.ToLower(v.s)), nil
+	case "upcase":
+		return str(strings.ToUpper(v.s)), nil
+	case "strip":
+		return str(strings.TrimSpace(v.s)), nil
+	case "empty?":
+		return boolean(v.s == ""), nil
+	}
+	return v, p.fail()
+}
+
+func (p *parser) primary() (value, error) {
+	if p.done() {
+		return value{}, p.fail()
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+
+	switch t.kind {
+	case stringToken:
+		return str(t.text), nil
+	case wordsToken:
+		return value{kind: listValue, list: t.words}, nil
+	case punctToken:
+		if t.text == "(" {
+			v, err := p.or()
+			if err != nil {
+				return v, err
+			}
+			return v, p.expect(")")
+		}
+		return value{}, p.fail()
+	}
+
+	switch t.text {
+	case "true", "false":
+		return boolean(t.text == "true"), nil
+	case "nil":
+		return value{}, nil
+	case "ENV":
+		return p.envValue()
+	}
+	return value{}, p.fail()
+}
+
+// envValue reads ENV["NAME"] or ENV.fetch("NAME", default).
+func (p *parser) envValue() (value, error) {
+	if p.accept("[") {
+		key, err := p.or()
+		if err != nil {
+			return key, err
+		}
+		if err := p.expect("]"); err != nil {
+			return key, err
+		}
+		return p.lookup(key, nil)
+	}
+
+	if !p.accept(".") || !p.accept("fetch") || !p.accept("(") {
+		return value{}, p.fail()
+	}
+	key, err := p.or()
+	if err != nil {
+		return key, err
+	}
+	var fallback *value
+	if p.accept(",") {
+		v, err := p.or()
+		if err != nil {
+			return v, err
+		}
+		fallback = &v
+	}
+	if err := p.expect(")"); err != nil {
+		return key, err
+	}
+	v, err := p.lookup(key, fallback)
+	if err == nil && v.kind == nilValue && fallback == nil && p.skip == 0 {
+		return v, fmt.Errorf("key not found: %q", key.s)
+	}
+	return v, err
+}
+
+func (p *parser) lookup(key value, fallback *value) (value, error) {
+	if key.kind != stringValue {
+		return value{}, p.fail()
+	}
+	if s, ok := p.env(key.s); ok {
+		return str(s), nil
+	}
+	if fallback != nil {
+		return *fallback, nil
+	}
+	return value{}, nil
+}
@@ -0,0 +1,551 @@
+package launcher_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/libbuildpack"
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/finalize"
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/launcher"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from the launcher and the
+// output of its children at once.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+var _ = Describe("Launcher", func() {
+	var env map[string]string
+
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+
+	render := func(src string) (string, error) {
+		return launcher.RenderERB("nginx.conf", src, lookup)
+	}
+
+	BeforeEach(func() {
+		env = map[string]string{"PORT": "8080", "APP_ROOT": "/home/vcap/app"}
+	})
+
+	Describe("RenderERB", func() {
+		It("outputs environment variables", func() {
+			Expect(render(`listen <%= ENV["PORT"] %>; root <%= ENV['APP_ROOT'] %>/public; <%= ENV["UNSET"] %>`)).To(Equal("listen 8080; root /home/vcap/app/public; "))
+			Expect(render(`<%= ENV.fetch("UNSET", "fallback") %> <%= ENV.fetch("PORT", "80") %>`)).To(Equal("fallback 8080"))
+		})
+
+		It("evaluates the toggles finalize writes", func() {
+			conf := `<% if ENV["FORCE_HTTPS"] || %w(enabled true on visible).include?(ENV.fetch("BP_STATICFILE_FORCE_HTTPS", "false").downcase) %>redirect<% end %>`
+			Expect(render(conf)).To(Equal(""))
+
+			env["BP_STATICFILE_FORCE_HTTPS"] = "ON"
+			Expect(render(conf)).To(Equal("redirect"))
+
+			delete(env, "BP_STATICFILE_FORCE_HTTPS")
+			env["FORCE_HTTPS"] = ""
+			Expect(render(conf)).To(Equal("redirect"))
+		})
+
+		It("nests conditionals", func() {
+			conf := `<% if ENV["A"] == "1" %>a<% if ENV["B"] %>b<% else %>!b<% end %><% elsif !ENV["C"].nil? && ENV["C"].strip.empty? %>c<% else %>z<% end %><% unless true %>never<% end %>`
+			env["A"] = "1"
+			Expect(render(conf)).To(Equal("a!b"))
+			env["B"] = "yes"
+			Expect(render(conf)).To(Equal("ab"))
+			env["A"] = "2"
+			env["C"] = " "
+			Expect(render(conf)).To(Equal("c"))
+			delete(env, "C")
+			Expect(render(conf)).To(Equal("z"))
+		})
+
+		It("supports comments, trimming and escaped tags", func() {
+			Expect(render("<%# a comment %>a\n  <%- if true -%>\nb\n<% end -%>\n<%% c")).To(Equal("a\nb\n<% c"))
+		})
+
+		It("maps the output lines to the source lines", func() {
+			out, lines, err := launcher.RenderERBLines("nginx.conf", "a\n<% if ENV[\"UNSET\"] %>\nb\n<% end %>\nc <%= ENV[\"PORT\"] %>\n<%# comment\n%>d\n", lookup)
+			Expect(err).To(BeNil())
+			Expect(out).To(Equal("a\n\nc 8080\nd\n"))
+			Expect(lines).To(Equal([]int{1, 4, 5, 7}))
+		})
+
+		It("reports unsupported ERB with its line", func() {
+			_, err := render("events {}\n\n<%= `hostname` %>")
+			Expect(err).To(MatchError("nginx.conf line 3: unsupported ERB \"`hostname`\""))
+
+			_, err = render("<% if true %>\n")
+			Expect(err).To(MatchError("nginx.conf line 2: missing <% end %>"))
+
+			_, err = render("\n<% end %>")
+			Expect(err).To(MatchError("nginx.conf line 2: <% end %> without <% if %>"))
+
+			_, err = render(`<% ENV["PORT"].each { |c| puts c } %>`)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("renders the nginx.conf finalize generates", func() {
+			buildDir, err := ioutil.TempDir("", "staticfile-buildpack.build.")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(buildDir)
+
+			sf := &finalize.Finalizer{
+				BuildDir: buildDir,
+				Log:      libbuildpack.NewLogger(ioutil.Discard),
+				Config: finalize.Staticfile{
+					PushState: true,
+					HSTS:      true,
+					Locations: []finalize.Location{{Match: "/admin/", SSI: "on"}},
+				},
+			}
+			Expect(sf.ConfigureNginx()).To(Succeed())
+			data, err := ioutil.ReadFile(filepath.Join(buildDir, "nginx", "conf", "nginx.conf"))
+			Expect(err).To(BeNil())
+
+			env["BP_STATICFILE_ENABLE_HTTP2"] = "true"
+			conf, err := render(string(data))
+			Expect(err).To(BeNil())
+			Expect(conf).NotTo(ContainSubstring("<%"))
+			Expect(conf).To(ContainSubstring("listen 8080 http2;"))
+			Expect(conf).To(ContainSubstring("root /home/vcap/app/public;"))
+			Expect(conf).To(ContainSubstring("rewrite ^(.*)$ / break;"))
+			Expect(conf).To(ContainSubstring("ssi on;"))
+			Expect(conf).NotTo(ContainSubstring("return 301 https://"))
+		})
+	})
+
+	Describe("RenderConfig", func() {
+		var confDir, tmpDir string
+
+		BeforeEach(func() {
+			var err error
+			confDir, err = ioutil.TempDir("", "staticfile-buildpack.conf.")
+			Expect(err).To(BeNil())
+			tmpDir, err = ioutil.TempDir("", "staticfile-buildpack.tmp.")
+			Expect(err).To(BeNil())
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "nginx.conf"), []byte(`include mime.types; listen <%= ENV["PORT"] %>;`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "mime.types"), []byte("types {}"), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(confDir)).To(Succeed())
+			Expect(os.RemoveAll(tmpDir)).To(Succeed())
+		})
+
+		It("renders next to links to the other files and leaves the source alone", func() {
+			for i := 0; i < 2; i++ {
+				rendered, err := launcher.RenderConfig(filepath.Join(confDir, "nginx.conf"), tmpDir, lookup)
+				Expect(err).To(BeNil())
+				Expect(strings.HasPrefix(rendered, tmpDir)).To(BeTrue())
+				Expect(ioutil.ReadFile(rendered)).To(Equal([]byte("include mime.types; listen 8080;")))
+				Expect(ioutil.ReadFile(filepath.Join(filepath.Dir(rendered), "mime.types"))).To(Equal([]byte("types {}")))
+			}
+			Expect(ioutil.ReadFile(filepath.Join(confDir, "nginx.conf"))).To(Equal([]byte(`include mime.types; listen <%= ENV["PORT"] %>;`)))
+		})
+	})
+
+	Describe("LaunchEnv", func() {
+		AfterEach(func() {
+			os.Unsetenv("VCAP_APPLICATION")
+			os.Unsetenv("STATICFILE_APP_NAME")
+		})
+
+		It("derives STATICFILE_APP_NAME from VCAP_APPLICATION", func() {
+			os.Setenv("VCAP_APPLICATION", `{"application_name": "my app/v2"}`)
+			name, ok := launcher.LaunchEnv("STATICFILE_APP_NAME")
+			Expect(ok).To(BeTrue())
+			Expect(name).To(Equal("my_app_v2"))
+
+			os.Setenv("STATICFILE_APP_NAME", "explicit")
+			name, _ = launcher.LaunchEnv("STATICFILE_APP_NAME")
+			Expect(name).To(Equal("explicit"))
+		})
+	})
+
+	Describe("ResolveServices", func() {
+		var appRoot, services string
+
+		BeforeEach(func() {
+			var err error
+			appRoot, err = ioutil.TempDir("", "staticfile-buildpack.app.")
+			Expect(err).To(BeNil())
+			services = filepath.Join(appRoot, "services.json")
+			Expect(ioutil.WriteFile(services, []byte(`[{"tag": "api", "field": "api.url", "client_cert_field": "cert", "client_key_field": "key",
+				"prefix": "/api/", "env": "STATICFILE_UPSTREAM_0", "dir": "nginx/conf/services/upstream_0"}]`), 0644)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(appRoot)).To(Succeed())
+		})
+
+		It("resolves the upstreams and writes the client certificate", func() {
+			env["VCAP_SERVICES"] = `{"user-provided": [{"name": "backend", "tags": ["api"], "credentials": {"api": {"url": "https://api.example.com/v1"}, "cert": "CERT", "key": "KEY"}}]}`
+
+			upstreams, err := launcher.ResolveServices(services, appRoot, lookup)
+			Expect(err).To(BeNil())
+			Expect(upstreams).To(Equal(map[string]string{"STATICFILE_UPSTREAM_0": "https://api.example.com/v1"}))
+			Expect(ioutil.ReadFile(filepath.Join(appRoot, "nginx", "conf", "services", "upstream_0", "client.crt"))).To(Equal([]byte("CERT")))
+			fi, err := os.Stat(filepath.Join(appRoot, "nginx", "conf", "services", "upstream_0", "client.key"))
+			Expect(err).To(BeNil())
+			Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		for _, c := range []struct{ vcap, message string }{
+			{`{}`, "a service tagged api is not bound to the app"},
+			{`{"a": [{"name": "one", "tags": ["api"]}, {"name": "two", "tags": ["api"]}]}`, "2 services match a service tagged api"},
+			{`{"a": [{"name": "one", "tags": ["api"], "credentials": {"api": {}}}]}`, "a service tagged api has no api.url credential"},
+			{`{"a": [{"name": "one", "tags": ["api"], "credentials": {"api": {"url": "ftp://example.com"}}}]}`, "the api.url credential of a service tagged api is not an http:// or https:// URL"},
+			{`{"a": [{"name": "one", "tags": ["api"], "credentials": {"api": {"url": "https://example.com/;return 200"}}}]}`, "the api.url credential of a service tagged api is not an http:// or https:// URL"},
+			{`{"a": [{"name": "one", "tags": ["api"], "credentials": {"api": {"url": "https://example.com"}, "cert": "CERT"}}]}`, "a service tagged api has no key credential"},
+		} {
+			c := c
+			It("fails when "+c.message, func() {
+				env["VCAP_SERVICES"] = c.vcap
+				_, err := launcher.ResolveServices(services, appRoot, lookup)
+				Expect(err).To(MatchError("Staticfile proxy /api/: " + c.message))
+			})
+		}
+	})
+
+	Describe("WriteAuth", func() {
+		var (
+			confDir  string
+			warnings []string
+		)
+
+		write := func(source string) error {
+			Expect(ioutil.WriteFile(filepath.Join(confDir, "auth.json"), []byte(source), 0644)).To(Succeed())
+			var err error
+			warnings, err = launcher.WriteAuth(filepath.Join(confDir, "auth.json"), lookup)
+			return err
+		}
+
+		htpasswd := func() []string {
+			data, err := ioutil.ReadFile(filepath.Join(confDir, launcher.RuntimeAuthFile))
+			Expect(err).To(BeNil())
+			return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		}
+
+		BeforeEach(func() {
+			var err error
+			confDir, err = ioutil.TempDir("", "staticfile-buildpack.conf.")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(confDir)).To(Succeed())
+		})
+
+		It("hashes the plain-text passwords of user:password lines", func() {
+			env["SITE_USERS"] = "# editors\nbob:$apr1$abc$def\n\nalice:secret\n"
+			Expect(write(`{"env": "SITE_USERS"}`)).To(Succeed())
+
+			lines := htpasswd()
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0]).To(Equal("bob:$apr1$abc$def"))
+			Expect(lines[1]).To(MatchRegexp(`^alice:\$6\$[0-9a-f]{16}\$[./0-9A-Za-z]{86}$`))
+			fi, err := os.Stat(filepath.Join(confDir, launcher.RuntimeAuthFile))
+			Expect(err).To(BeNil())
+			Expect(fi.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			Expect(warnings).To(BeEmpty())
+		})
+
+		It("hashes with SHA-512 crypt", func() {
+			Expect(launcher.SHA512Crypt("Hello world!", "saltstring")).To(Equal("$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"))
+		})
+
+		It("reads a JSON object of users", func() {
+			env["SITE_USERS"] = `{"carol": "$2y$05$hash", "bob": "$1$salt$hash"}`
+			Expect(write(`{"env": "SITE_USERS"}`)).To(Succeed())
+			Expect(htpasswd()).To(Equal([]string{"bob:$1$salt$hash", "carol:$2y$05$hash"}))
+		})
+
+		It("reads the username and password credentials of a service", func() {
+			env["VCAP_SERVICES"] = `{"user-provided": [{"name": "site-users", "credentials": {"username": "admin", "password": "{SHA}hash"}}]}`
+			Expect(write(`{"service": "site-users"}`)).To(Succeed())
+			Expect(htpasswd()).To(Equal([]string{"admin:{SHA}hash"}))
+			Expect(warnings).To(Equal([]string{"Staticfile basic_auth_from: the password of admin is an unsalted SHA-1 hash"}))
+		})
+
+		It("keeps a plain-text password and warns about it", func() {
+			env["SITE_USERS"] = "alice:{PLAIN}secret\n"
+			Expect(write(`{"env": "SITE_USERS"}`)).To(Succeed())
+			Expect(htpasswd()).To(Equal([]string{"alice:{PLAIN}secret"}))
+			Expect(warnings).To(Equal([]string{"Staticfile basic_auth_from: the password of alice is plain text"}))
+		})
+
+		for _, c := range []struct{ source, value, message string }{
+			{`{"env": "SITE_USERS"}`, "", "SITE_USERS is not set"},
+			{`{"env": "SITE_USERS"}`, "{not json", "SITE_USERS is not a valid JSON object"},
+			{`{"env": "SITE_USERS"}`, "# nobody\n", "SITE_USERS has no users"},
+			{`{"env": "SITE_USERS"}`, "alice", "SITE_USERS has an invalid user, expected user:password"},
+			{`{"env": "SITE_USERS"}`, "al ice:secret", "SITE_USERS has an invalid user, expected user:password"},
+			{`{"tag": "users", "field": "list"}`, "", "a service tagged users is not bound to the app"},
+		} {
+			c := c
+			It("fails when "+c.message, func() {
+				env["SITE_USERS"] = c.value
+				Expect(write(c.source)).To(MatchError("Staticfile basic_auth_from: " + c.message))
+			})
+		}
+
+		It("names the credential of a service", func() {
+			env["VCAP_SERVICES"] = `{"user-provided": [{"name": "site-users", "tags": ["users"], "credentials": {"list": ""}}]}`
+			Expect(write(`{"tag": "users", "field": "list"}`)).To(MatchError("Staticfile basic_auth_from: the list credential of a service tagged users has no users"))
+		})
+	})
+
+	Describe("WaitReady", func() {
+		It("marks nginx ready once the port accepts connections", func() {
+			dir, err := ioutil.TempDir("", "staticfile-buildpack.run.")
+			Expect(err).To(BeNil())
+			defer os.RemoveAll(dir)
+			marker := filepath.Join(dir, "run", "ready")
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer listener.Close()
+
+			Expect(launcher.WaitReady(listener.Addr().String(), marker, 10*time.Millisecond)).To(Succeed())
+			Expect(marker).To(BeARegularFile())
+		})
+	})
+
+	Describe("Supervisor", func() {
+		var (
+			appRoot    string
+			supervisor *launcher.Supervisor
+			signals    chan os.Signal
+			stderr     *syncBuffer
+		)
+
+		script := func(name, body string) string {
+			path := filepath.Join(appRoot, name)
+			Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755)).To(Succeed())
+			return path
+		}
+
+		// serve loops until a trapped signal exits the script.
+		const serve = "while :; do sleep 0.05; done"
+
+		run := func() <-chan int {
+			status := make(chan int, 1)
+			go func() {
+				defer GinkgoRecover()
+				s, err := supervisor.Run(signals)
+				Expect(err).To(BeNil())
+				status <- s
+			}()
+			return status
+		}
+
+		exists := func(name string) func() bool {
+			return func() bool {
+				_, err := os.Stat(filepath.Join(appRoot, name))
+				return err == nil
+			}
+		}
+
+		read := func(name string) string {
+			contents, _ := ioutil.ReadFile(filepath.Join(appRoot, name))
+			return string(contents)
+		}
+
+		BeforeEach(func() {
+			var err error
+			appRoot, err = ioutil.TempDir("", "staticfile-buildpack.app.")
+			Expect(err).To(BeNil())
+			Expect(os.MkdirAll(filepath.Join(appRoot, "nginx", "conf"), 0755)).To(Succeed())
+			Expect(os.MkdirAll(filepath.Join(appRoot, "nginx", "logs"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "conf", "nginx.conf"), []byte(`listen <%= ENV["PORT"] %>;`), 0644)).To(Succeed())
+
+			signals = make(chan os.Signal, 1)
+			stderr = new(syncBuffer)
+			supervisor = &launcher.Supervisor{
+				Config:       launcher.Config{Conf: "nginx/conf/nginx.conf", DrainTimeout: 1},
+				AppRoot:      appRoot,
+				Env:          lookup,
+				TmpDir:       appRoot,
+				Stdout:       new(syncBuffer),
+				Stderr:       stderr,
+				RestartDelay: 10 * time.Millisecond,
+			}
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(appRoot)).To(Succeed())
+		})
+
+		It("runs before_start and stops nginx gracefully on SIGTERM", func() {
+			supervisor.Config.BeforeStart = []string{"echo configured > before"}
+			supervisor.Nginx = script("nginx.sh", `[ -f before ] && echo "$@" > args
+trap 'echo quit > signal; exit 0' QUIT
+`+serve)
+
+			status := run()
+			Eventually(func() string { return read("args") }).Should(ContainSubstring("-p " + appRoot + "/nginx -c " + appRoot + "/staticfile-nginx."))
+			conf := strings.Fields(read("args"))[3]
+			Expect(ioutil.ReadFile(conf)).To(Equal([]byte("listen 8080;")))
+
+			signals <- syscall.SIGTERM
+			Eventually(status, 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("signal")).To(Equal("quit\n"))
+			Expect(filepath.Dir(conf)).NotTo(BeADirectory())
+		})
+
+		It("stops nginx at once after the drain timeout", func() {
+			supervisor.Nginx = script("nginx.sh", `trap '' QUIT
+trap 'echo term > signal; exit 0' TERM
+touch started
+`+serve)
+
+			status := run()
+			Eventually(exists("started")).Should(BeTrue())
+			signals <- syscall.SIGTERM
+			Consistently(status, 500*time.Millisecond).ShouldNot(Receive())
+			Eventually(status, 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("signal")).To(Equal("term\n"))
+			Expect(stderr.String()).To(ContainSubstring("nginx is still serving after 1s, stopping it now"))
+		})
+
+		It("forwards other signals", func() {
+			supervisor.Nginx = script("nginx.sh", `trap 'echo hup >> signal' HUP
+touch started
+`+serve)
+
+			status := run()
+			Eventually(exists("started")).Should(BeTrue())
+			signals <- syscall.SIGHUP
+			Eventually(func() string { return read("signal") }).Should(Equal("hup\n"))
+
+			signals <- syscall.SIGINT
+			Eventually(status, 2*time.Second).Should(Receive(Equal(128 + int(syscall.SIGTERM))))
+		})
+
+		It("restarts nginx after a crash until no restarts are left", func() {
+			supervisor.Config.Restarts = 2
+			supervisor.Nginx = script("nginx.sh", "echo started >> starts\nexit 3")
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(3)))
+			Expect(read("starts")).To(Equal("started\nstarted\nstarted\n"))
+			Expect(stderr.String()).To(ContainSubstring("nginx exited with status 3, restarting it (2 of 2)"))
+			Expect(stderr.String()).To(ContainSubstring("nginx exited with status 3\n"))
+		})
+
+		It("removes the sockets left by a crash before starting nginx", func() {
+			Expect(os.MkdirAll(filepath.Join(appRoot, "nginx", "run"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "run", "status.sock"), nil, 0644)).To(Succeed())
+			supervisor.Config.Sockets = []string{"nginx/run/status.sock"}
+			supervisor.Config.Restarts = 1
+			supervisor.Nginx = script("nginx.sh", `if [ -e nginx/run/status.sock ]; then echo stale >> starts; else echo clean >> starts; fi
+touch nginx/run/status.sock
+exit 3`)
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(3)))
+			Expect(read("starts")).To(Equal("clean\nclean\n"))
+		})
+
+		It("starts the metrics process again when it exits", func() {
+			supervisor.Config.Metrics = "nginx/conf/metrics.json"
+			supervisor.Metrics = script("metrics.sh", `echo "$@" >> metrics-starts
+exit 1`)
+			supervisor.Nginx = script("nginx.sh", `while [ "$(cat metrics-starts 2>/dev/null | wc -l)" -lt 3 ]; do sleep 0.05; done`)
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("metrics-starts")).To(HavePrefix(strings.Repeat(appRoot+"/nginx/conf/metrics.json\n", 3)))
+			Expect(stderr.String()).To(ContainSubstring("the metrics process exited with status 1, starting it again"))
+		})
+
+		It("forwards the logs and stops the forwarder once nginx is gone", func() {
+			supervisor.Config.FIFOs = []string{"nginx/logs/access.log"}
+			supervisor.Config.Forward = []launcher.Stream{{Path: "nginx/logs/access.log", Out: "stdout"}}
+			supervisor.Config.LogPrefix = "[web] "
+			supervisor.Logs = script("logs.sh", `echo "$@" > logs-args
+trap 'echo stopped > logs-signal; exit 0' TERM
+`+serve)
+			supervisor.Nginx = script("nginx.sh", `while [ ! -f logs-args ]; do sleep 0.05; done`)
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("logs-args")).To(Equal("-prefix [web]  " + appRoot + "/nginx/logs/access.log:stdout\n"))
+			Expect(read("logs-signal")).To(Equal("stopped\n"))
+			fi, err := os.Stat(filepath.Join(appRoot, "nginx", "logs", "access.log"))
+			Expect(err).To(BeNil())
+			Expect(fi.Mode() & os.ModeNamedPipe).NotTo(BeZero())
+		})
+
+		It("resolves the service upstreams and basic_auth users before rendering nginx.conf", func() {
+			env["VCAP_SERVICES"] = `{"user-provided": [{"name": "backend", "credentials": {"url": "https://api.example.com"}}]}`
+			env["SITE_USERS"] = "alice:$apr1$abc$def"
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "conf", "services.json"), []byte(`[{"service": "backend", "field": "url", "prefix": "/api/", "env": "STATICFILE_UPSTREAM_0", "dir": "nginx/conf/services/upstream_0"}]`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "conf", "auth.json"), []byte(`{"env": "SITE_USERS"}`), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "conf", "nginx.conf"), []byte(`proxy_pass "<%= ENV["STATICFILE_UPSTREAM_0"] %>";`), 0644)).To(Succeed())
+			supervisor.Config.Services = "nginx/conf/services.json"
+			supervisor.Config.Auth = "nginx/conf/auth.json"
+			supervisor.Config.BeforeStart = []string{`echo "$STATICFILE_UPSTREAM_0" > before`}
+			supervisor.Nginx = script("nginx.sh", `cat "$4" > conf`)
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("conf")).To(Equal(`proxy_pass "https://api.example.com";`))
+			Expect(read("before")).To(Equal("https://api.example.com\n"))
+			Expect(read("nginx/conf/.htpasswd-runtime")).To(Equal("alice:$apr1$abc$def\n"))
+		})
+
+		It("fails before starting nginx when a service is not bound", func() {
+			Expect(ioutil.WriteFile(filepath.Join(appRoot, "nginx", "conf", "services.json"), []byte(`[{"service": "backend", "field": "url", "prefix": "/api/", "env": "STATICFILE_UPSTREAM_0"}]`), 0644)).To(Succeed())
+			supervisor.Config.Services = "nginx/conf/services.json"
+			supervisor.Nginx = script("nginx.sh", "touch started")
+
+			_, err := supervisor.Run(signals)
+			Expect(err).To(MatchError("Staticfile proxy /api/: service backend is not bound to the app"))
+			Expect(exists("started")()).To(BeFalse())
+		})
+
+		It("starts the log forwarder again when it exits", func() {
+			supervisor.Config.FIFOs = []string{"nginx/logs/access.log"}
+			supervisor.Config.Forward = []launcher.Stream{{Path: "nginx/logs/access.log", Out: "stdout"}}
+			supervisor.Logs = script("logs.sh", `echo "$@" >> logs-starts
+exit 1`)
+			supervisor.Nginx = script("nginx.sh", `while [ "$(cat logs-starts 2>/dev/null | wc -l)" -lt 3 ]; do sleep 0.05; done`)
+
+			Eventually(run(), 2*time.Second).Should(Receive(Equal(0)))
+			Expect(read("logs-starts")).To(HavePrefix(strings.Repeat(appRoot+"/nginx/logs/access.log:stdout\n", 3)))
+			Expect(stderr.String()).To(ContainSubstring("the log forwarder exited with status 1, starting it again"))
+		})
+
+		It("fails when a before_start command fails", func() {
+			supervisor.Config.BeforeStart = []string{"exit 4"}
+			supervisor.Nginx = script("nginx.sh", "touch started")
+
+			status, err := supervisor.Run(signals)
+			Expect(err).To(MatchError(`before_start command "exit 4" failed: exit status 4`))
+			Expect(status).To(Equal(1))
+			Expect(exists("started")()).To(BeFalse())
+		})
+	})
+})
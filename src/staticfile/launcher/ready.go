@@ -0,0 +1,29 @@
+package launcher
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WaitReady removes marker, waits until addr accepts connections and then
+// creates marker, which the health check endpoint answers 200 for.
+func WaitReady(addr, marker string, interval time.Duration) error {
+	if err := os.MkdirAll(filepath.Dir(marker), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for {
+		conn, err := net.DialTimeout("tcp", addr, interval)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(interval)
+	}
+	return ioutil.WriteFile(marker, nil, 0644)
+}
@@ -0,0 +1,90 @@
+package launcher
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// LaunchEnv is the process environment, with STATICFILE_APP_NAME derived
+// from VCAP_APPLICATION when it is not set.
+func LaunchEnv(key string) (string, bool) {
+	if value, ok := os.LookupEnv(key); ok {
+		return value, ok
+	}
+	if key == "STATICFILE_APP_NAME" {
+		return appName(os.Getenv("VCAP_APPLICATION"))
+	}
+	return "", false
+}
+
+var unsafeNameChars = regexp.MustCompile(`[^\w.-]`)
+
+func appName(vcapApplication string) (string, bool) {
+	var app struct {
+		Name string `json:"application_name"`
+	}
+	if vcapApplication == "" || json.Unmarshal([]byte(vcapApplication), &app) != nil {
+		return "", false
+	}
+	return unsafeNameChars.ReplaceAllString(app.Name, "_"), true
+}
+
+// RenderConfig renders the ERB tags of the nginx.conf at path into a new
+// directory under tmpDir and returns the rendered file. The droplet is left
+// untouched, so the app starts the same way every time. The new directory
+// links to the other files next to nginx.conf, since nginx resolves
+// relative includes such as mime.types against the directory of the
+// configuration. The caller removes the new directory once nginx is done
+// with it.
+func RenderConfig(path, tmpDir string, env Env) (string, error) {
+	rendered, _, err := RenderConfigLines(path, tmpDir, env)
+	return rendered, err
+}
+
+// RenderConfigLines is RenderConfig that also returns the line of the
+// source each rendered line starts on.
+func RenderConfigLines(path, tmpDir string, env Env) (string, []int, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	conf, lines, err := RenderERBLines(filepath.Base(path), string(src), env)
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir(tmpDir, "staticfile-nginx.")
+	if err != nil {
+		return "", nil, err
+	}
+	rendered, err := writeConfig(dir, path, conf)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	return rendered, lines, nil
+}
+
+// writeConfig writes conf to dir next to links to the other files in the
+// directory of path.
+func writeConfig(dir, path, conf string) (string, error) {
+	confDir := filepath.Dir(path)
+	files, err := ioutil.ReadDir(confDir)
+	if err != nil {
+		return "", err
+	}
+	for _, file := range files {
+		if file.Name() == filepath.Base(path) {
+			continue
+		}
+		if err := os.Symlink(filepath.Join(confDir, file.Name()), filepath.Join(dir, file.Name())); err != nil {
+			return "", err
+		}
+	}
+
+	rendered := filepath.Join(dir, filepath.Base(path))
+	return rendered, ioutil.WriteFile(rendered, []byte(conf), 0644)
+}
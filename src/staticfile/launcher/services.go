@@ -0,0 +1,169 @@
+package launcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// serviceBinding is a proxy upstream of services.json, which finalize
+// stages for the proxies bound to a service by name or tag. Dir is
+// relative to the app directory.
+type serviceBinding struct {
+	Service         string `json:"service"`
+	Tag             string `json:"tag"`
+	Field           string `json:"field"`
+	ClientCertField string `json:"client_cert_field"`
+	ClientKeyField  string `json:"client_key_field"`
+	CAField         string `json:"ca_field"`
+	Prefix          string `json:"prefix"`
+	Env             string `json:"env"`
+	Dir             string `json:"dir"`
+}
+
+// service is a service of VCAP_SERVICES.
+type service struct {
+	Name        string                 `json:"name"`
+	Tags        []string               `json:"tags"`
+	Credentials map[string]interface{} `json:"credentials"`
+}
+
+// boundServices reads VCAP_SERVICES.
+func boundServices(env Env) ([]service, error) {
+	vcap, ok := env("VCAP_SERVICES")
+	if !ok || strings.TrimSpace(vcap) == "" {
+		return nil, nil
+	}
+	var byLabel map[string][]service
+	if err := json.Unmarshal([]byte(vcap), &byLabel); err != nil {
+		return nil, fmt.Errorf("VCAP_SERVICES is not valid JSON: %s", err)
+	}
+	var services []service
+	for _, list := range byLabel {
+		services = append(services, list...)
+	}
+	return services, nil
+}
+
+// serviceName names the service called name or, without a name, tagged
+// tag in messages.
+func serviceName(name, tag string) string {
+	if name == "" {
+		return "a service tagged " + tag
+	}
+	return "service " + name
+}
+
+// findService returns the one service called name or, without a name,
+// tagged tag.
+func findService(services []service, name, tag string) (service, error) {
+	what := serviceName(name, tag)
+	var matches []service
+	for _, s := range services {
+		if name != "" && s.Name == name || name == "" && hasTag(s, tag) {
+			matches = append(matches, s)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return service{}, fmt.Errorf("%s is not bound to the app", what)
+	case 1:
+		return matches[0], nil
+	}
+	return service{}, fmt.Errorf("%d services match %s", len(matches), what)
+}
+
+func hasTag(s service, tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// credential looks up a credential by its field, with dots between the
+// keys of nested objects, e.g. api.url.
+func credential(credentials map[string]interface{}, field string) interface{} {
+	var value interface{} = credentials
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[key]
+	}
+	return value
+}
+
+// ResolveServices resolves the proxy upstreams of services.json from
+// VCAP_SERVICES. It returns the upstream URL of each binding by the
+// variable nginx.conf reads it from, and writes the client certificate
+// files of mutual TLS under the app directory.
+func ResolveServices(path, appRoot string, env Env) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var bindings []serviceBinding
+	if err := json.Unmarshal(data, &bindings); err != nil {
+		return nil, err
+	}
+	services, err := boundServices(env)
+	if err != nil {
+		return nil, err
+	}
+
+	upstreams := map[string]string{}
+	for _, binding := range bindings {
+		if err := resolveService(binding, services, appRoot, upstreams); err != nil {
+			return nil, fmt.Errorf("Staticfile proxy %s: %s", binding.Prefix, err)
+		}
+	}
+	return upstreams, nil
+}
+
+func resolveService(binding serviceBinding, services []service, appRoot string, upstreams map[string]string) error {
+	s, err := findService(services, binding.Service, binding.Tag)
+	if err != nil {
+		return err
+	}
+	what := serviceName(binding.Service, binding.Tag)
+
+	upstream, ok := credential(s.Credentials, binding.Field).(string)
+	if !ok {
+		return fmt.Errorf("%s has no %s credential", what, binding.Field)
+	}
+	parsed, err := url.Parse(upstream)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || strings.ContainsAny(upstream, " \t\r\n;{}\"") {
+		return fmt.Errorf("the %s credential of %s is not an http:// or https:// URL", binding.Field, what)
+	}
+	upstreams[binding.Env] = upstream
+
+	files := []struct{ name, field string }{
+		{"client.crt", binding.ClientCertField},
+		{"client.key", binding.ClientKeyField},
+		{"ca.crt", binding.CAField},
+	}
+	for _, file := range files {
+		if file.field == "" {
+			continue
+		}
+		pem, ok := credential(s.Credentials, file.field).(string)
+		if !ok {
+			return fmt.Errorf("%s has no %s credential", what, file.field)
+		}
+		dir := filepath.Join(appRoot, binding.Dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file.name), []byte(pem), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
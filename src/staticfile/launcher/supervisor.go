@@ -0,0 +1,396 @@
+package launcher
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/logs"
+)
+
+const (
+	// stableAfter is how long nginx has to run before a crash no longer
+	// counts against Config.Restarts.
+	stableAfter = time.Minute
+	// killAfter bounds how long a process has to exit after SIGTERM.
+	killAfter = 6 * time.Second
+)
+
+// Signals are the signals the supervisor handles. SIGTERM and SIGQUIT
+// stop nginx gracefully and SIGINT stops it at once; the others are
+// forwarded to nginx, e.g. SIGHUP reloads its configuration.
+var Signals = []os.Signal{
+	syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT,
+	syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGWINCH,
+}
+
+// Supervisor is the web process of the app. It starts the log forwarder,
+// resolves the service upstreams and basic_auth users, runs the
+// before_start commands, renders nginx.conf and starts the helpers and
+// nginx, then stays in front of nginx until it exits.
+type Supervisor struct {
+	Config  Config
+	AppRoot string
+	Env     Env
+	TmpDir  string
+	// Addr is where nginx listens, for the readiness marker.
+	Addr   string
+	Stdout io.Writer
+	Stderr io.Writer
+	// Nginx, Logs and Metrics are the executables started, looked up on
+	// the PATH unless they contain a slash.
+	Nginx   string
+	Logs    string
+	Metrics string
+	// RestartDelay is how long to wait before starting nginx again.
+	RestartDelay time.Duration
+
+	// vars are the variables set for nginx.conf and the children, such as
+	// the resolved service upstreams.
+	vars map[string]string
+}
+
+// Run starts the app and returns the exit status of the launcher once
+// nginx has exited or has been stopped by one of signals.
+func (s *Supervisor) Run(signals <-chan os.Signal) (int, error) {
+	var helpers []*helper
+	defer func() {
+		// nginx is gone, so the helpers stop in reverse order and the log
+		// forwarder, started first, writes the last lines.
+		for i := len(helpers) - 1; i >= 0; i-- {
+			helpers[i].stop(syscall.SIGTERM)
+		}
+	}()
+
+	if len(s.Config.Forward) > 0 {
+		for _, fifo := range s.Config.FIFOs {
+			if err := logs.CreateFIFO(s.path(fifo)); err != nil {
+				return 1, fmt.Errorf("unable to create %s: %s", fifo, err)
+			}
+		}
+		var args []string
+		if s.Config.LogPrefix != "" {
+			args = append(args, "-prefix", s.Config.LogPrefix)
+		}
+		for _, stream := range s.Config.Forward {
+			args = append(args, s.path(stream.Path)+":"+stream.Out)
+		}
+		forwarder, err := s.startHelper("the log forwarder", s.Logs, args...)
+		if err != nil {
+			return 1, fmt.Errorf("unable to start the log forwarder: %s", err)
+		}
+		helpers = append(helpers, forwarder)
+	}
+
+	if s.Config.Services != "" {
+		upstreams, err := ResolveServices(s.path(s.Config.Services), s.AppRoot, s.Env)
+		if err != nil {
+			return 1, err
+		}
+		s.vars = upstreams
+	}
+	if s.Config.Auth != "" {
+		warnings, err := WriteAuth(s.path(s.Config.Auth), s.Env)
+		if err != nil {
+			return 1, err
+		}
+		for _, warning := range warnings {
+			s.logf("%s", warning)
+		}
+	}
+
+	for _, command := range s.Config.BeforeStart {
+		stopped, err := s.beforeStart(command, signals)
+		if err != nil {
+			return 1, err
+		}
+		if stopped {
+			return 0, nil
+		}
+	}
+
+	conf, err := RenderConfig(s.path(s.Config.Conf), s.TmpDir, s.env)
+	if err != nil {
+		return 1, fmt.Errorf("unable to render %s: %s", s.Config.Conf, err)
+	}
+	defer os.RemoveAll(filepath.Dir(conf))
+
+	if s.Config.Metrics != "" {
+		metrics, err := s.startHelper("the metrics process", s.Metrics, s.path(s.Config.Metrics))
+		if err != nil {
+			return 1, fmt.Errorf("unable to start the metrics process: %s", err)
+		}
+		helpers = append(helpers, metrics)
+	}
+	if s.Config.Ready != "" {
+		go func() {
+			if err := WaitReady(s.Addr, s.path(s.Config.Ready), 200*time.Millisecond); err != nil {
+				s.logf("unable to mark nginx ready: %s", err)
+			}
+		}()
+	}
+
+	return s.supervise(conf, signals)
+}
+
+// beforeStart runs one before_start command, reporting whether a signal
+// stopped it.
+func (s *Supervisor) beforeStart(command string, signals <-chan os.Signal) (bool, error) {
+	s.logf("running %s", command)
+	p, err := s.start("sh", "-c", command)
+	if err != nil {
+		return false, err
+	}
+	for {
+		select {
+		case <-p.done:
+			if p.err != nil {
+				return false, fmt.Errorf("before_start command %q failed: %s", command, p.err)
+			}
+			return false, nil
+		case sig := <-signals:
+			if stops(sig) {
+				p.stop(syscall.SIGTERM)
+				return true, nil
+			}
+			p.signal(sig)
+		}
+	}
+}
+
+// supervise runs nginx, starting it again after a crash while restarts
+// are left.
+func (s *Supervisor) supervise(conf string, signals <-chan os.Signal) (int, error) {
+	restarts := 0
+	for {
+		for _, socket := range s.Config.Sockets {
+			if err := os.Remove(s.path(socket)); err != nil && !os.IsNotExist(err) {
+				s.logf("unable to remove %s: %s", socket, err)
+			}
+		}
+		started := time.Now()
+		nginx, err := s.start(s.Nginx, "-p", s.path("nginx"), "-c", conf)
+		if err != nil {
+			return 1, fmt.Errorf("unable to start nginx: %s", err)
+		}
+		if stopped := s.wait(nginx, signals); stopped {
+			return nginx.status(), nil
+		}
+
+		status := nginx.status()
+		if time.Since(started) >= stableAfter {
+			restarts = 0
+		}
+		if status == 0 || restarts >= s.Config.Restarts {
+			s.logf("nginx exited with status %d", status)
+			return status, nil
+		}
+		restarts++
+		s.logf("nginx exited with status %d, restarting it (%d of %d)", status, restarts, s.Config.Restarts)
+
+		timer := time.NewTimer(s.RestartDelay)
+	delay:
+		for {
+			select {
+			case <-timer.C:
+				break delay
+			case sig := <-signals:
+				if stops(sig) {
+					timer.Stop()
+					return status, nil
+				}
+			}
+		}
+	}
+}
+
+// wait forwards signals to nginx until it exits, reporting whether it was
+// asked to stop.
+func (s *Supervisor) wait(nginx *process, signals <-chan os.Signal) bool {
+	for {
+		select {
+		case <-nginx.done:
+			return false
+		case sig := <-signals:
+			switch {
+			case sig == syscall.SIGINT:
+				nginx.stop(syscall.SIGTERM)
+				return true
+			case stops(sig):
+				s.drain(nginx)
+				return true
+			default:
+				nginx.signal(sig)
+			}
+		}
+	}
+}
+
+// drain asks nginx to quit once the requests in flight are done, and
+// stops it at once when that takes longer than the drain timeout.
+func (s *Supervisor) drain(nginx *process) {
+	timeout := time.Duration(s.Config.DrainTimeout) * time.Second
+	s.logf("stopping nginx, waiting up to %s for requests in flight", timeout)
+	nginx.signal(syscall.SIGQUIT)
+	select {
+	case <-nginx.done:
+	case <-time.After(timeout):
+		s.logf("nginx is still serving after %s, stopping it now", timeout)
+		nginx.stop(syscall.SIGTERM)
+	}
+}
+
+func stops(sig os.Signal) bool {
+	return sig == syscall.SIGTERM || sig == syscall.SIGQUIT || sig == syscall.SIGINT
+}
+
+// env is Env with vars.
+func (s *Supervisor) env(key string) (string, bool) {
+	if value, ok := s.vars[key]; ok {
+		return value, true
+	}
+	return s.Env(key)
+}
+
+func (s *Supervisor) path(name string) string {
+	return filepath.Join(s.AppRoot, name)
+}
+
+func (s *Supervisor) logf(format string, args ...interface{}) {
+	fmt.Fprintf(s.Stderr, "staticfile-launcher: "+format+"\n", args...)
+}
+
+// process is a child of the launcher, which Wait reaps as soon as it exits.
+type process struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+func (s *Supervisor) start(name string, args ...string) (*process, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = s.AppRoot
+	cmd.Stdout = s.Stdout
+	cmd.Stderr = s.Stderr
+	if len(s.vars) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range s.vars {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
+	// A process group of its own keeps a signal sent to the group of the
+	// launcher from reaching the child, so nginx is not stopped before it
+	// has drained and the log forwarder outlives it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &process{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		p.err = cmd.Wait()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// helper is a process that runs next to nginx, such as the log forwarder
+// and the metrics process, which nginx blocks on when they stop reading
+// their FIFOs. It is started again whenever it exits, until it is stopped.
+type helper struct {
+	name string
+	args []string
+	what string
+
+	mu      sync.Mutex
+	current *process
+	stopped bool
+}
+
+func (s *Supervisor) startHelper(what, name string, args ...string) (*helper, error) {
+	p, err := s.start(name, args...)
+	if err != nil {
+		return nil, err
+	}
+	h := &helper{name: name, args: args, what: what, current: p}
+	go s.keep(h)
+	return h, nil
+}
+
+// keep starts h again each time it exits, after RestartDelay.
+func (s *Supervisor) keep(h *helper) {
+	for {
+		h.mu.Lock()
+		p := h.current
+		h.mu.Unlock()
+		<-p.done
+
+		if h.isStopped() {
+			return
+		}
+		s.logf("%s exited with status %d, starting it again", h.what, p.status())
+		time.Sleep(s.RestartDelay)
+
+		h.mu.Lock()
+		if !h.stopped {
+			if next, err := s.start(h.name, h.args...); err != nil {
+				s.logf("unable to start %s: %s", h.what, err)
+			} else {
+				h.current = next
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *helper) isStopped() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stopped
+}
+
+// stop stops h for good.
+func (h *helper) stop(sig syscall.Signal) {
+	h.mu.Lock()
+	h.stopped = true
+	p := h.current
+	h.mu.Unlock()
+	p.stop(sig)
+}
+
+func (p *process) signal(sig os.Signal) {
+	p.cmd.Process.Signal(sig)
+}
+
+// stop signals the process group and waits for the process, killing the
+// group when it has not exited after killAfter.
+func (p *process) stop(sig syscall.Signal) {
+	syscall.Kill(-p.cmd.Process.Pid, sig)
+	select {
+	case <-p.done:
+	case <-time.After(killAfter):
+		syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+		<-p.done
+	}
+}
+
+// status is the exit status of the process, which is 128 plus the signal
+// when a signal killed it, as in a shell.
+func (p *process) status() int {
+	exit, ok := p.err.(*exec.ExitError)
+	if !ok {
+		if p.err != nil {
+			return 1
+		}
+		return 0
+	}
+	if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exit.ExitCode()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/logs"
+)
+
+func main() {
+	prefix := flag.String("prefix", "", "prepended to every forwarded line")
+	drain := flag.Duration("drain", 5*time.Second, "how long to keep forwarding once SIGTERM arrives")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-prefix <prefix>] <fifo>:stdout|stderr...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	forwarder := &logs.Forwarder{Prefix: *prefix, Drain: *drain}
+	for _, arg := range flag.Args() {
+		i := strings.LastIndex(arg, ":")
+		if i < 0 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		var out io.Writer
+		switch arg[i+1:] {
+		case "stdout":
+			out = os.Stdout
+		case "stderr":
+			out = os.Stderr
+		default:
+			flag.Usage()
+			os.Exit(2)
+		}
+		forwarder.Streams = append(forwarder.Streams, &logs.Stream{Name: filepath.Base(arg[:i]), Path: arg[:i], Out: out})
+	}
+
+	// The launcher sends SIGTERM once nginx is gone, and the forwarder
+	// drains what nginx wrote while it shut down.
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		close(done)
+	}()
+	if err := forwarder.Run(done); err != nil {
+		fmt.Fprintf(os.Stderr, "staticfile-logs: %s\n", err)
+		os.Exit(1)
+	}
+}
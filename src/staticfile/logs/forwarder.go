@@ -0,0 +1,164 @@
+// Package logs forwards the access and error logs that nginx writes to
+// FIFOs onto the stdout and stderr of the app, where Cloud Foundry picks
+// them up.
+package logs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultBuffer is the number of lines a Stream holds while its output
+// stalls. Lines beyond it are dropped so that nginx never blocks on a full
+// FIFO.
+const DefaultBuffer = 10000
+
+// CreateFIFO makes path a FIFO. An existing FIFO is kept, and anything
+// else at path is replaced, so that nginx never logs to a regular file no
+// one reads.
+func CreateFIFO(path string) error {
+	info, err := os.Lstat(path)
+	if err == nil {
+		if info.Mode()&os.ModeNamedPipe != 0 {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := syscall.Mkfifo(path, 0600); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stream copies the lines written to the FIFO at Path to Out.
+type Stream struct {
+	Name string
+	Path string
+	Out  io.Writer
+
+	lines   chan string
+	read    uint64
+	written uint64
+	// dropped counts the lines lost since the last notice, lost all of
+	// them.
+	dropped uint64
+	lost    uint64
+}
+
+// Forwarder copies each Stream to its output, tagging lines with Prefix.
+type Forwarder struct {
+	Prefix  string
+	Streams []*Stream
+	// Buffer is the number of lines held per stream, DefaultBuffer when 0.
+	Buffer int
+	// Drain bounds how long Run keeps forwarding once done is closed.
+	Drain time.Duration
+}
+
+// Run forwards the streams until done is closed, then until the lines
+// already written by nginx are out or Drain has passed.
+func (f *Forwarder) Run(done <-chan struct{}) error {
+	buffer := f.Buffer
+	if buffer == 0 {
+		buffer = DefaultBuffer
+	}
+	for _, s := range f.Streams {
+		if err := CreateFIFO(s.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range f.Streams {
+		s.lines = make(chan string, buffer)
+		go f.write(s)
+		go f.read(s)
+	}
+
+	<-done
+	f.drain()
+	return nil
+}
+
+// read opens the FIFO again each time nginx closes it, as it does when it
+// reopens its logs or restarts.
+func (f *Forwarder) read(s *Stream) {
+	for {
+		file, err := os.Open(s.Path)
+		if err != nil {
+			f.enqueue(s, fmt.Sprintf("staticfile-logs: unable to open %s: %s\n", s.Path, err))
+			time.Sleep(time.Second)
+			CreateFIFO(s.Path)
+			continue
+		}
+
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				if !strings.HasSuffix(line, "\n") {
+					line += "\n"
+				}
+				f.enqueue(s, f.Prefix+line)
+			}
+			if err != nil {
+				break
+			}
+		}
+		file.Close()
+	}
+}
+
+// enqueue never blocks: a line that does not fit is counted and dropped.
+func (f *Forwarder) enqueue(s *Stream, line string) {
+	atomic.AddUint64(&s.read, 1)
+	select {
+	case s.lines <- line:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.AddUint64(&s.lost, 1)
+	}
+}
+
+func (f *Forwarder) write(s *Stream) {
+	for line := range s.lines {
+		if n := atomic.SwapUint64(&s.dropped, 0); n > 0 {
+			fmt.Fprintf(s.Out, "%sstaticfile-logs: dropped %d %s lines while the output was blocked\n", f.Prefix, n, s.Name)
+		}
+		io.WriteString(s.Out, line)
+		atomic.AddUint64(&s.written, 1)
+	}
+}
+
+// drain waits until every line read has been written or dropped and no
+// stream has read a line for a moment.
+func (f *Forwarder) drain() {
+	deadline := time.Now().Add(f.Drain)
+	last, _ := f.progress()
+	for time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		read, out := f.progress()
+		if read == last && read == out {
+			return
+		}
+		last = read
+	}
+}
+
+// progress counts the lines read, and those written or dropped.
+func (f *Forwarder) progress() (read, out uint64) {
+	for _, s := range f.Streams {
+		read += atomic.LoadUint64(&s.read)
+		out += atomic.LoadUint64(&s.written) + atomic.LoadUint64(&s.lost)
+	}
+	return read, out
+}
@@ -0,0 +1,144 @@
+package logs_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/logs"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// syncBuffer is a bytes.Buffer safe to read while the forwarder writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// stalledWriter blocks every write until released.
+type stalledWriter struct {
+	release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return len(p), nil
+}
+
+var _ = Describe("Forwarder", func() {
+	var (
+		err    error
+		dir    string
+		access string
+	)
+
+	BeforeEach(func() {
+		dir, err = ioutil.TempDir("", "staticfile-buildpack.logs.")
+		Expect(err).To(BeNil())
+		access = filepath.Join(dir, "access.log")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	writeLines := func(lines string) {
+		f, err := os.OpenFile(access, os.O_WRONLY, 0)
+		Expect(err).To(BeNil())
+		_, err = f.WriteString(lines)
+		Expect(err).To(BeNil())
+		Expect(f.Close()).To(Succeed())
+	}
+
+	Describe("CreateFIFO", func() {
+		It("creates a FIFO once", func() {
+			Expect(logs.CreateFIFO(access)).To(Succeed())
+			Expect(logs.CreateFIFO(access)).To(Succeed())
+			info, err := os.Stat(access)
+			Expect(err).To(BeNil())
+			Expect(info.Mode() & os.ModeNamedPipe).NotTo(BeZero())
+		})
+
+		It("replaces a regular file", func() {
+			Expect(ioutil.WriteFile(access, []byte("stale"), 0644)).To(Succeed())
+			Expect(logs.CreateFIFO(access)).To(Succeed())
+			info, err := os.Stat(access)
+			Expect(err).To(BeNil())
+			Expect(info.Mode() & os.ModeNamedPipe).NotTo(BeZero())
+		})
+	})
+
+	Describe("Run", func() {
+		var (
+			done     chan struct{}
+			finished chan error
+		)
+
+		start := func(forwarder *logs.Forwarder) {
+			done = make(chan struct{})
+			finished = make(chan error, 1)
+			go func() { finished <- forwarder.Run(done) }()
+			Eventually(func() error {
+				_, err := os.Stat(access)
+				return err
+			}).Should(Succeed())
+		}
+
+		It("prefixes lines and reopens the FIFO", func() {
+			out := &syncBuffer{}
+			start(&logs.Forwarder{Prefix: "[web] ", Streams: []*logs.Stream{{Name: "access.log", Path: access, Out: out}}, Drain: time.Second})
+
+			writeLines("GET /\nGET /a")
+			Eventually(out.String).Should(Equal("[web] GET /\n[web] GET /a\n"))
+			writeLines("GET /b\n")
+			Eventually(out.String).Should(Equal("[web] GET /\n[web] GET /a\n[web] GET /b\n"))
+
+			close(done)
+			Eventually(finished).Should(Receive(BeNil()))
+		})
+
+		It("drops lines instead of blocking nginx when the output stalls", func() {
+			out := stalledWriter{release: make(chan struct{})}
+			start(&logs.Forwarder{Streams: []*logs.Stream{{Name: "access.log", Path: access, Out: out}}, Buffer: 2})
+
+			written := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				for i := 0; i < 100; i++ {
+					writeLines("GET / HTTP/1.1 200\n")
+				}
+				close(written)
+			}()
+			Eventually(written).Should(BeClosed())
+
+			close(out.release)
+			close(done)
+			Eventually(finished).Should(Receive(BeNil()))
+		})
+
+		It("creates its FIFOs", func() {
+			start(&logs.Forwarder{Streams: []*logs.Stream{{Name: "access.log", Path: access, Out: &syncBuffer{}}}})
+			info, err := os.Stat(access)
+			Expect(err).To(BeNil())
+			Expect(info.Mode() & os.ModeNamedPipe).NotTo(BeZero())
+			close(done)
+		})
+	})
+})
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/metrics"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("staticfile-metrics: ")
+
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <metrics.json>", os.Args[0])
+	}
+
+	data, err := ioutil.ReadFile(os.Args[1])
+	if err != nil {
+		log.Fatalf("unable to read config: %s", err)
+	}
+	var config metrics.Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		log.Fatalf("unable to parse config: %s", err)
+	}
+	config.Resolve(os.Getenv("APP_ROOT"))
+
+	collector := metrics.NewCollector(config.Prefixes, config.Buckets)
+	go consume(collector, config.Log)
+
+	server := &http.Server{
+		Addr:        fmt.Sprintf(":%d", config.Port),
+		Handler:     metrics.Handler{Collector: collector, Status: metrics.UnixStatus(config.Status)},
+		ReadTimeout: 10 * time.Second,
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// consume reads the metrics log FIFO, opening it again each time nginx
+// closes it.
+func consume(collector *metrics.Collector, path string) {
+	for {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Printf("unable to open %s: %s", path, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := collector.Consume(f); err != nil {
+			log.Printf("unable to read %s: %s", path, err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// Path is where Handler serves the metrics.
+const Path = "/metrics"
+
+// Handler serves the stub_status and request metrics at Path. nginx_up is
+// 0 when stub_status cannot be read, and the request metrics are served
+// regardless.
+type Handler struct {
+	Collector *Collector
+	Status    func() (StubStatus, error)
+}
+
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != Path {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := new(bytes.Buffer)
+	status, err := h.Status()
+	body.WriteString("# HELP nginx_up Whether nginx answered the stub_status request.\n# TYPE nginx_up gauge\n")
+	if err != nil {
+		body.WriteString("nginx_up 0\n")
+	} else {
+		body.WriteString("nginx_up 1\n")
+		status.WriteTo(body)
+	}
+	h.Collector.WriteTo(body)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(body.Bytes())
+}
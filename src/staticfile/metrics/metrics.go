@@ -0,0 +1,250 @@
+// Package metrics serves Prometheus metrics for the nginx process of a
+// staticfile app. Connection counts come from nginx's stub_status, and
+// request counts and latencies from an access log that nginx writes to a
+// FIFO in a format of its own.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Config is the metrics.json that finalize writes next to nginx.conf.
+// Log and Status are relative to the app directory.
+type Config struct {
+	Port     int       `json:"port"`
+	Log      string    `json:"log"`
+	Status   string    `json:"status"`
+	Prefixes []string  `json:"prefixes"`
+	Buckets  []float64 `json:"buckets"`
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets, as in the Prometheus client libraries.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// LogFormat is the nginx log_format of the metrics log. The URI comes last
+// because it is the only field that may contain spaces.
+const LogFormat = "$status $request_time $uri"
+
+// OtherPrefix labels requests matching none of the configured prefixes.
+const OtherPrefix = "other"
+
+// Resolve makes Log and Status absolute against the app directory.
+func (c *Config) Resolve(appRoot string) {
+	if !filepath.IsAbs(c.Log) {
+		c.Log = filepath.Join(appRoot, c.Log)
+	}
+	if !filepath.IsAbs(c.Status) {
+		c.Status = filepath.Join(appRoot, c.Status)
+	}
+}
+
+type requestKey struct {
+	Status string
+	Prefix string
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Collector counts the requests read from the metrics log by status and
+// path prefix, and their latencies by path prefix.
+type Collector struct {
+	mu        sync.Mutex
+	prefixes  []string
+	buckets   []float64
+	requests  map[requestKey]uint64
+	durations map[string]*histogram
+	skipped   uint64
+	// dropped is updated atomically, as Consume must not wait for mu.
+	dropped uint64
+}
+
+// NewCollector returns a Collector labelling requests with the longest of
+// prefixes that matches their URI. Without prefixes every request is
+// labelled "/".
+func NewCollector(prefixes []string, buckets []float64) *Collector {
+	if len(prefixes) == 0 {
+		prefixes = []string{"/"}
+	}
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]string{}, prefixes...)
+	sort.SliceStable(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	return &Collector{
+		prefixes:  sorted,
+		buckets:   buckets,
+		requests:  map[requestKey]uint64{},
+		durations: map[string]*histogram{},
+	}
+}
+
+// Observe records one line of the metrics log. It reports whether the line
+// was in LogFormat.
+func (c *Collector) Observe(line string) bool {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), " ", 3)
+	if len(fields) != 3 {
+		c.skip()
+		return false
+	}
+	if _, err := strconv.Atoi(fields[0]); err != nil {
+		c.skip()
+		return false
+	}
+	seconds, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		c.skip()
+		return false
+	}
+	prefix := c.prefix(fields[2])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[requestKey{Status: fields[0], Prefix: prefix}]++
+	h, ok := c.durations[prefix]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(c.buckets))}
+		c.durations[prefix] = h
+	}
+	for i, bound := range c.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+	return true
+}
+
+func (c *Collector) skip() {
+	c.mu.Lock()
+	c.skipped++
+	c.mu.Unlock()
+}
+
+func (c *Collector) prefix(uri string) string {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(uri, prefix) {
+			return prefix
+		}
+	}
+	return OtherPrefix
+}
+
+// consumeBacklog is how many lines read from the metrics log wait to be
+// observed before Consume drops lines.
+const consumeBacklog = 4096
+
+// Consume reads the lines of r until it is closed, for the collector to
+// observe. It reads lines as soon as nginx writes them and drops those
+// that find the backlog full, so that a collector held up, e.g. by a slow
+// scrape, never blocks the writes of nginx to the FIFO. The lines left in
+// the backlog are observed after Consume returns.
+func (c *Collector) Consume(r io.Reader) error {
+	lines := make(chan string, consumeBacklog)
+	go func() {
+		for line := range lines {
+			c.Observe(line)
+		}
+	}()
+	defer close(lines)
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			select {
+			case lines <- line:
+			default:
+				atomic.AddUint64(&c.dropped, 1)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteTo writes the request metrics in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	out := &countingWriter{w: w}
+	keys := make([]requestKey, 0, len(c.requests))
+	for key := range c.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Prefix != keys[j].Prefix {
+			return keys[i].Prefix < keys[j].Prefix
+		}
+		return keys[i].Status < keys[j].Status
+	})
+	out.printf("# HELP staticfile_http_requests_total Requests served by nginx, by status and path prefix.\n")
+	out.printf("# TYPE staticfile_http_requests_total counter\n")
+	for _, key := range keys {
+		out.printf("staticfile_http_requests_total{status=%q,prefix=%q} %d\n", key.Status, key.Prefix, c.requests[key])
+	}
+
+	prefixes := make([]string, 0, len(c.durations))
+	for prefix := range c.durations {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	out.printf("# HELP staticfile_http_request_duration_seconds Time nginx took to serve requests, by path prefix.\n")
+	out.printf("# TYPE staticfile_http_request_duration_seconds histogram\n")
+	for _, prefix := range prefixes {
+		h := c.durations[prefix]
+		for i, bound := range c.buckets {
+			out.printf("staticfile_http_request_duration_seconds_bucket{prefix=%q,le=%q} %d\n", prefix, formatFloat(bound), h.counts[i])
+		}
+		out.printf("staticfile_http_request_duration_seconds_bucket{prefix=%q,le=\"+Inf\"} %d\n", prefix, h.count)
+		out.printf("staticfile_http_request_duration_seconds_sum{prefix=%q} %s\n", prefix, formatFloat(h.sum))
+		out.printf("staticfile_http_request_duration_seconds_count{prefix=%q} %d\n", prefix, h.count)
+	}
+
+	out.printf("# HELP staticfile_metrics_log_skipped_total Lines of the metrics log that could not be parsed.\n")
+	out.printf("# TYPE staticfile_metrics_log_skipped_total counter\n")
+	out.printf("staticfile_metrics_log_skipped_total %d\n", c.skipped)
+	out.printf("# HELP staticfile_metrics_log_dropped_total Lines of the metrics log dropped because the collector fell behind.\n")
+	out.printf("# TYPE staticfile_metrics_log_dropped_total counter\n")
+	out.printf("staticfile_metrics_log_dropped_total %d\n", atomic.LoadUint64(&c.dropped))
+	return out.n, out.err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingWriter keeps the first write error, so WriteTo can print without
+// checking each line.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) printf(format string, args ...interface{}) {
+	if c.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(c.w, format, args...)
+	c.n += int64(n)
+	c.err = err
+}
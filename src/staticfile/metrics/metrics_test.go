@@ -0,0 +1,154 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cloudfoundry/staticfile-buildpack/src/staticfile/metrics"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics", func() {
+	var collector *metrics.Collector
+
+	BeforeEach(func() {
+		collector = metrics.NewCollector([]string{"/", "/api/", "/api/v2/"}, []float64{0.01, 0.1, 1})
+	})
+
+	Describe("Collector", func() {
+		It("counts requests by status and the longest matching prefix", func() {
+			err := collector.Consume(strings.NewReader("200 0.003 /index.html\n200 0.050 /api/users\n404 0.001 /api/v2/a b\n200 1.500 /api/users\nnot a line\n"))
+			Expect(err).To(BeNil())
+
+			out := new(bytes.Buffer)
+			Eventually(func() string {
+				out.Reset()
+				collector.WriteTo(out)
+				return out.String()
+			}).Should(ContainSubstring("staticfile_metrics_log_skipped_total 1\n"))
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_requests_total{status="200",prefix="/"} 1` + "\n"))
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_requests_total{status="200",prefix="/api/"} 2` + "\n"))
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_requests_total{status="404",prefix="/api/v2/"} 1` + "\n"))
+			Expect(out.String()).To(ContainSubstring("staticfile_metrics_log_skipped_total 1\n"))
+		})
+
+		It("drops lines rather than block the writer while the collector is held up", func() {
+			// WriteTo holds the collector while it writes, here until the
+			// pipe is read.
+			r, w := io.Pipe()
+			go collector.WriteTo(w)
+			_, err := r.Read(make([]byte, 1))
+			Expect(err).To(BeNil())
+
+			err = collector.Consume(strings.NewReader(strings.Repeat("200 0.001 /index.html\n", 5000)))
+			Expect(err).To(BeNil())
+			go ioutil.ReadAll(r)
+
+			counts := regexp.MustCompile(`(?m)^(?:staticfile_http_requests_total\{status="200",prefix="/"\}|staticfile_metrics_log_dropped_total) (\d+)$`)
+			total := func() []int {
+				out := new(bytes.Buffer)
+				collector.WriteTo(out)
+				var n []int
+				for _, m := range counts.FindAllStringSubmatch(out.String(), -1) {
+					count, _ := strconv.Atoi(m[1])
+					n = append(n, count)
+				}
+				return n
+			}
+			Eventually(func() int {
+				n := total()
+				if len(n) != 2 {
+					return 0
+				}
+				return n[0] + n[1]
+			}).Should(Equal(5000))
+			Expect(total()[1]).To(BeNumerically(">", 0))
+		})
+
+		It("builds cumulative latency histograms", func() {
+			collector.Observe("200 0.050 /api/users")
+			collector.Observe("200 1.500 /api/users")
+
+			out := new(bytes.Buffer)
+			collector.WriteTo(out)
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_request_duration_seconds_bucket{prefix="/api/",le="0.01"} 0
+staticfile_http_request_duration_seconds_bucket{prefix="/api/",le="0.1"} 1
+staticfile_http_request_duration_seconds_bucket{prefix="/api/",le="1"} 1
+staticfile_http_request_duration_seconds_bucket{prefix="/api/",le="+Inf"} 2
+staticfile_http_request_duration_seconds_sum{prefix="/api/"} 1.55
+staticfile_http_request_duration_seconds_count{prefix="/api/"} 2
+`))
+		})
+
+		It("labels requests outside the prefixes as other", func() {
+			collector = metrics.NewCollector([]string{"/api/"}, nil)
+			Expect(collector.Observe("200 0.001 /index.html")).To(BeTrue())
+
+			out := new(bytes.Buffer)
+			collector.WriteTo(out)
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_requests_total{status="200",prefix="other"} 1`))
+			Expect(out.String()).To(ContainSubstring(`staticfile_http_request_duration_seconds_bucket{prefix="other",le="0.005"} 1`))
+		})
+	})
+
+	Describe("ParseStubStatus", func() {
+		It("reads the stub_status page", func() {
+			status, err := metrics.ParseStubStatus(strings.NewReader("Active connections: 291 \nserver accepts handled requests\n 16630948 16630947 31070465 \nReading: 6 Writing: 179 Waiting: 106 \n"))
+			Expect(err).To(BeNil())
+			Expect(status).To(Equal(metrics.StubStatus{Active: 291, Accepts: 16630948, Handled: 16630947, Requests: 31070465, Reading: 6, Writing: 179, Waiting: 106}))
+		})
+
+		It("rejects other pages", func() {
+			_, err := metrics.ParseStubStatus(strings.NewReader("<html>Not Found</html>"))
+			Expect(err).To(MatchError("unexpected stub_status output"))
+		})
+	})
+
+	Describe("Handler", func() {
+		var (
+			handler  metrics.Handler
+			recorder *httptest.ResponseRecorder
+		)
+
+		BeforeEach(func() {
+			collector.Observe("200 0.002 /")
+			handler = metrics.Handler{Collector: collector, Status: func() (metrics.StubStatus, error) {
+				return metrics.StubStatus{Active: 2, Accepts: 10, Handled: 10, Requests: 24, Writing: 1, Waiting: 1}, nil
+			}}
+			recorder = httptest.NewRecorder()
+		})
+
+		It("serves the metrics in the Prometheus text format", func() {
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("text/plain; version=0.0.4; charset=utf-8"))
+			Expect(recorder.Body.String()).To(ContainSubstring("nginx_up 1\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring("# TYPE nginx_connections_active gauge\nnginx_connections_active 2\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring("# TYPE nginx_http_requests_total counter\nnginx_http_requests_total 24\n"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`staticfile_http_requests_total{status="200",prefix="/"} 1`))
+		})
+
+		It("reports nginx as down when stub_status fails", func() {
+			handler.Status = func() (metrics.StubStatus, error) { return metrics.StubStatus{}, errors.New("connection refused") }
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring("nginx_up 0\n"))
+			Expect(recorder.Body.String()).NotTo(ContainSubstring("nginx_connections_active"))
+			Expect(recorder.Body.String()).To(ContainSubstring(`staticfile_http_requests_total{status="200",prefix="/"} 1`))
+		})
+
+		It("serves nothing else", func() {
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
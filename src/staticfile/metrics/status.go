@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StubStatus is the output of nginx's stub_status.
+type StubStatus struct {
+	Active   uint64
+	Accepts  uint64
+	Handled  uint64
+	Requests uint64
+	Reading  uint64
+	Writing  uint64
+	Waiting  uint64
+}
+
+// ParseStubStatus reads the stub_status page:
+//
+//	Active connections: 2
+//	server accepts handled requests
+//	 10 10 24
+//	Reading: 0 Writing: 1 Waiting: 1
+func ParseStubStatus(r io.Reader) (StubStatus, error) {
+	var words []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		words = append(words, strings.Fields(scanner.Text())...)
+	}
+	if err := scanner.Err(); err != nil {
+		return StubStatus{}, err
+	}
+
+	expected := []string{"Active", "connections:", "", "server", "accepts", "handled", "requests", "", "", "", "Reading:", "", "Writing:", "", "Waiting:", ""}
+	if len(words) != len(expected) {
+		return StubStatus{}, fmt.Errorf("unexpected stub_status output")
+	}
+	var numbers []uint64
+	for i, word := range words {
+		if expected[i] != "" {
+			if word != expected[i] {
+				return StubStatus{}, fmt.Errorf("unexpected stub_status output")
+			}
+			continue
+		}
+		n, err := strconv.ParseUint(word, 10, 64)
+		if err != nil {
+			return StubStatus{}, fmt.Errorf("unexpected stub_status value %q", word)
+		}
+		numbers = append(numbers, n)
+	}
+	return StubStatus{
+		Active:   numbers[0],
+		Accepts:  numbers[1],
+		Handled:  numbers[2],
+		Requests: numbers[3],
+		Reading:  numbers[4],
+		Writing:  numbers[5],
+		Waiting:  numbers[6],
+	}, nil
+}
+
+// UnixStatus returns a function fetching stub_status from nginx over the
+// unix socket it listens on for the metrics process.
+func UnixStatus(socket string) func() (StubStatus, error) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	return func() (StubStatus, error) {
+		resp, err := client.Get("http://nginx/stub_status")
+		if err != nil {
+			return StubStatus{}, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return StubStatus{}, fmt.Errorf("stub_status returned %s", resp.Status)
+		}
+		return ParseStubStatus(resp.Body)
+	}
+}
+
+// WriteTo writes the stub_status counters in the Prometheus text format.
+func (s StubStatus) WriteTo(w io.Writer) (int64, error) {
+	out := &countingWriter{w: w}
+	gauge := func(name, help string, value uint64) {
+		out.printf("# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	counter := func(name, help string, value uint64) {
+		out.printf("# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge("nginx_connections_active", "Open client connections, including waiting ones.", s.Active)
+	gauge("nginx_connections_reading", "Connections where nginx is reading the request header.", s.Reading)
+	gauge("nginx_connections_writing", "Connections where nginx is writing the response.", s.Writing)
+	gauge("nginx_connections_waiting", "Idle keep-alive connections.", s.Waiting)
+	counter("nginx_connections_accepted_total", "Accepted client connections.", s.Accepts)
+	counter("nginx_connections_handled_total", "Handled client connections.", s.Handled)
+	counter("nginx_http_requests_total", "Client requests.", s.Requests)
+	return out.n, out.err
+}
@@ -34,6 +34,20 @@ func (m *MockManifest) EXPECT() *MockManifestMockRecorder {
 	return m.recorder
 }
 
+// AllDependencyVersions mocks base method.
+func (m *MockManifest) AllDependencyVersions(arg0 string) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AllDependencyVersions", arg0)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// AllDependencyVersions indicates an expected call of AllDependencyVersions.
+func (mr *MockManifestMockRecorder) AllDependencyVersions(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllDependencyVersions", reflect.TypeOf((*MockManifest)(nil).AllDependencyVersions), arg0)
+}
+
 // DefaultVersion mocks base method.
 func (m *MockManifest) DefaultVersion(arg0 string) (libbuildpack.Dependency, error) {
 	m.ctrl.T.Helper()
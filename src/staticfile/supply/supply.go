@@ -8,6 +8,7 @@ import (
 
 type Manifest interface {
 	DefaultVersion(string) (libbuildpack.Dependency, error)
+	AllDependencyVersions(string) []string
 }
 
 type Installer interface {
@@ -19,6 +20,10 @@ type Stager interface {
 	DepDir() string
 }
 
+// brotliModule is the dependency holding the dynamic brotli modules built
+// for an nginx version of the manifest.
+const brotliModule = "nginx-brotli"
+
 type Supplier struct {
 	Stager    Stager
 	Manifest  Manifest
@@ -49,5 +54,17 @@ func (ss *Supplier) InstallNginx() error {
 		return err
 	}
 
+	// finalize loads the modules when the Staticfile enables brotli.
+	for _, version := range ss.Manifest.AllDependencyVersions(brotliModule) {
+		if version != nginx.Version {
+			continue
+		}
+		ss.Log.Info("Installing the brotli module for nginx %s", nginx.Version)
+		module := libbuildpack.Dependency{Name: brotliModule, Version: version}
+		if err := ss.Installer.InstallDependency(module, filepath.Join(nginxDir, "modules")); err != nil {
+			return err
+		}
+	}
+
 	return ss.Stager.AddBinDependencyLink(filepath.Join(nginxDir, "sbin", "nginx"), "nginx")
 }
@@ -70,10 +70,17 @@ var _ = Describe("Supply", func() {
 	})
 
 	Describe("InstallNginx", func() {
+		var brotliVersions []string
+
 		BeforeEach(func() {
+			brotliVersions = nil
+		})
+
+		JustBeforeEach(func() {
 			dep := libbuildpack.Dependency{Name: "nginx", Version: "99.99"}
 
 			mockManifest.EXPECT().DefaultVersion("nginx").Return(dep, nil)
+			mockManifest.EXPECT().AllDependencyVersions("nginx-brotli").Return(brotliVersions)
 			mockInstaller.EXPECT().InstallDependency(dep, filepath.Join(depDir, "nginx"))
 		})
 
@@ -87,5 +94,19 @@ var _ = Describe("Supply", func() {
 
 			Expect(link).To(Equal("../nginx/sbin/nginx"))
 		})
+
+		Context("the manifest has a brotli module for the nginx version", func() {
+			BeforeEach(func() {
+				brotliVersions = []string{"99.98", "99.99"}
+			})
+
+			It("installs it into the nginx modules dir", func() {
+				module := libbuildpack.Dependency{Name: "nginx-brotli", Version: "99.99"}
+				mockInstaller.EXPECT().InstallDependency(module, filepath.Join(depDir, "nginx", "modules"))
+
+				Expect(supplier.InstallNginx()).To(Succeed())
+				Expect(buffer.String()).To(ContainSubstring("       Installing the brotli module for nginx 99.99"))
+			})
+		})
 	})
 })